@@ -0,0 +1,244 @@
+package core
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/nikkolasg/dsign/key"
+	"github.com/nikkolasg/dsign/minisign"
+	"github.com/nikkolasg/dsign/pgp"
+	"github.com/nikkolasg/dsign/ssh"
+)
+
+// Types of SignatureInfo, each one having its own Format.
+const (
+	// TypeRaw signs the message as is. The output is the raw signature.
+	TypeRaw uint32 = iota
+	// TypePGPKey self certifies the OpenPGP key of the group. The message is
+	// the user id and the timestamp is the creation time of the key. The
+	// output is the armored public key, also saved with the longterm share.
+	TypePGPKey
+	// TypePGPBinary makes an OpenPGP detached signature of the message, with
+	// the timestamp as creation time. The key must have been certified with
+	// TypePGPKey first. The output is the armored signature. The message being
+	// sent over the network, it is limited in size: it is meant for small
+	// documents such as files of checksums.
+	TypePGPBinary
+	// TypePGPText is similar to TypePGPBinary for a text document, i.e. the
+	// line endings do not matter.
+	TypePGPText
+	// TypeSSH makes an OpenSSH signature of the message within the namespace
+	// of the info, e.g. "git" to sign git commits. The output is the armored
+	// SSHSIG blob, which can be checked with "ssh-keygen -Y verify". As for
+	// TypePGPBinary, the message is limited in size.
+	TypeSSH
+	// TypeMinisign makes a minisign signature of the message, with the
+	// timestamp in the trusted comment. It needs a second distributed
+	// signature, the global one. The output is the content of the
+	// ".minisig" file.
+	TypeMinisign
+	// TypeSignify makes an OpenBSD signify signature of the message. The
+	// output is the content of the ".sig" file.
+	TypeSignify
+)
+
+// Format defines how a signature info turns into the bytes to sign with the
+// distributed key, and how the resulting signature is encoded.
+type Format interface {
+	// Message returns the bytes to sign.
+	Message(info *SignatureInfo, longterm *key.SharedPrivate) ([]byte, error)
+	// Encode returns the final output from the distributed signature.
+	Encode(info *SignatureInfo, longterm *key.SharedPrivate, sig []byte) ([]byte, error)
+}
+
+var formats = map[uint32]Format{
+	TypeRaw:       &rawFormat{},
+	TypePGPKey:    &pgpKeyFormat{},
+	TypePGPBinary: &pgpDocFormat{text: false},
+	TypePGPText:   &pgpDocFormat{text: true},
+	TypeSSH:       &sshFormat{},
+	TypeMinisign:  &minisignFormat{},
+	TypeSignify:   &signifyFormat{},
+}
+
+// chainedFormat is a Format needing a second signature over a message derived
+// from the first signature.
+type chainedFormat interface {
+	Format
+	// Next returns the message of the second signature.
+	Next(info *SignatureInfo, longterm *key.SharedPrivate, sig []byte) ([]byte, error)
+	// EncodeChained returns the final output from both signatures.
+	EncodeChained(info *SignatureInfo, longterm *key.SharedPrivate, sig, next []byte) ([]byte, error)
+}
+
+// format returns the format of the given type.
+func format(typ uint32) (Format, error) {
+	f, ok := formats[typ]
+	if !ok {
+		return nil, errors.New("dsign: unknown signature type " + strconv.Itoa(int(typ)))
+	}
+	return f, nil
+}
+
+type rawFormat struct{}
+
+func (r *rawFormat) Message(info *SignatureInfo, l *key.SharedPrivate) ([]byte, error) {
+	return []byte(info.Message), nil
+}
+
+func (r *rawFormat) Encode(info *SignatureInfo, l *key.SharedPrivate, sig []byte) ([]byte, error) {
+	return sig, nil
+}
+
+type pgpKeyFormat struct{}
+
+func (p *pgpKeyFormat) certification(info *SignatureInfo, l *key.SharedPrivate) (*pgp.PublicKey, *pgp.Signature, error) {
+	if info.Message == "" {
+		return nil, nil, errors.New("dsign: empty pgp user id")
+	}
+	pub, err := pgp.NewPublicKey(l.Share.Public(), time.Unix(info.Timestamp, 0))
+	if err != nil {
+		return nil, nil, err
+	}
+	return pub, pgp.NewCertification(pub, info.Message), nil
+}
+
+func (p *pgpKeyFormat) Message(info *SignatureInfo, l *key.SharedPrivate) ([]byte, error) {
+	_, cert, err := p.certification(info, l)
+	if err != nil {
+		return nil, err
+	}
+	return cert.Digest(), nil
+}
+
+func (p *pgpKeyFormat) Encode(info *SignatureInfo, l *key.SharedPrivate, sig []byte) ([]byte, error) {
+	pub, cert, err := p.certification(info, l)
+	if err != nil {
+		return nil, err
+	}
+	packet, err := cert.Packet(sig)
+	if err != nil {
+		return nil, err
+	}
+	block, err := pgp.PublicKeyBlock(pub, info.Message, packet)
+	return []byte(block), err
+}
+
+type pgpDocFormat struct {
+	text bool
+}
+
+func (p *pgpDocFormat) signature(info *SignatureInfo, l *key.SharedPrivate) (*pgp.Signature, error) {
+	if l.PgpCreated.IsZero() {
+		return nil, errors.New("dsign: no pgp key certified for key " + l.KeyID)
+	}
+	pub, err := pgp.NewPublicKey(l.Share.Public(), l.PgpCreated)
+	if err != nil {
+		return nil, err
+	}
+	return pgp.NewDocumentSignature(pub, []byte(info.Message), p.text, time.Unix(info.Timestamp, 0)), nil
+}
+
+func (p *pgpDocFormat) Message(info *SignatureInfo, l *key.SharedPrivate) ([]byte, error) {
+	sig, err := p.signature(info, l)
+	if err != nil {
+		return nil, err
+	}
+	return sig.Digest(), nil
+}
+
+func (p *pgpDocFormat) Encode(info *SignatureInfo, l *key.SharedPrivate, sig []byte) ([]byte, error) {
+	s, err := p.signature(info, l)
+	if err != nil {
+		return nil, err
+	}
+	armored, err := s.ArmoredPacket(sig)
+	return []byte(armored), err
+}
+
+type sshFormat struct{}
+
+func (s *sshFormat) signature(info *SignatureInfo, l *key.SharedPrivate) (*ssh.Signature, error) {
+	return ssh.NewSignature(l.Share.Public(), info.Namespace, ssh.HashSHA512, []byte(info.Message))
+}
+
+func (s *sshFormat) Message(info *SignatureInfo, l *key.SharedPrivate) ([]byte, error) {
+	sig, err := s.signature(info, l)
+	if err != nil {
+		return nil, err
+	}
+	return sig.SignedData(), nil
+}
+
+func (s *sshFormat) Encode(info *SignatureInfo, l *key.SharedPrivate, sig []byte) ([]byte, error) {
+	ss, err := s.signature(info, l)
+	if err != nil {
+		return nil, err
+	}
+	armored, err := ss.Armored(sig)
+	return []byte(armored), err
+}
+
+type minisignFormat struct{}
+
+func (m *minisignFormat) signature(info *SignatureInfo, l *key.SharedPrivate) (*minisign.Signature, error) {
+	trusted := "timestamp:" + strconv.FormatInt(info.Timestamp, 10)
+	return minisign.NewSignature(l.Share.Public(), []byte(info.Message), trusted)
+}
+
+func (m *minisignFormat) Message(info *SignatureInfo, l *key.SharedPrivate) ([]byte, error) {
+	sig, err := m.signature(info, l)
+	if err != nil {
+		return nil, err
+	}
+	return sig.Message(), nil
+}
+
+func (m *minisignFormat) Encode(info *SignatureInfo, l *key.SharedPrivate, sig []byte) ([]byte, error) {
+	return nil, errors.New("dsign: minisign signature without global signature")
+}
+
+func (m *minisignFormat) Next(info *SignatureInfo, l *key.SharedPrivate, sig []byte) ([]byte, error) {
+	s, err := m.signature(info, l)
+	if err != nil {
+		return nil, err
+	}
+	return s.GlobalMessage(sig), nil
+}
+
+func (m *minisignFormat) EncodeChained(info *SignatureInfo, l *key.SharedPrivate, sig, global []byte) ([]byte, error) {
+	s, err := m.signature(info, l)
+	if err != nil {
+		return nil, err
+	}
+	file, err := s.File(sig, global)
+	return []byte(file), err
+}
+
+type signifyFormat struct{}
+
+func (s *signifyFormat) Message(info *SignatureInfo, l *key.SharedPrivate) ([]byte, error) {
+	return []byte(info.Message), nil
+}
+
+func (s *signifyFormat) Encode(info *SignatureInfo, l *key.SharedPrivate, sig []byte) ([]byte, error) {
+	file, err := minisign.SignifyFile(l.Share.Public(), sig, "verify with "+l.KeyID+".pub")
+	return []byte(file), err
+}
+
+// PGPKeyInfo returns the signature info to self certify the OpenPGP key of the
+// given longterm key. The user id is built from the longterm key information.
+// The creation time is part of the OpenPGP fingerprint: the one of the current
+// key is used if it has already been certified.
+func PGPKeyInfo(l *key.SharedPrivate, created time.Time) *SignatureInfo {
+	if !l.PgpCreated.IsZero() {
+		created = l.PgpCreated
+	}
+	return &SignatureInfo{
+		KeyID:     l.KeyID,
+		Type:      TypePGPKey,
+		Message:   pgp.UserID(l.FullName, l.Extra, l.Email),
+		Timestamp: created.Unix(),
+	}
+}
@@ -1,8 +1,10 @@
 package core
 
 import (
+	"github.com/dedis/kyber"
 	"github.com/nikkolasg/dsign/dkg"
 	"github.com/nikkolasg/dsign/dss"
+	"github.com/nikkolasg/dsign/key"
 	"github.com/nikkolasg/dsign/net"
 )
 
@@ -26,9 +28,26 @@ type NewKeyPair struct {
 
 // LongtermProposal contains the relevant information to put in the key identity
 type LongtermProposal struct {
-	FullName string // fullname as described in pgp keys
-	Email    string // email as described in pgp keys
-	Extra    string // generic extra information to be shown before validation
+	FullName string   // fullname as described in pgp keys
+	Email    string   // email as described in pgp keys
+	Extra    string   // generic extra information to be shown before validation
+	Group    []byte   // hash of the group definition, see key.GroupIdentity.Hash
+	KeyID    string   // key whose shares are refreshed, empty for a new key
+	Reshare  *Reshare // new group of the refreshed key, nil to keep the group
+}
+
+// Reshare describes the new group a longterm key is reshared to. The members of
+// the new group which are not in the old one do not hold the key yet: they
+// learn its public information from it. The Group of the proposal is the one
+// of the old list, whose threshold is the number of coefficients of Public.
+type Reshare struct {
+	OldList    []*key.Identity // members of the group holding the key
+	List       []*key.Identity // members of the new group
+	Threshold  uint32          // threshold of the new group
+	Public     []kyber.Point   // public polynomial of the key
+	PgpID      uint64          // OpenPGP key id of the key, if certified
+	PgpCreated int64           // unix creation time of the OpenPGP key
+	PgpPublic  string          // armored OpenPGP public key
 }
 
 // NewSignature contains all packets used to create a new distributed signature
@@ -41,9 +60,11 @@ type NewSignature struct {
 
 // SignatureInfo contains all information about the message to sign
 type SignatureInfo struct {
-	KeyID   string
-	Type    uint32 // type of message
-	Message string // message to sign => dependant of type, may be only an accessor
+	KeyID     string
+	Type      uint32 // type of message, see the Type constants
+	Message   string // message to sign => dependant of type, may be only an accessor
+	Timestamp int64  // unix time of the signature, set by the initiator if empty
+	Namespace string // namespace of the signature, only used by TypeSSH
 }
 
 // Signing packets is sent to compute a distributed signature (either over a
@@ -52,4 +73,5 @@ type Signing struct {
 	SessionID []byte      // ties a signing request with a session id
 	Random    *dkg.Packet // packet to generate a random distributed key
 	Signature *dss.Packet // packet to generate a distributed signature
+	Round     uint32      // index of the signature when the format needs several
 }
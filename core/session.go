@@ -0,0 +1,251 @@
+package core
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/nikkolasg/dsign/key"
+)
+
+// Status indicates at which step a session is.
+type Status int
+
+const (
+	// StatusPending means the request is waiting to be validated
+	StatusPending Status = iota
+	// StatusKeyGeneration means a dkg is running, either for the longterm key
+	// or for the random key of a signature
+	StatusKeyGeneration
+	// StatusSigning means the dss protocol is running
+	StatusSigning
+	// StatusDone means the result is available
+	StatusDone
+	// StatusFailed means the session stopped with an error
+	StatusFailed
+	// StatusCancelled means the session has been cancelled locally
+	StatusCancelled
+)
+
+func (s Status) String() string {
+	switch s {
+	case StatusPending:
+		return "pending"
+	case StatusKeyGeneration:
+		return "key generation"
+	case StatusSigning:
+		return "signing"
+	case StatusDone:
+		return "done"
+	case StatusFailed:
+		return "failed"
+	case StatusCancelled:
+		return "cancelled"
+	default:
+		return "unknown"
+	}
+}
+
+// ErrCancelled is sent over the error channel of a session that has been
+// cancelled.
+var ErrCancelled = errors.New("dsign: session cancelled")
+
+// ErrTimeout is sent over the error channel of a session that did not finish
+// in time.
+var ErrTimeout = errors.New("dsign: session timed out")
+
+// Session is a handle over a longterm key creation or a signature creation run
+// by the State. Either the longterm share or the signature is sent over its
+// respective channel when ready; any error stopping the session is sent over
+// the error channel.
+type Session struct {
+	id          []byte
+	status      Status
+	ctx         context.Context
+	cancel      context.CancelFunc
+	longtermCh  chan *key.SharedPrivate
+	signatureCh chan []byte
+	record      *SignatureRecord // record of the signature once done
+	errCh       chan error
+	timer       *time.Timer // fails the session once the timeout is reached
+	end         time.Time   // when the session finished
+
+	sync.Mutex
+}
+
+// newSession returns a running session that fails with ErrTimeout if it is not
+// finished after the given timeout.
+func newSession(id []byte, timeout time.Duration) *Session {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &Session{
+		id:          id,
+		ctx:         ctx,
+		cancel:      cancel,
+		longtermCh:  make(chan *key.SharedPrivate, 1),
+		signatureCh: make(chan []byte, 1),
+		errCh:       make(chan error, 1),
+	}
+	s.Lock()
+	s.timer = time.AfterFunc(timeout, func() { s.fail(ErrTimeout) })
+	s.Unlock()
+	return s
+}
+
+// ID returns the identifier of the session, shared by all participants.
+func (s *Session) ID() []byte {
+	return s.id
+}
+
+// Status returns the current status of the session.
+func (s *Session) Status() Status {
+	s.Lock()
+	defer s.Unlock()
+	return s.status
+}
+
+// WaitLongterm returns a channel over which the longterm share is sent when
+// ready. Only used by longterm key creation sessions.
+func (s *Session) WaitLongterm() chan *key.SharedPrivate {
+	return s.longtermCh
+}
+
+// WaitSignature returns a channel over which the signature is sent when ready.
+// Only used by signing sessions.
+func (s *Session) WaitSignature() chan []byte {
+	return s.signatureCh
+}
+
+// WaitError returns a channel over which any error stopping the session is
+// sent to.
+func (s *Session) WaitError() chan error {
+	return s.errCh
+}
+
+// Done returns a channel that is closed when the session is finished, whatever
+// its outcome.
+func (s *Session) Done() <-chan struct{} {
+	return s.ctx.Done()
+}
+
+// Cancel stops the session locally. This node stops participating to the
+// session and ErrCancelled is sent over the error channel.
+func (s *Session) Cancel() {
+	s.Lock()
+	defer s.Unlock()
+	if s.isFinished() {
+		return
+	}
+	s.stop(StatusCancelled)
+	s.errCh <- ErrCancelled
+}
+
+// Longterm blocks until the longterm share is ready, the session fails or the
+// given context is done. The session keeps running if the context expires.
+func (s *Session) Longterm(ctx context.Context) (*key.SharedPrivate, error) {
+	select {
+	case l := <-s.longtermCh:
+		return l, nil
+	case err := <-s.errCh:
+		return nil, err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Signature blocks until the signature is ready, the session fails or the
+// given context is done. The session keeps running if the context expires.
+func (s *Session) Signature(ctx context.Context) ([]byte, error) {
+	select {
+	case sig := <-s.signatureCh:
+		return sig, nil
+	case err := <-s.errCh:
+		return nil, err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Record returns the record of the signature, containing the output encoded
+// according to the type of the signature info. It returns nil until a signing
+// session is done.
+func (s *Session) Record() *SignatureRecord {
+	s.Lock()
+	defer s.Unlock()
+	return s.record
+}
+
+// setStatus updates the status of a running session. It returns false if the
+// session is already finished.
+func (s *Session) setStatus(st Status) bool {
+	s.Lock()
+	defer s.Unlock()
+	if s.isFinished() {
+		return false
+	}
+	s.status = st
+	return true
+}
+
+func (s *Session) finishLongterm(l *key.SharedPrivate) {
+	s.Lock()
+	defer s.Unlock()
+	if s.isFinished() {
+		return
+	}
+	s.stop(StatusDone)
+	s.longtermCh <- l
+}
+
+func (s *Session) finishSignature(r *SignatureRecord) {
+	s.Lock()
+	defer s.Unlock()
+	if s.isFinished() {
+		return
+	}
+	s.record = r
+	s.stop(StatusDone)
+	s.signatureCh <- r.Signature
+}
+
+func (s *Session) fail(err error) {
+	s.Lock()
+	defer s.Unlock()
+	if s.isFinished() {
+		return
+	}
+	s.stop(StatusFailed)
+	s.errCh <- err
+}
+
+// finished returns true if the session is done, failed or cancelled.
+func (s *Session) finished() bool {
+	s.Lock()
+	defer s.Unlock()
+	return s.isFinished()
+}
+
+// expired returns true if the session finished more than d ago.
+func (s *Session) expired(d time.Duration) bool {
+	s.Lock()
+	defer s.Unlock()
+	return s.isFinished() && time.Since(s.end) > d
+}
+
+// stop sets the final status of the session. The lock must be held by the
+// caller.
+func (s *Session) stop(st Status) {
+	s.status = st
+	s.end = time.Now()
+	s.timer.Stop()
+	s.cancel()
+}
+
+func (s *Session) isFinished() bool {
+	return s.status == StatusDone || s.status == StatusFailed || s.status == StatusCancelled
+}
+
+func sessionKey(id []byte) string {
+	return hex.EncodeToString(id)
+}
@@ -0,0 +1,61 @@
+package core
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSessionTimeout(t *testing.T) {
+	session := newSession([]byte("session"), 10*time.Millisecond)
+	select {
+	case err := <-session.WaitError():
+		require.Equal(t, ErrTimeout, err)
+	case <-time.After(time.Second):
+		t.Fatal("session did not time out")
+	}
+	require.Equal(t, StatusFailed, session.Status())
+	<-session.Done()
+	require.True(t, session.expired(0))
+	require.False(t, session.expired(time.Hour))
+
+	// a finished session does not time out
+	session = newSession([]byte("session"), 10*time.Millisecond)
+	session.finishSignature(&SignatureRecord{Signature: []byte("signature")})
+	time.Sleep(20 * time.Millisecond)
+	require.Equal(t, StatusDone, session.Status())
+}
+
+func TestStateGC(t *testing.T) {
+	s := &State{
+		conf:     &Config{SessionTimeout: time.Hour},
+		signings: make(map[string]*sigState),
+		sessions: make(map[string]*Session),
+	}
+	done := s.newSigState([]byte("done"))
+	running := s.newSigState([]byte("running"))
+	done.session.finishSignature(&SignatureRecord{Signature: []byte("signature")})
+	s.gc()
+	require.Len(t, s.sessions, 2)
+
+	s.conf.SessionTimeout = time.Nanosecond
+	time.Sleep(time.Millisecond)
+	s.gc()
+	require.Len(t, s.sessions, 1)
+	require.Len(t, s.signings, 1)
+	_, ok := s.signings[sessionKey(running.id)]
+	require.True(t, ok)
+}
+
+func TestStateSignatureTimeout(t *testing.T) {
+	s := &State{
+		conf:     &Config{},
+		signings: make(map[string]*sigState),
+		sessions: make(map[string]*Session),
+	}
+	// signing always has a deadline
+	require.Equal(t, DefaultSignatureTimeout, s.newSigState([]byte("default")).timeout)
+	s.conf.SignatureTimeout = time.Second
+	require.Equal(t, time.Second, s.newSigState([]byte("custom")).timeout)
+}
@@ -0,0 +1,415 @@
+package core
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/dedis/kyber"
+	"github.com/nikkolasg/dsign/dkg"
+	"github.com/nikkolasg/dsign/dss"
+	"github.com/nikkolasg/dsign/key"
+	"github.com/nikkolasg/dsign/net"
+	"github.com/nikkolasg/dsign/pgp"
+	"github.com/nikkolasg/slog"
+	"golang.org/x/crypto/ed25519"
+)
+
+// sigState runs the creation of a distributed signature. Once the signature
+// info has been validated, it runs a dkg to generate the random distributed
+// key and then the dss protocol using both the longterm and the random key. The
+// longterm key is selected by the KeyID of the signature info. The validation
+// runs in the background and any packets received before their respective
+// handler is ready are kept until then. Formats needing a second signature
+// over the first one run the dkg and the dss again in a second round.
+type sigState struct {
+	id         []byte
+	session    *Session
+	priv       *key.Private
+	conf       *dkg.Config
+	timeout    time.Duration // deadline of the dss once the partial signature is sent
+	gw         net.Gateway
+	st         Store
+	val        Validator
+	lookup     func(string) (*lg, bool) // returns the longterm share of a key id
+	update     func(*lg) error          // saves an updated longterm share
+	longterm   *lg                      // longterm share used to sign
+	info       *SignatureInfo           // the validated signature info
+	msg        []byte                   // bytes to sign, given by the format of the info
+	validating bool                     // true once the info is being validated
+	random     *dkg.Handler             // nil until the info is validated
+	dss        *dss.Handler             // nil until the random share is generated
+	pendingDkg []*pendingDkg            // dkg packets received before the info
+	pendingDss []*pendingDss            // dss packets received before the random share
+	round      uint32                   // index of the signature being computed
+	sigs       [][]byte                 // signatures of the previous rounds
+	pendingNxt []*pendingSigning        // packets of the next round
+
+	sync.Mutex
+}
+
+// pendingDss is a dss packet received before its handler is ready.
+type pendingDss struct {
+	from   *key.Identity
+	packet *dss.Packet
+}
+
+// pendingSigning is a packet of the next round received before the current
+// round is finished.
+type pendingSigning struct {
+	from    *key.Identity
+	signing *Signing
+}
+
+func newSigState(priv *key.Private, conf *dkg.Config, timeout time.Duration, gw net.Gateway, session *Session, s Store, v Validator, lookup func(string) (*lg, bool), update func(*lg) error) *sigState {
+	return &sigState{
+		id:      session.ID(),
+		session: session,
+		priv:    priv,
+		conf:    conf,
+		timeout: timeout,
+		gw:      gw,
+		st:      s,
+		val:     v,
+		lookup:  lookup,
+		update:  update,
+	}
+}
+
+// Start broadcasts the given signature info to the group and starts the dkg
+// for the random distributed key. The signature is made with the given longterm
+// share.
+func (s *sigState) Start(si *SignatureInfo, longterm *lg) error {
+	s.Lock()
+	defer s.Unlock()
+	msg, err := message(si, longterm)
+	if err != nil {
+		return err
+	}
+	s.info = si
+	s.longterm = longterm
+	s.msg = msg
+	if err := s.startRandom(); err != nil {
+		return err
+	}
+	packet := &ProtocolPacket{
+		NewSignature: &NewSignature{
+			SessionID: s.id,
+			Info:      si,
+		},
+	}
+	if err := broadcast(s.gw, s.conf.List, packet); err != nil {
+		slog.Infof("dsign: signature info not sent to everyone: %s", err)
+	}
+	s.random.Start()
+	return nil
+}
+
+func (s *sigState) process(id *key.Identity, ns *NewSignature) {
+	s.Lock()
+	defer s.Unlock()
+	if s.session.finished() {
+		return
+	}
+	if ns.Info != nil && s.info == nil && !s.validating {
+		// validation may take a while, e.g. waiting for a human approval, so
+		// it runs in the background while the packets are kept aside
+		s.validating = true
+		go s.validateInfo(id, ns.Info)
+	}
+	if ns.Signing == nil {
+		return
+	}
+	s.processSigning(id, ns.Signing)
+}
+
+// processSigning dispatches the packet to the handler of the current round.
+// The lock must be held by the caller.
+func (s *sigState) processSigning(id *key.Identity, sg *Signing) {
+	switch {
+	case sg.Round < s.round:
+		// late packet of a previous round
+		return
+	case sg.Round == s.round+1:
+		s.pendingNxt = append(s.pendingNxt, &pendingSigning{id, sg})
+		return
+	case sg.Round > s.round:
+		return
+	}
+	switch {
+	case sg.Random != nil:
+		if s.random == nil {
+			s.pendingDkg = append(s.pendingDkg, &pendingDkg{id, sg.Random})
+			return
+		}
+		s.random.Process(id, sg.Random)
+	case sg.Signature != nil:
+		if s.dss == nil {
+			s.pendingDss = append(s.pendingDss, &pendingDss{id, sg.Signature})
+			return
+		}
+		s.dss.Process(id, sg.Signature)
+	}
+}
+
+// validateInfo validates the info received from the given identity and starts
+// the dkg for the random key if it is accepted.
+func (s *sigState) validateInfo(id *key.Identity, si *SignatureInfo) {
+	ok, reason := s.validate(si)
+	s.Lock()
+	defer s.Unlock()
+	if s.session.finished() {
+		return
+	}
+	if !ok {
+		slog.Infof("dsign: signature info from <%s> rejected: %s", id.Address, reason)
+		s.pendingDkg = nil
+		s.pendingDss = nil
+		s.session.fail(errors.New("dsign: signature info rejected: " + reason))
+		return
+	}
+	s.info = si
+	s.longterm, _ = s.lookup(si.KeyID)
+	s.msg, _ = message(si, s.longterm)
+	if err := s.startRandom(); err != nil {
+		s.pendingDkg = nil
+		s.pendingDss = nil
+		s.session.fail(err)
+		return
+	}
+	for _, p := range s.pendingDkg {
+		s.random.Process(p.from, p.packet)
+	}
+	s.pendingDkg = nil
+}
+
+func (s *sigState) validate(si *SignatureInfo) (bool, string) {
+	longterm, ok := s.lookup(si.KeyID)
+	if !ok {
+		return false, "unknown key id " + si.KeyID
+	}
+	if _, err := message(si, longterm); err != nil {
+		return false, err.Error()
+	}
+	return s.val.ValidateSignatureInfo(si)
+}
+
+// startRandom creates the dkg handler for the random distributed key and
+// waits for its outcome in the background.
+func (s *sigState) startRandom() error {
+	random, err := dkg.NewHandler(s.priv, s.conf, &randomNetwork{s, s.round})
+	if err != nil {
+		return err
+	}
+	s.session.setStatus(StatusKeyGeneration)
+	s.random = random
+	go s.waitRandom(random)
+	return nil
+}
+
+func (s *sigState) waitRandom(random *dkg.Handler) {
+	select {
+	case share := <-random.WaitShare():
+		s.startSigning(&share)
+	case err := <-random.WaitError():
+		s.fail(err)
+	case <-s.session.Done():
+	}
+}
+
+// startSigning creates the dss handler from the random share, sends our
+// partial signature and process any dss packets received so far.
+func (s *sigState) startSigning(random *dkg.Share) {
+	s.Lock()
+	if !s.session.setStatus(StatusSigning) {
+		s.Unlock()
+		return
+	}
+	conf := &dss.Config{
+		Config:           s.conf,
+		SignatureTimeout: s.timeout,
+		Longterm:         s.longterm.Share,
+		Random:           random,
+		Message:          s.msg,
+		Mode:             dss.ModeEd25519,
+	}
+	handler, err := dss.NewHandler(s.priv, conf, &dssNetwork{s, s.round})
+	if err != nil {
+		s.Unlock()
+		s.fail(err)
+		return
+	}
+	s.dss = handler
+	s.dss.Start()
+	for _, p := range s.pendingDss {
+		s.dss.Process(p.from, p.packet)
+	}
+	s.pendingDss = nil
+	s.Unlock()
+
+	select {
+	case sig := <-handler.WaitSignature():
+		s.finish(handler, sig)
+	case err := <-handler.WaitError():
+		s.fail(err)
+	case <-s.session.Done():
+	}
+}
+
+// finish verifies the signature, encodes it according to the format of the
+// info, saves its record and hands it to the session. If the format needs
+// another signature, it starts the next round instead.
+func (s *sigState) finish(handler *dss.Handler, sig []byte) {
+	if err := verify(s.longterm.Share.Public(), s.msg, sig); err != nil {
+		s.fail(err)
+		return
+	}
+	f, _ := format(s.info.Type)
+	var output []byte
+	var err error
+	if cf, ok := f.(chainedFormat); ok {
+		if len(s.sigs) == 0 {
+			s.nextRound(cf, sig)
+			return
+		}
+		output, err = cf.EncodeChained(s.info, s.longterm, s.sigs[0], sig)
+		sig = s.sigs[0]
+	} else {
+		output, err = f.Encode(s.info, s.longterm, sig)
+	}
+	if err != nil {
+		s.fail(err)
+		return
+	}
+	record := &SignatureRecord{
+		SessionID: s.id,
+		KeyID:     s.info.KeyID,
+		Info:      s.info,
+		Signature: sig,
+		Output:    output,
+		Signers:   handler.Signers(),
+		Timestamp: time.Now(),
+	}
+	if err := s.st.SaveSignature(record); err != nil {
+		s.fail(err)
+		return
+	}
+	if s.info.Type == TypePGPKey {
+		if err := s.savePGPKey(output); err != nil {
+			s.fail(err)
+			return
+		}
+	}
+	s.session.finishSignature(record)
+}
+
+// nextRound keeps the signature of the current round and starts a new dkg for
+// the signature of the message derived from it. A new random key is
+// generated since reusing one would leak the longterm key.
+func (s *sigState) nextRound(cf chainedFormat, sig []byte) {
+	s.Lock()
+	defer s.Unlock()
+	if s.session.finished() {
+		return
+	}
+	msg, err := cf.Next(s.info, s.longterm, sig)
+	if err != nil {
+		s.session.fail(err)
+		return
+	}
+	s.sigs = append(s.sigs, sig)
+	s.msg = msg
+	s.round++
+	s.dss = nil
+	if err := s.startRandom(); err != nil {
+		s.session.fail(err)
+		return
+	}
+	s.random.Start()
+	pending := s.pendingNxt
+	s.pendingNxt = nil
+	for _, p := range pending {
+		s.processSigning(p.from, p.signing)
+	}
+}
+
+// savePGPKey saves the newly certified OpenPGP key with the longterm share.
+func (s *sigState) savePGPKey(armored []byte) error {
+	pub, err := pgp.NewPublicKey(s.longterm.Share.Public(), time.Unix(s.info.Timestamp, 0))
+	if err != nil {
+		return err
+	}
+	l := *s.longterm
+	l.PgpID = pub.KeyID()
+	l.PgpCreated = pub.Created()
+	l.PgpPublic = string(armored)
+	return s.update(&l)
+}
+
+func (s *sigState) fail(err error) {
+	slog.Infof("dsign: signing session failed: %s", err)
+	s.session.fail(err)
+}
+
+// verify checks the distributed signature as a regular Ed25519 signature
+// against the given distributed public key.
+func verify(public kyber.Point, msg, sig []byte) error {
+	buff, err := public.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(ed25519.PublicKey(buff), msg, sig) {
+		return errors.New("dsign: invalid distributed signature")
+	}
+	return nil
+}
+
+// message returns the bytes to sign from the signature info, according to its
+// format.
+func message(si *SignatureInfo, longterm *lg) ([]byte, error) {
+	f, err := format(si.Type)
+	if err != nil {
+		return nil, err
+	}
+	return f.Message(si, longterm)
+}
+
+// randomNetwork sends the dkg packets of a signing session.
+type randomNetwork struct {
+	s     *sigState
+	round uint32
+}
+
+// Send implements the dkg.Network interface.
+func (r *randomNetwork) Send(id *key.Identity, p *dkg.Packet) error {
+	return send(r.s.gw, id, &ProtocolPacket{
+		NewSignature: &NewSignature{
+			SessionID: r.s.id,
+			Signing: &Signing{
+				SessionID: r.s.id,
+				Random:    p,
+				Round:     r.round,
+			},
+		},
+	})
+}
+
+// dssNetwork sends the dss packets of a signing session.
+type dssNetwork struct {
+	s     *sigState
+	round uint32
+}
+
+// Send implements the dss.Network interface.
+func (d *dssNetwork) Send(id *key.Identity, p *dss.Packet) error {
+	return send(d.s.gw, id, &ProtocolPacket{
+		NewSignature: &NewSignature{
+			SessionID: d.s.id,
+			Signing: &Signing{
+				SessionID: d.s.id,
+				Signature: p,
+				Round:     d.round,
+			},
+		},
+	})
+}
@@ -1,9 +1,17 @@
 package core
 
 import (
+	"bytes"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
+	"sort"
+	"sync"
+	"time"
 
+	"github.com/dedis/kyber"
+	"github.com/nikkolasg/dsign/dkg"
 	"github.com/nikkolasg/dsign/key"
 	"github.com/nikkolasg/dsign/net"
 	"github.com/nikkolasg/slog"
@@ -11,54 +19,360 @@ import (
 
 type lg = key.SharedPrivate
 
+// DefaultMaxSessions is the maximum number of signing sessions running at the
+// same time if none is given in the Config.
+const DefaultMaxSessions = 64
+
+// DefaultSessionTimeout is the maximum duration of a session if none is given
+// in the Config.
+const DefaultSessionTimeout = 5 * time.Minute
+
+// DefaultSignatureTimeout is the deadline to gather the partial signatures if
+// none is given in the Config.
+const DefaultSignatureTimeout = time.Minute
+
+// Config holds the information about the group of nodes running dsign
+// together.
+type Config struct {
+	// list of participants and threshold used by every sub protocol
+	*dkg.Config
+	// maximum number of signing sessions running at the same time. Requests
+	// above this limit are refused. DefaultMaxSessions if zero.
+	MaxSessions int
+	// maximum duration of a session after which it fails with ErrTimeout.
+	// Finished sessions are forgotten after the same duration.
+	// DefaultSessionTimeout if zero.
+	SessionTimeout time.Duration
+	// deadline to gather the partial signatures once this node sent its own,
+	// after which the signature fails with the participants missing.
+	// DefaultSignatureTimeout if zero.
+	SignatureTimeout time.Duration
+	// maximum duration of the validation of a request by a node, e.g. the
+	// approval timeout of a human validator. The nodes only join a dkg once
+	// they validated its request, so the first phase of the dkg timeout is
+	// extended by this duration. It must be shorter than the session timeout.
+	ValidationTimeout time.Duration
+	// period of the refresh of the shares of every longterm key, none if
+	// zero. The refresh is started by the first participant of the list.
+	RefreshPeriod time.Duration
+}
+
+func (c *Config) maxSessions() int {
+	if c.MaxSessions <= 0 {
+		return DefaultMaxSessions
+	}
+	return c.MaxSessions
+}
+
+func (c *Config) sessionTimeout() time.Duration {
+	if c.SessionTimeout <= 0 {
+		return DefaultSessionTimeout
+	}
+	return c.SessionTimeout
+}
+
+// dkgConfig returns the configuration of the dkgs run by the state, giving the
+// nodes the validation timeout to join.
+func (c *Config) dkgConfig() *dkg.Config {
+	conf := *c.Config
+	conf.JoinTimeout = c.ValidationTimeout
+	return &conf
+}
+
+func (c *Config) signatureTimeout() time.Duration {
+	if c.SignatureTimeout <= 0 {
+		return DefaultSignatureTimeout
+	}
+	return c.SignatureTimeout
+}
+
 // State is the core of dsign. It runs the necessary sub protocol (dkg / dss)
 // with the right parameters to get a dsign-ature.
 type State struct {
-	gw            net.Gateway // to send / receive packets from network
-	st            Store       // to store and load cryptographic material + signature
-	val           Validator   // to validate the requests
-	hasLongterm   bool        // true if dist. longterm key is already generated.
-	longterm      *lg         // private share of the dist. key
-	longtermState *lgState
-	signingState  *sigState
+	gw            net.Gateway              // to send / receive packets from network
+	st            Store                    // to store and load cryptographic material + signature
+	val           Validator                // to validate the requests
+	conf          *Config                  // group information
+	dkgConf       *dkg.Config              // dkg configuration, with the validation timeout
+	priv          *key.Private             // private key of this node
+	longterms     map[string]*lg           // private shares of the dist. keys indexed by key id
+	longtermState *lgState                 // current or last longterm key creation
+	signings      map[string]*sigState     // signing sessions indexed by their hex id
+	sessions      map[string]*Session      // all sessions indexed by their hex id
+	early         map[string]*earlySigning // packets of unknown signing sessions indexed by their hex id
+	ticker        *time.Ticker             // periodic refresh, nil without refresh period
+	done          chan struct{}            // closed once stopped
+
+	sync.Mutex
 }
 
-// NewState returns a new state
-func NewState(gw net.Gateway, s Store, v Validator) *State {
+// NewState returns a new state. It returns an error if the longterm private key
+// of this node can't be loaded from the Store, if the configuration is invalid
+// or if the gateway can't be started.
+func NewState(gw net.Gateway, s Store, v Validator, c *Config) (*State, error) {
+	priv, err := s.LongtermKey()
+	if err != nil {
+		return nil, err
+	}
+	dkgConf := c.dkgConfig()
+	if err := dkgConf.Validate(); err != nil {
+		return nil, err
+	}
+	if _, err := groupHash(c.Config); err != nil {
+		return nil, err
+	}
+	if c.ValidationTimeout >= c.sessionTimeout() {
+		return nil, errors.New("dsign: validation timeout longer than the session timeout")
+	}
+	if _, err := c.Config.Index(priv.Public); err != nil {
+		return nil, err
+	}
 	state := &State{
-		gw:  gw,
-		st:  s,
-		val: v,
+		gw:        gw,
+		st:        s,
+		val:       v,
+		conf:      c,
+		dkgConf:   dkgConf,
+		priv:      priv,
+		longterms: make(map[string]*lg),
+		signings:  make(map[string]*sigState),
+		sessions:  make(map[string]*Session),
+		early:     make(map[string]*earlySigning),
+		done:      make(chan struct{}),
+	}
+	shares, err := s.LongtermShares()
+	if err != nil {
+		return nil, err
+	}
+	for _, l := range shares {
+		state.longterms[l.KeyID] = l
+	}
+	if err := state.resumeLongterm(); err != nil {
+		slog.Infof("dsign: longterm key creation not resumed: %s", err)
+	}
+	if err := state.gw.Start(state.handler); err != nil {
+		return nil, err
+	}
+	if c.RefreshPeriod > 0 && c.List[0].Equals(priv.Public) {
+		state.ticker = time.NewTicker(c.RefreshPeriod)
+		go state.refreshLoop()
+	}
+	return state, nil
+}
+
+// Stop stops the periodic refresh of the shares and the gateway. The running
+// sessions fail once their timeout is reached.
+func (s *State) Stop() error {
+	s.Lock()
+	select {
+	case <-s.done:
+		s.Unlock()
+		return nil
+	default:
 	}
-	if lg, err := s.LongtermShare(); err == nil {
-		state.hasLongterm = true
-		state.longterm = lg
+	close(s.done)
+	if s.ticker != nil {
+		s.ticker.Stop()
 	}
-	go state.gw.Start(state.handler)
-	return state
+	s.Unlock()
+	return s.gw.Stop()
 }
 
 // StartNewLongterm starts the creation of a new distributed longterm key pair. Once
 // finished, the longterm distributed key pair is automatically saved thanks to
-// the Store.
-func (s *State) StartNewLongterm(lp *LongtermProposal) error {
-	if s.hasLongterm {
-		return errors.New("dsign only supports one longterm key for the moment")
+// the Store. The returned Session allows to wait for the outcome. Only one
+// longterm key creation can run at a time. The hash of the group definition is
+// added to the proposal if missing, so the other nodes can check they run the
+// dkg within the same group.
+func (s *State) StartNewLongterm(lp *LongtermProposal) (*Session, error) {
+	if lp.KeyID != "" {
+		return nil, errors.New("dsign: key id given for a new longterm key")
+	}
+	return s.startLongterm(lp)
+}
+
+// StartRefresh starts the refresh of the shares of the longterm key with the
+// given key id. The nodes reshare the key among themselves: the distributed
+// key stays the same while the previous shares become useless. The new shares
+// replace the previous ones in the Store once finished. The refresh runs in
+// place of a longterm key creation, with the same validation.
+func (s *State) StartRefresh(keyID string) (*Session, error) {
+	l, ok := s.longtermShare(keyID)
+	if !ok {
+		return nil, errors.New("dsign: unknown key id " + keyID)
+	}
+	return s.startLongterm(&LongtermProposal{
+		FullName: l.FullName,
+		Email:    l.Email,
+		Extra:    l.Extra,
+		KeyID:    keyID,
+	})
+}
+
+// StartReshare starts the resharing of the longterm key with the given key id
+// to a new group, with the given threshold. The members of the group deal
+// sub-shares of their shares to the members of the new group, which end up
+// with shares of the same distributed key. The members of the new group save
+// their shares once finished, those leaving the group keep their useless
+// previous share. The new group runs this State with its own definition: the
+// members of both groups sign with the new shares once restarted with it.
+func (s *State) StartReshare(keyID string, list []*key.Identity, threshold int) (*Session, error) {
+	l, ok := s.longtermShare(keyID)
+	if !ok {
+		return nil, errors.New("dsign: unknown key id " + keyID)
+	}
+	if err := key.NewGroupIdentity(list, threshold).Validate(); err != nil {
+		return nil, err
+	}
+	r := &Reshare{
+		OldList:   s.conf.List,
+		List:      list,
+		Threshold: uint32(threshold),
+		Public:    l.Share.Commits,
+		PgpID:     l.PgpID,
+		PgpPublic: l.PgpPublic,
+	}
+	if !l.PgpCreated.IsZero() {
+		r.PgpCreated = l.PgpCreated.Unix()
+	}
+	return s.startLongterm(&LongtermProposal{
+		FullName: l.FullName,
+		Email:    l.Email,
+		Extra:    l.Extra,
+		KeyID:    keyID,
+		Reshare:  r,
+	})
+}
+
+// refreshLoop periodically refreshes the shares of every longterm key, one
+// after the other, until the state is stopped.
+func (s *State) refreshLoop() {
+	for {
+		select {
+		case <-s.ticker.C:
+		case <-s.done:
+			return
+		}
+		s.Lock()
+		ids := make([]string, 0, len(s.longterms))
+		for id := range s.longterms {
+			ids = append(ids, id)
+		}
+		s.Unlock()
+		sort.Strings(ids)
+		for _, id := range ids {
+			session, err := s.StartRefresh(id)
+			if err != nil {
+				slog.Infof("dsign: refresh of longterm key %s not started: %s", id, err)
+				continue
+			}
+			select {
+			case <-session.Done():
+			case <-s.done:
+				return
+			}
+		}
+	}
+}
+
+// startLongterm validates the proposal and runs it in a new longterm state.
+func (s *State) startLongterm(lp *LongtermProposal) (*Session, error) {
+	if lp.Group == nil {
+		group, err := groupHash(s.conf.Config)
+		if err != nil {
+			return nil, err
+		}
+		lp.Group = group
 	}
+	if ok, err := forGroup(lp, s.conf.Config); err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, errors.New("dsign: longterm proposal for a different group")
+	}
+	// the validation may block, e.g. waiting for a human approval
 	if ok, e := s.val.ValidateLongtermInfo(lp); !ok {
-		return errors.New("validation of longterm key info failed: " + e)
+		return nil, errors.New("validation of longterm key info failed: " + e)
 	}
-	sessionID := newSessionID()
-	s.longtermState = newLongtermState(s.gw, sessionID, s.st)
-	s.longtermState.Start()
-	return nil
+	s.Lock()
+	if s.longtermState != nil && !s.longtermState.session.finished() {
+		s.Unlock()
+		return nil, errors.New("dsign: longterm key creation already running")
+	}
+	lgs := s.newLongtermState(newSessionID())
+	s.Unlock()
+	if err := lgs.Start(lp); err != nil {
+		lgs.session.fail(err)
+		return nil, err
+	}
+	return lgs.session, nil
 }
 
-// NewSignature starts the creation of a new distributed signature.
-func (s *State) NewSignature(si *SignatureInfo) error {
+// resumeLongterm resumes the longterm key creation saved in the Store, if any.
+// Its proposal has already been validated before the restart.
+func (s *State) resumeLongterm() error {
+	c, err := s.st.LoadCheckpoint()
+	if err == ErrNoCheckpoint {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	s.Lock()
+	lgs := s.newLongtermState(c.SessionID)
+	s.Unlock()
+	if err := lgs.resume(c); err != nil {
+		lgs.session.fail(err)
+		return err
+	}
+	slog.Infof("dsign: longterm key creation resumed after %d packets", len(c.Dkg.Packets))
 	return nil
 }
 
+// NewSignature starts the creation of a new distributed signature over the
+// given info. Once finished, the signature is verified and saved thanks to the
+// Store. The returned Session allows to wait for the signature. Many signing
+// sessions can run at the same time, up to the limit given in the Config. The
+// KeyID of the info selects the longterm key to sign with.
+func (s *State) NewSignature(si *SignatureInfo) (*Session, error) {
+	longterm, ok := s.longtermShare(si.KeyID)
+	if !ok {
+		return nil, errors.New("dsign: unknown key id " + si.KeyID)
+	}
+	info := *si
+	if info.Timestamp == 0 {
+		info.Timestamp = time.Now().Unix()
+	}
+	if _, err := message(&info, longterm); err != nil {
+		return nil, err
+	}
+	si = &info
+	// the validation may block, e.g. waiting for a human approval
+	if ok, e := s.val.ValidateSignatureInfo(si); !ok {
+		return nil, errors.New("validation of signature info failed: " + e)
+	}
+	s.Lock()
+	s.gc()
+	if s.runningSignings() >= s.conf.maxSessions() {
+		s.Unlock()
+		return nil, errors.New("dsign: too many signing sessions running")
+	}
+	ss := s.newSigState(newSessionID())
+	s.Unlock()
+	if err := ss.Start(si, longterm); err != nil {
+		ss.session.fail(err)
+		return nil, err
+	}
+	return ss.session, nil
+}
+
+// Session returns the session corresponding to the given id, if any. Sessions
+// started by other nodes are also accessible.
+func (s *State) Session(id []byte) (*Session, bool) {
+	s.Lock()
+	defer s.Unlock()
+	session, ok := s.sessions[sessionKey(id)]
+	return session, ok
+}
+
 // handler receives all packet from network and dispatch it to the right
 // recipients for further processing.
 func (s *State) handler(id *key.Identity, msg []byte) {
@@ -80,52 +394,580 @@ func (s *State) handler(id *key.Identity, msg []byte) {
 	}
 }
 
+// handleNewKeyPair dispatches the packet to the current longterm state. Only a
+// proposal from a member of the group starts a new longterm state once the
+// current one is finished: the dkg packets sent before it are dropped, the
+// dealers resend them once they receive our deal.
 func (s *State) handleNewKeyPair(id *key.Identity, nkp *NewKeyPair) {
-	if s.hasLongterm {
-		slog.Debugf("dsign: <%s> sent longterm creation, but already has one", id.Address)
+	s.Lock()
+	current := s.longtermState
+	if current == nil || (current.session.finished() && !bytes.Equal(current.id, nkp.SessionID)) {
+		if nkp.Proposal == nil || !s.proposer(id, nkp.Proposal) {
+			s.Unlock()
+			slog.Debugf("dsign: <%s> sent packet for an unknown longterm session", id.Address)
+			return
+		}
+		current = s.newLongtermState(nkp.SessionID)
+	}
+	s.Unlock()
+	if !bytes.Equal(current.id, nkp.SessionID) {
+		slog.Debugf("dsign: <%s> sent packet for another longterm session", id.Address)
+		return
 	}
-	if s.longterm == nil {
-		s.longtermState = newLongtermState(s.gw, nkp.SessionID, s.st)
+	current.process(id, nkp)
+}
+
+// proposer returns true if the given identity may propose a longterm key
+// creation: a member of the group, or a member of the old group resharing a key
+// to this one.
+func (s *State) proposer(id *key.Identity, lp *LongtermProposal) bool {
+	if _, err := s.conf.Index(id); err == nil {
+		return true
 	}
-	s.longtermState.process(id, nkp)
+	return lp.Reshare != nil && contains(lp.Reshare.OldList, id)
 }
 
+// handleNewSignature dispatches the packet to its signing state. Only a
+// signature info from a member of the group starts a new signing state, so
+// nobody else can use up the sessions. The other packets of a member for an
+// unknown session are kept until its info arrives.
 func (s *State) handleNewSignature(id *key.Identity, ns *NewSignature) {
+	s.Lock()
+	if len(s.longterms) == 0 {
+		s.Unlock()
+		slog.Debugf("dsign: <%s> sent signature request, but no longterm key", id.Address)
+		return
+	}
+	var early []*pendingSigning
+	current, ok := s.signings[sessionKey(ns.SessionID)]
+	if !ok {
+		if _, err := s.conf.Index(id); err != nil {
+			s.Unlock()
+			slog.Debugf("dsign: <%s> sent packet for an unknown signing session", id.Address)
+			return
+		}
+		s.gc()
+		if ns.Info == nil {
+			s.keepEarly(id, ns)
+			s.Unlock()
+			return
+		}
+		if s.runningSignings() >= s.conf.maxSessions() {
+			s.Unlock()
+			slog.Debugf("dsign: <%s> sent new signing session, but too many running", id.Address)
+			return
+		}
+		current = s.newSigState(ns.SessionID)
+		if e, ok := s.early[sessionKey(ns.SessionID)]; ok {
+			early = e.packets
+			delete(s.early, sessionKey(ns.SessionID))
+		}
+	}
+	s.Unlock()
+	current.process(id, ns)
+	for _, p := range early {
+		current.process(p.from, &NewSignature{SessionID: ns.SessionID, Signing: p.signing})
+	}
+}
+
+// earlySigning holds the packets of a signing session received before its
+// info.
+type earlySigning struct {
+	received time.Time // when the first packet was received
+	packets  []*pendingSigning
+}
+
+// keepEarly keeps the packet of a member for an unknown signing session until
+// the info of the session arrives: the random dkg of the other members may
+// start before the info of the initiator is received. At most MaxSessions
+// sessions of n(n+2) packets, enough for the deals, responses and partial
+// signatures, are kept for the session timeout. The lock must be held by the
+// caller.
+func (s *State) keepEarly(id *key.Identity, ns *NewSignature) {
+	k := sessionKey(ns.SessionID)
+	e, ok := s.early[k]
+	if !ok {
+		if ns.Signing == nil || len(s.early) >= s.conf.maxSessions() {
+			slog.Debugf("dsign: <%s> sent packet for an unknown signing session", id.Address)
+			return
+		}
+		e = &earlySigning{received: time.Now()}
+		s.early[k] = e
+	}
+	n := len(s.conf.List)
+	if ns.Signing == nil || len(e.packets) >= n*(n+2) {
+		slog.Debugf("dsign: <%s> sent too many packets for an unknown signing session", id.Address)
+		return
+	}
+	e.packets = append(e.packets, &pendingSigning{from: id, signing: ns.Signing})
+}
+
+// newLongtermState creates and registers a new longterm state. The lock must
+// be held by the caller.
+func (s *State) newLongtermState(id []byte) *lgState {
+	session := newSession(id, s.conf.sessionTimeout())
+	s.sessions[sessionKey(id)] = session
+	s.longtermState = newLongtermState(s.priv, s.dkgConf, s.gw, session, s.st, s.val, s.longtermShare, s.newLongterm)
+	return s.longtermState
+}
+
+// newSigState creates and registers a new signing state. The lock must be held
+// by the caller.
+func (s *State) newSigState(id []byte) *sigState {
+	session := newSession(id, s.conf.sessionTimeout())
+	ss := newSigState(s.priv, s.dkgConf, s.conf.signatureTimeout(), s.gw, session, s.st, s.val, s.longtermShare, s.updateLongterm)
+	s.sessions[sessionKey(id)] = session
+	s.signings[sessionKey(id)] = ss
+	return ss
+}
 
+// runningSignings returns the number of signing sessions not yet finished. The
+// lock must be held by the caller.
+func (s *State) runningSignings() int {
+	var n int
+	for _, ss := range s.signings {
+		if !ss.session.finished() {
+			n++
+		}
+	}
+	return n
+}
+
+// gc forgets about the sessions finished for longer than the session timeout.
+// Abandoned sessions are not a concern since they fail by themselves once
+// the timeout is reached. The lock must be held by the caller.
+func (s *State) gc() {
+	timeout := s.conf.sessionTimeout()
+	for k, session := range s.sessions {
+		if !session.expired(timeout) {
+			continue
+		}
+		delete(s.sessions, k)
+		delete(s.signings, k)
+	}
+	for k, e := range s.early {
+		if time.Since(e.received) > timeout {
+			delete(s.early, k)
+		}
+	}
+}
+
+// newLongterm is called by the longterm state when the distributed key has been
+// generated and saved.
+func (s *State) newLongterm(l *lg) {
+	s.Lock()
+	defer s.Unlock()
+	s.longterms[l.KeyID] = l
+}
+
+// updateLongterm saves the updated longterm share and uses it from now on.
+func (s *State) updateLongterm(l *lg) error {
+	if err := s.st.SaveLongterm(l); err != nil {
+		return err
+	}
+	s.newLongterm(l)
+	return nil
 }
 
+// longtermShare returns the longterm share corresponding to the given key id.
+// It is used by the signing states to select the key to sign with.
+func (s *State) longtermShare(keyID string) (*lg, bool) {
+	s.Lock()
+	defer s.Unlock()
+	l, ok := s.longterms[keyID]
+	return l, ok
+}
+
+// lgState runs the creation of a new longterm distributed key, or the refresh
+// of the shares of an existing one. The dkg
+// protocol only starts once the proposal has been validated in the background.
+// Any dkg packets received before are kept until then.
 type lgState struct {
-	id []byte
-	gw net.Gateway
-	st Store
+	id         []byte
+	session    *Session
+	priv       *key.Private
+	conf       *dkg.Config
+	gw         net.Gateway
+	st         Store
+	val        Validator
+	longterm   func(string) (*lg, bool) // returns the longterm share to refresh
+	cb         func(*lg)                // called once the new longterm key is saved
+	proposal   *LongtermProposal        // the validated proposal
+	validating bool                     // true once the proposal is being validated
+	saved      bool                     // true once a checkpoint has been saved
+	dkg        *dkg.Handler             // nil until the proposal is validated
+	pending    []*pendingDkg            // dkg packets received before the proposal
+
+	sync.Mutex
 }
 
-func newLongtermState(gw net.Gateway, id []byte, s Store) *lgState {
+// pendingDkg is a dkg packet received before its handler is ready.
+type pendingDkg struct {
+	from   *key.Identity
+	packet *dkg.Packet
+}
+
+func newLongtermState(priv *key.Private, conf *dkg.Config, gw net.Gateway, session *Session, s Store, v Validator, longterm func(string) (*lg, bool), cb func(*lg)) *lgState {
 	return &lgState{
-		id: id,
-		gw: gw,
-		st: s,
+		id:       session.ID(),
+		session:  session,
+		priv:     priv,
+		conf:     conf,
+		gw:       gw,
+		st:       s,
+		val:      v,
+		longterm: longterm,
+		cb:       cb,
 	}
 }
 
-func (l *lgState) Start() {
-
+// Start broadcasts the given proposal to the group and starts the dkg.
+func (l *lgState) Start(lp *LongtermProposal) error {
+	l.Lock()
+	defer l.Unlock()
+	if err := l.startDkg(lp); err != nil {
+		return err
+	}
+	l.proposal = lp
+	packet := &ProtocolPacket{
+		NewKeyPair: &NewKeyPair{
+			SessionID: l.id,
+			Proposal:  lp,
+		},
+	}
+	if err := broadcast(l.gw, participants(lp, l.conf), packet); err != nil {
+		slog.Infof("dsign: longterm proposal not sent to everyone: %s", err)
+	}
+	l.dkg.Start()
+	return nil
 }
 
 func (l *lgState) process(id *key.Identity, nkp *NewKeyPair) {
+	l.Lock()
+	defer l.Unlock()
+	if l.session.finished() {
+		return
+	}
+	if nkp.Proposal != nil && l.proposal == nil && !l.validating {
+		// validation may take a while, e.g. waiting for a human approval, so
+		// it runs in the background while the packets are kept aside
+		l.validating = true
+		go l.validateProposal(id, nkp.Proposal)
+	}
+	if nkp.Longterm == nil {
+		return
+	}
+	if l.dkg == nil {
+		l.pending = append(l.pending, &pendingDkg{id, nkp.Longterm})
+		return
+	}
+	l.dkg.Process(id, nkp.Longterm)
+}
+
+// validateProposal validates the proposal received from the given identity
+// and starts the dkg if it is accepted.
+func (l *lgState) validateProposal(id *key.Identity, lp *LongtermProposal) {
+	// no need to bother the validator with a proposal for another group
+	ok, reason := false, "different group definition"
+	if same, err := forGroup(lp, l.conf); err != nil {
+		reason = err.Error()
+	} else if same {
+		ok, reason = l.val.ValidateLongtermInfo(lp)
+	}
+	l.Lock()
+	defer l.Unlock()
+	if l.session.finished() {
+		return
+	}
+	if !ok {
+		slog.Infof("dsign: longterm proposal from <%s> rejected: %s", id.Address, reason)
+		l.pending = nil
+		l.session.fail(errors.New("dsign: longterm proposal rejected: " + reason))
+		return
+	}
+	if err := l.startDkg(lp); err != nil {
+		l.pending = nil
+		l.session.fail(err)
+		return
+	}
+	l.proposal = lp
+	for _, p := range l.pending {
+		l.dkg.Process(p.from, p.packet)
+	}
+	l.pending = nil
+}
+
+// Send implements the dkg.Network interface.
+func (l *lgState) Send(id *key.Identity, p *dkg.Packet) error {
+	return send(l.gw, id, &ProtocolPacket{
+		NewKeyPair: &NewKeyPair{
+			SessionID: l.id,
+			Longterm:  p,
+		},
+	})
+}
+
+// startDkg creates the dkg handler and waits for its outcome in the
+// background.
+func (l *lgState) startDkg(lp *LongtermProposal) error {
+	conf, err := l.dkgConfig(lp)
+	if err != nil {
+		return err
+	}
+	handler, err := dkg.NewHandler(l.priv, conf, l)
+	if err != nil {
+		return err
+	}
+	l.session.setStatus(StatusKeyGeneration)
+	l.dkg = handler
+	go l.wait()
+	return nil
+}
+
+// resume resumes the dkg from the checkpoint saved before a restart and waits
+// for its outcome in the background.
+func (l *lgState) resume(c *Checkpoint) error {
+	l.Lock()
+	defer l.Unlock()
+	conf, err := l.dkgConfig(c.Proposal)
+	if err != nil {
+		return err
+	}
+	l.proposal = c.Proposal
+	l.saved = true
+	handler, err := dkg.ResumeHandler(l.priv, conf, l, c.Dkg)
+	if err != nil {
+		return err
+	}
+	l.session.setStatus(StatusKeyGeneration)
+	l.dkg = handler
+	go l.wait()
+	return nil
+}
+
+// dkgConfig returns the configuration of the dkg running the proposal. The dkg
+// reshares the longterm key among the group when the proposal refreshes a key.
+func (l *lgState) dkgConfig(lp *LongtermProposal) (*dkg.Config, error) {
+	c := *l.conf
+	c.Checkpoint = func(t *dkg.Transcript) error {
+		return l.checkpoint(lp, t)
+	}
+	if r := lp.Reshare; r != nil {
+		if len(r.Public) == 0 || keyID(r.Public[0]) != lp.KeyID {
+			return nil, errors.New("dsign: reshare of another key than " + lp.KeyID)
+		}
+		c.OldList = r.OldList
+		c.List = r.List
+		c.Threshold = int(r.Threshold)
+		c.Public = r.Public
+		if contains(r.OldList, l.priv.Public) {
+			longterm, ok := l.longterm(lp.KeyID)
+			if !ok {
+				return nil, errors.New("dsign: no longterm share to reshare for key id " + lp.KeyID)
+			}
+			c.Share = longterm.Share
+		}
+		return &c, nil
+	}
+	if lp.KeyID != "" {
+		longterm, ok := l.longterm(lp.KeyID)
+		if !ok {
+			return nil, errors.New("dsign: no longterm share to refresh for key id " + lp.KeyID)
+		}
+		c.OldList = c.List
+		c.Public = longterm.Share.Commits
+		c.Share = longterm.Share
+	}
+	return &c, nil
+}
+
+// checkpoint saves the transcript of the dkg so it resumes after a restart. A
+// checkpoint of the same session with another seed means the dkg dealt before
+// a restart without being resumed: dealing again with fresh randomness would
+// leave the nodes with inconsistent shares, so the dkg is stopped instead. It
+// is called by the dkg handler, which is only used with the lock held.
+func (l *lgState) checkpoint(lp *LongtermProposal, t *dkg.Transcript) error {
+	if !l.saved {
+		c, err := l.st.LoadCheckpoint()
+		switch {
+		case err == ErrNoCheckpoint:
+		case err != nil:
+			return err
+		case bytes.Equal(c.SessionID, l.id) && !bytes.Equal(c.Dkg.Seed, t.Seed):
+			return errors.New("dsign: dkg already dealt before a restart")
+		}
+		l.saved = true
+	}
+	return l.st.SaveCheckpoint(&Checkpoint{
+		SessionID: l.id,
+		Proposal:  lp,
+		Dkg:       t,
+	})
+}
+
+func (l *lgState) wait() {
+	select {
+	case share := <-l.dkg.WaitShare():
+		l.save(&share)
+	case err := <-l.dkg.WaitError():
+		slog.Infof("dsign: longterm dkg failed: %s", err)
+		l.deleteCheckpoint()
+		l.session.fail(err)
+	case <-l.session.Done():
+		l.deleteCheckpoint()
+	}
+}
+
+// deleteCheckpoint deletes the checkpoint of the dkg once there is nothing left
+// to resume.
+func (l *lgState) deleteCheckpoint() {
+	if err := l.st.DeleteCheckpoint(l.id); err != nil {
+		slog.Infof("dsign: can't delete the dkg checkpoint: %s", err)
+	}
+}
+
+func (l *lgState) save(share *dkg.Share) {
+	if r := l.proposal.Reshare; r != nil && !contains(r.List, l.priv.Public) {
+		// the share dealt is useless now, there is nothing to save
+		l.deleteCheckpoint()
+		slog.Infof("dsign: longterm key %s reshared to a group without this node", l.proposal.KeyID)
+		previous, _ := l.longterm(l.proposal.KeyID)
+		l.session.finishLongterm(previous)
+		return
+	}
+	sp := &lg{
+		KeyID:    keyID(share.Public()),
+		FullName: l.proposal.FullName,
+		Email:    l.proposal.Email,
+		Extra:    l.proposal.Extra,
+		Share:    share,
+	}
+	if l.proposal.KeyID != "" {
+		if sp.KeyID != l.proposal.KeyID {
+			l.session.fail(errors.New("dsign: refresh changed the longterm key " + l.proposal.KeyID))
+			return
+		}
+		// the refreshed key keeps all its information, pgp key included
+		if previous, ok := l.longterm(l.proposal.KeyID); ok {
+			refreshed := *previous
+			refreshed.Share = share
+			sp = &refreshed
+		} else if r := l.proposal.Reshare; r != nil {
+			// a new member learns the pgp key from the proposal
+			sp.PgpID = r.PgpID
+			sp.PgpPublic = r.PgpPublic
+			if r.PgpCreated != 0 {
+				sp.PgpCreated = time.Unix(r.PgpCreated, 0)
+			}
+		}
+	}
+	if err := l.st.SaveLongterm(sp); err != nil {
+		slog.Infof("dsign: can't save longterm share: %s", err)
+		l.session.fail(err)
+		return
+	}
+	l.saveAudit(sp.KeyID)
+	// a restart before this point resumes the dkg and computes the share again
+	l.deleteCheckpoint()
+	slog.Infof("dsign: new longterm key %s saved", sp.KeyID)
+	l.cb(sp)
+	l.session.finishLongterm(sp)
+}
 
+// saveAudit saves the audit of the dkg along the new longterm share. The share
+// is usable without it, so a failure is only logged.
+func (l *lgState) saveAudit(keyID string) {
+	a, err := l.dkg.Audit()
+	if err == nil {
+		err = l.st.SaveAudit(keyID, a)
+	}
+	if err != nil {
+		slog.Infof("dsign: can't save the audit of longterm key %s: %s", keyID, err)
+	}
 }
 
-type sigState struct {
-	id []byte
-	gw net.Gateway
+// send marshals the packet and sends it to the given identity.
+func send(gw net.Gateway, id *key.Identity, p *ProtocolPacket) error {
+	buff, err := encoder.Marshal(p)
+	if err != nil {
+		return err
+	}
+	return gw.Send(id, buff)
 }
 
-func newSigState(gw net.Gateway, id []byte) *sigState {
-	return &sigState{
-		id: id,
-		gw: gw,
+// broadcast marshals the packet and sends it to every member of the list except
+// ourself.
+func broadcast(gw net.Gateway, list []*key.Identity, p *ProtocolPacket) error {
+	buff, err := encoder.Marshal(p)
+	if err != nil {
+		return err
+	}
+	return gw.Broadcast(list, buff)
+}
+
+// groupHash returns the hash of the definition of the group running the dkg
+// with the given config, so nodes can check they all run it with the same
+// participants and threshold.
+func groupHash(conf *dkg.Config) ([]byte, error) {
+	return key.NewGroupIdentity(conf.List, conf.Threshold).Hash()
+}
+
+// forGroup returns true if the proposal is meant for the group running the dkg
+// with the given config. A reshare is meant for both the old and the new group.
+// It returns an error if the hash of one of the groups can't be computed.
+func forGroup(lp *LongtermProposal, conf *dkg.Config) (bool, error) {
+	group, err := groupHash(conf)
+	if err != nil {
+		return false, err
+	}
+	r := lp.Reshare
+	if r == nil {
+		return bytes.Equal(lp.Group, group), nil
+	}
+	old, err := key.NewGroupIdentity(r.OldList, len(r.Public)).Hash()
+	if err != nil {
+		return false, err
+	}
+	next, err := key.NewGroupIdentity(r.List, int(r.Threshold)).Hash()
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(lp.Group, old) && (bytes.Equal(group, old) || bytes.Equal(group, next)), nil
+}
+
+// participants returns the members of the group running the proposal: both
+// the old and the new group for a reshare.
+func participants(lp *LongtermProposal, conf *dkg.Config) []*key.Identity {
+	if lp.Reshare == nil {
+		return conf.List
+	}
+	list := append([]*key.Identity{}, lp.Reshare.OldList...)
+	for _, id := range lp.Reshare.List {
+		if !contains(list, id) {
+			list = append(list, id)
+		}
+	}
+	return list
+}
+
+func contains(list []*key.Identity, id *key.Identity) bool {
+	for _, i := range list {
+		if i.Equals(id) {
+			return true
+		}
+	}
+	return false
+}
+
+// keyID returns the hexadecimal representation of the first 8 bytes of the
+// sha256 hash of the distributed public key.
+func keyID(public kyber.Point) string {
+	buff, err := public.MarshalBinary()
+	if err != nil {
+		panic(err)
 	}
+	h := sha256.Sum256(buff)
+	return hex.EncodeToString(h[:8])
 }
 
 func newSessionID() []byte {
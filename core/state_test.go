@@ -1 +1,943 @@
 package core
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nikkolasg/dsign/dkg"
+	"github.com/nikkolasg/dsign/key"
+	"github.com/nikkolasg/dsign/net"
+	"github.com/nikkolasg/dsign/net/transport/noise"
+	"github.com/nikkolasg/dsign/ssh"
+	"github.com/nikkolasg/dsign/test"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ed25519"
+)
+
+// memStore is a Store keeping everything in memory
+type memStore struct {
+	priv       *key.Private
+	longterms  map[string]*key.SharedPrivate
+	audits     map[string][]byte // protobuf encoded audits
+	signatures []*SignatureRecord
+	checkpoint []byte // protobuf encoded checkpoint
+	last       []byte // last checkpoint saved, even if deleted since
+	savedCh    chan bool
+	sync.Mutex
+}
+
+func newMemStore(priv *key.Private) *memStore {
+	return &memStore{
+		priv:      priv,
+		longterms: make(map[string]*key.SharedPrivate),
+		audits:    make(map[string][]byte),
+		savedCh:   make(chan bool, 1),
+	}
+}
+
+func (m *memStore) LongtermKey() (*key.Private, error) {
+	return m.priv, nil
+}
+
+func (m *memStore) LongtermShares() ([]*key.SharedPrivate, error) {
+	m.Lock()
+	defer m.Unlock()
+	var shares []*key.SharedPrivate
+	for _, s := range m.longterms {
+		shares = append(shares, s)
+	}
+	return shares, nil
+}
+
+func (m *memStore) LongtermShare(keyID string) (*key.SharedPrivate, error) {
+	m.Lock()
+	defer m.Unlock()
+	s, ok := m.longterms[keyID]
+	if !ok {
+		return nil, errors.New("no longterm share for " + keyID)
+	}
+	return s, nil
+}
+
+func (m *memStore) SaveLongterm(s *key.SharedPrivate) error {
+	m.Lock()
+	m.longterms[s.KeyID] = s
+	m.Unlock()
+	m.savedCh <- true
+	return nil
+}
+
+func (m *memStore) SaveAudit(keyID string, a *dkg.Audit) error {
+	buff, err := MarshalAudit(a)
+	if err != nil {
+		return err
+	}
+	m.Lock()
+	defer m.Unlock()
+	m.audits[keyID] = buff
+	return nil
+}
+
+func (m *memStore) LongtermAudit(keyID string) (*dkg.Audit, error) {
+	m.Lock()
+	defer m.Unlock()
+	buff, ok := m.audits[keyID]
+	if !ok {
+		return nil, ErrNoAudit
+	}
+	return UnmarshalAudit(buff)
+}
+
+func (m *memStore) SaveSignature(r *SignatureRecord) error {
+	m.Lock()
+	defer m.Unlock()
+	m.signatures = append(m.signatures, r)
+	return nil
+}
+
+func (m *memStore) GetSignature(sessionID []byte) (*SignatureRecord, error) {
+	m.Lock()
+	defer m.Unlock()
+	for _, r := range m.signatures {
+		if bytes.Equal(r.SessionID, sessionID) {
+			return r, nil
+		}
+	}
+	return nil, ErrNoSignature
+}
+
+func (m *memStore) ListSignatures(keyID string, since time.Time) ([]*SignatureRecord, error) {
+	m.Lock()
+	defer m.Unlock()
+	var records []*SignatureRecord
+	for _, r := range m.signatures {
+		if (keyID == "" || r.KeyID == keyID) && !r.Timestamp.Before(since) {
+			records = append(records, r)
+		}
+	}
+	return records, nil
+}
+
+func (m *memStore) SaveCheckpoint(c *Checkpoint) error {
+	buff, err := MarshalCheckpoint(c)
+	if err != nil {
+		return err
+	}
+	m.Lock()
+	defer m.Unlock()
+	m.checkpoint = buff
+	m.last = buff
+	return nil
+}
+
+func (m *memStore) LoadCheckpoint() (*Checkpoint, error) {
+	m.Lock()
+	defer m.Unlock()
+	if m.checkpoint == nil {
+		return nil, ErrNoCheckpoint
+	}
+	return UnmarshalCheckpoint(m.checkpoint)
+}
+
+func (m *memStore) DeleteCheckpoint(sessionID []byte) error {
+	c, err := m.LoadCheckpoint()
+	if err != nil {
+		return nil
+	}
+	m.Lock()
+	defer m.Unlock()
+	if bytes.Equal(c.SessionID, sessionID) {
+		m.checkpoint = nil
+	}
+	return nil
+}
+
+type okValidator struct{}
+
+func (o *okValidator) ValidateLongtermInfo(*LongtermProposal) (bool, string) { return true, "" }
+func (o *okValidator) ValidateSignatureInfo(*SignatureInfo) (bool, string)   { return true, "" }
+
+// gatedValidator accepts every signature info once its gate is closed.
+type gatedValidator struct {
+	gate chan bool
+}
+
+func (g *gatedValidator) ValidateLongtermInfo(*LongtermProposal) (bool, string) { return true, "" }
+func (g *gatedValidator) ValidateSignatureInfo(*SignatureInfo) (bool, string) {
+	<-g.gate
+	return true, ""
+}
+
+func newStates(t *testing.T, privs []*key.Private, gws []net.Gateway, thr int) ([]*State, []*memStore) {
+	return newStatesWithConfig(t, privs, gws, &Config{Config: &dkg.Config{Threshold: thr}})
+}
+
+// newStatesWithConfig creates the states using the given config, only the list
+// of participants is filled in.
+func newStatesWithConfig(t *testing.T, privs []*key.Private, gws []net.Gateway, conf *Config) ([]*State, []*memStore) {
+	return newStatesWithValidators(t, privs, gws, conf, func(int) Validator { return &okValidator{} })
+}
+
+// newStatesWithValidators creates the states using the validator returned by
+// val for each of them.
+func newStatesWithValidators(t *testing.T, privs []*key.Private, gws []net.Gateway, conf *Config, val func(int) Validator) ([]*State, []*memStore) {
+	conf.List = test.ListFromPrivates(privs)
+	states := make([]*State, len(privs))
+	stores := make([]*memStore, len(privs))
+	for i := range privs {
+		stores[i] = newMemStore(privs[i])
+		s, err := NewState(gws[i], stores[i], val(i), conf)
+		require.Nil(t, err)
+		states[i] = s
+	}
+	time.Sleep(10 * time.Millisecond)
+	return states, stores
+}
+
+func stopGateways(gws []net.Gateway) {
+	for i := range gws {
+		gws[i].Stop()
+	}
+}
+
+// newLongterm runs a longterm key creation and waits until every node has
+// saved its share. It returns the share of the first node.
+func newLongterm(t *testing.T, states []*State, stores []*memStore, lp *LongtermProposal) *key.SharedPrivate {
+	session, err := states[0].StartNewLongterm(lp)
+	require.Nil(t, err)
+	longterm := waitLongterm(t, states, stores, session)
+	require.Equal(t, lp.FullName, longterm.FullName)
+	return longterm
+}
+
+// waitLongterm waits until every node has saved its share of the longterm key
+// created or refreshed by the given session of the first node. It returns the
+// share of the first node.
+func waitLongterm(t *testing.T, states []*State, stores []*memStore, session *Session) *key.SharedPrivate {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	longterm, err := session.Longterm(ctx)
+	require.Nil(t, err)
+	require.Equal(t, StatusDone, session.Status())
+	for i := range stores {
+		select {
+		case <-stores[i].savedCh:
+		case <-time.After(5 * time.Second):
+			t.Fatal("longterm share not saved")
+		}
+	}
+	// the state is notified right after the store, and a new longterm
+	// creation is only accepted once the previous session is finished
+	for i := range states {
+		remote, ok := states[i].Session(session.ID())
+		require.True(t, ok)
+		select {
+		case <-remote.Done():
+		case <-time.After(5 * time.Second):
+			t.Fatal("longterm session not finished")
+		}
+	}
+	return longterm
+}
+
+func TestStateLongterm(t *testing.T) {
+	n := 5
+	thr := n/2 + 1
+	privs, gws := test.Gateways(n)
+	defer stopGateways(gws)
+	states, stores := newStates(t, privs, gws, thr)
+
+	lp := &LongtermProposal{FullName: "dsign", Email: "dsign@dsign.io"}
+	longterm := newLongterm(t, states, stores, lp)
+	public := longterm.Share.Public()
+	for _, s := range stores {
+		share, err := s.LongtermShare(longterm.KeyID)
+		require.Nil(t, err)
+		require.True(t, public.Equal(share.Share.Public()))
+		require.Equal(t, lp.Email, share.Email)
+		// the audit of the dkg is saved along the share
+		audit, err := s.LongtermAudit(longterm.KeyID)
+		require.Nil(t, err)
+		audited, err := audit.Verify()
+		require.Nil(t, err)
+		require.True(t, public.Equal(audited))
+	}
+
+	// a bare dkg packet of an unknown session, or a proposal from outside the
+	// group, does not prevent a new longterm key creation
+	_, stranger := test.FakeID("127.0.0.1:1")
+	bare, err := encoder.Marshal(&ProtocolPacket{NewKeyPair: &NewKeyPair{
+		SessionID: newSessionID(),
+		Longterm:  &dkg.Packet{},
+	}})
+	require.Nil(t, err)
+	states[0].handler(privs[1].Public, bare)
+	proposal, err := encoder.Marshal(&ProtocolPacket{NewKeyPair: &NewKeyPair{
+		SessionID: newSessionID(),
+		Proposal:  &LongtermProposal{FullName: "stray", Group: lp.Group},
+	}})
+	require.Nil(t, err)
+	states[0].handler(stranger, proposal)
+
+	// a second longterm key can be created
+	lp2 := &LongtermProposal{FullName: "dsign infra"}
+	longterm2 := newLongterm(t, states, stores, lp2)
+	require.NotEqual(t, longterm.KeyID, longterm2.KeyID)
+	for _, s := range stores {
+		shares, err := s.LongtermShares()
+		require.Nil(t, err)
+		require.Len(t, shares, 2)
+	}
+}
+
+func TestStateSignature(t *testing.T) {
+	n := 5
+	thr := n/2 + 1
+	privs, gws := test.Gateways(n)
+	defer stopGateways(gws)
+	states, stores := newStates(t, privs, gws, thr)
+
+	_, err := states[0].NewSignature(&SignatureInfo{Message: "Hello World"})
+	require.NotNil(t, err)
+
+	longterm := newLongterm(t, states, stores, &LongtermProposal{FullName: "dsign"})
+
+	_, err = states[0].NewSignature(&SignatureInfo{KeyID: "unknown", Message: "Hello World"})
+	require.NotNil(t, err)
+
+	info := &SignatureInfo{KeyID: longterm.KeyID, Message: "Hello World"}
+	session, err := states[0].NewSignature(info)
+	require.Nil(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	sig, err := session.Signature(ctx)
+	require.Nil(t, err)
+	require.Nil(t, verify(longterm.Share.Public(), []byte(info.Message), sig))
+
+	// a signature info from outside the group, or a bare packet of an
+	// unknown session, does not start a signing session
+	_, stranger := test.FakeID("127.0.0.1:1")
+	request := &NewSignature{SessionID: newSessionID(), Info: info}
+	buff, err := encoder.Marshal(&ProtocolPacket{NewSignature: request})
+	require.Nil(t, err)
+	states[0].handler(stranger, buff)
+	_, ok := states[0].Session(request.SessionID)
+	require.False(t, ok)
+	bare := &NewSignature{SessionID: newSessionID(), Signing: &Signing{}}
+	buff, err = encoder.Marshal(&ProtocolPacket{NewSignature: bare})
+	require.Nil(t, err)
+	states[0].handler(privs[1].Public, buff)
+	_, ok = states[0].Session(bare.SessionID)
+	require.False(t, ok)
+	// the packet of a member waits for the info, not the one of a stranger
+	states[0].handler(stranger, buff)
+	states[0].Lock()
+	early := states[0].early[sessionKey(bare.SessionID)]
+	states[0].Unlock()
+	require.Len(t, early.packets, 1)
+
+	// other nodes also know about the session and keep a record of the
+	// signature
+	for i, st := range stores {
+		remote, ok := states[i].Session(session.ID())
+		require.True(t, ok)
+		select {
+		case <-remote.Done():
+		case <-time.After(5 * time.Second):
+			t.Fatal("remote session not finished")
+		}
+		require.Equal(t, StatusDone, remote.Status())
+		record, err := st.GetSignature(session.ID())
+		require.Nil(t, err)
+		require.Equal(t, sig, record.Signature)
+		require.Equal(t, longterm.KeyID, record.KeyID)
+		require.Equal(t, info.Message, record.Info.Message)
+		require.Len(t, record.Signers, thr)
+	}
+}
+
+func TestStateSessionCancel(t *testing.T) {
+	n := 5
+	thr := n/2 + 1
+	privs, gws := test.Gateways(n)
+	defer stopGateways(gws)
+	states, stores := newStates(t, privs, gws, thr)
+	longterm := newLongterm(t, states, stores, &LongtermProposal{FullName: "dsign"})
+
+	info := &SignatureInfo{KeyID: longterm.KeyID, Message: "Hello World"}
+	// a deadline on the caller side does not stop the session
+	session, err := states[0].NewSignature(info)
+	require.Nil(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Nanosecond)
+	defer cancel()
+	_, err = session.Signature(ctx)
+	require.Equal(t, context.DeadlineExceeded, err)
+	_, err = session.Signature(context.Background())
+	require.Nil(t, err)
+	// cancelling a finished session does nothing
+	session.Cancel()
+	require.Equal(t, StatusDone, session.Status())
+
+	session, err = states[0].NewSignature(info)
+	require.Nil(t, err)
+	session.Cancel()
+	require.Equal(t, StatusCancelled, session.Status())
+	_, err = session.Signature(context.Background())
+	require.Equal(t, ErrCancelled, err)
+}
+
+func TestStateConcurrentSignatures(t *testing.T) {
+	n := 5
+	thr := n/2 + 1
+	privs, gws := test.Gateways(n)
+	defer stopGateways(gws)
+	states, stores := newStates(t, privs, gws, thr)
+	longterm := newLongterm(t, states, stores, &LongtermProposal{FullName: "dsign"})
+
+	nbSigs := 10
+	infos := make([]*SignatureInfo, nbSigs)
+	sessions := make([]*Session, nbSigs)
+	for i := range sessions {
+		// every node starts some sessions
+		infos[i] = &SignatureInfo{KeyID: longterm.KeyID, Message: fmt.Sprintf("artifact %d", i)}
+		session, err := states[i%n].NewSignature(infos[i])
+		require.Nil(t, err)
+		sessions[i] = session
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	for i, session := range sessions {
+		sig, err := session.Signature(ctx)
+		require.Nil(t, err)
+		require.Nil(t, verify(longterm.Share.Public(), []byte(infos[i].Message), sig))
+	}
+}
+
+func TestStateMaxSessions(t *testing.T) {
+	n := 5
+	thr := n/2 + 1
+	privs, gws := test.Gateways(n)
+	defer stopGateways(gws)
+	conf := &Config{Config: &dkg.Config{Threshold: thr}, MaxSessions: 1}
+	states, stores := newStatesWithConfig(t, privs, gws, conf)
+	longterm := newLongterm(t, states, stores, &LongtermProposal{FullName: "dsign"})
+
+	info := &SignatureInfo{KeyID: longterm.KeyID, Message: "Hello World"}
+	session, err := states[0].NewSignature(info)
+	require.Nil(t, err)
+	_, err = states[0].NewSignature(info)
+	require.NotNil(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err = session.Signature(ctx)
+	require.Nil(t, err)
+	// finished sessions do not count, once every node is done with it
+	for _, s := range states {
+		remote, ok := s.Session(session.ID())
+		require.True(t, ok)
+		<-remote.Done()
+	}
+	session, err = states[0].NewSignature(info)
+	require.Nil(t, err)
+	_, err = session.Signature(ctx)
+	require.Nil(t, err)
+}
+
+func TestStateMultipleLongterms(t *testing.T) {
+	n := 5
+	thr := n/2 + 1
+	privs, gws := test.Gateways(n)
+	defer stopGateways(gws)
+	states, stores := newStates(t, privs, gws, thr)
+	release := newLongterm(t, states, stores, &LongtermProposal{FullName: "release"})
+	infra := newLongterm(t, states, stores, &LongtermProposal{FullName: "infra"})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, longterm := range []*key.SharedPrivate{release, infra} {
+		info := &SignatureInfo{KeyID: longterm.KeyID, Message: "Hello " + longterm.FullName}
+		session, err := states[1].NewSignature(info)
+		require.Nil(t, err)
+		sig, err := session.Signature(ctx)
+		require.Nil(t, err)
+		require.Nil(t, verify(longterm.Share.Public(), []byte(info.Message), sig))
+	}
+
+	// the shares are loaded back from the store
+	_, gws2 := test.Gateways(1)
+	defer stopGateways(gws2)
+	state, err := NewState(gws2[0], stores[0], &okValidator{}, states[0].conf)
+	require.Nil(t, err)
+	_, ok := state.longtermShare(release.KeyID)
+	require.True(t, ok)
+	_, ok = state.longtermShare(infra.KeyID)
+	require.True(t, ok)
+}
+
+func TestStateSlowValidator(t *testing.T) {
+	n := 5
+	thr := n/2 + 1
+	privs, gws := test.Gateways(n)
+	defer stopGateways(gws)
+	gate := make(chan bool)
+	val := func(i int) Validator {
+		if i == 0 {
+			return &okValidator{}
+		}
+		return &gatedValidator{gate}
+	}
+	conf := &Config{Config: &dkg.Config{Threshold: thr}}
+	states, stores := newStatesWithValidators(t, privs, gws, conf, val)
+	longterm := newLongterm(t, states, stores, &LongtermProposal{FullName: "dsign"})
+
+	info := &SignatureInfo{KeyID: longterm.KeyID, Message: "Hello World"}
+	var sessions []*Session
+	for i := 0; i < 2; i++ {
+		session, err := states[0].NewSignature(info)
+		require.Nil(t, err)
+		sessions = append(sessions, session)
+	}
+	// the other nodes wait for their validator without blocking the
+	// processing of packets of other sessions
+	for _, session := range sessions {
+		var remote *Session
+		for remote == nil {
+			time.Sleep(10 * time.Millisecond)
+			remote, _ = states[1].Session(session.ID())
+		}
+		require.Equal(t, StatusPending, remote.Status())
+	}
+
+	close(gate)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for _, session := range sessions {
+		_, err := session.Signature(ctx)
+		require.Nil(t, err)
+	}
+}
+
+func TestStateSlowApproval(t *testing.T) {
+	n := 5
+	thr := n/2 + 1
+	privs, gws := test.Gateways(n)
+	defer stopGateways(gws)
+	gate := make(chan bool)
+	val := func(i int) Validator {
+		if i == 0 {
+			return &okValidator{}
+		}
+		return &gatedValidator{gate}
+	}
+	timeout := 100 * time.Millisecond
+	conf := &Config{Config: &dkg.Config{Threshold: thr, Timeout: timeout}, ValidationTimeout: DefaultSessionTimeout}
+	conf.List = test.ListFromPrivates(privs)
+	_, err := NewState(gws[0], newMemStore(privs[0]), &okValidator{}, conf)
+	require.NotNil(t, err)
+
+	conf.ValidationTimeout = 5 * time.Second
+	states, stores := newStatesWithValidators(t, privs, gws, conf, val)
+	longterm := newLongterm(t, states, stores, &LongtermProposal{FullName: "dsign"})
+
+	session, err := states[0].NewSignature(&SignatureInfo{KeyID: longterm.KeyID, Message: "Hello World"})
+	require.Nil(t, err)
+	// the approval takes longer than the dkg timeout of the initiator
+	time.Sleep(5 * timeout)
+	require.Equal(t, StatusKeyGeneration, session.Status())
+	close(gate)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err = session.Signature(ctx)
+	require.Nil(t, err)
+}
+
+func TestStatePGPKey(t *testing.T) {
+	n := 5
+	thr := n/2 + 1
+	privs, gws := test.Gateways(n)
+	defer stopGateways(gws)
+	states, stores := newStates(t, privs, gws, thr)
+	longterm := newLongterm(t, states, stores, &LongtermProposal{FullName: "dsign", Email: "dsign@dsign.io"})
+
+	_, err := states[0].NewSignature(&SignatureInfo{KeyID: longterm.KeyID, Type: 42})
+	require.NotNil(t, err)
+	// no pgp key yet
+	_, err = states[0].NewSignature(&SignatureInfo{KeyID: longterm.KeyID, Type: TypePGPBinary})
+	require.NotNil(t, err)
+
+	info := PGPKeyInfo(longterm, time.Now())
+	require.Equal(t, "dsign <dsign@dsign.io>", info.Message)
+	session, err := states[0].NewSignature(info)
+	require.Nil(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err = session.Signature(ctx)
+	require.Nil(t, err)
+	output := string(session.Record().Output)
+	require.True(t, strings.Contains(output, "PGP PUBLIC KEY BLOCK"))
+
+	// every node saves the pgp key with its share
+	for i := range states {
+		remote, ok := states[i].Session(session.ID())
+		require.True(t, ok)
+		<-remote.Done()
+		share, err := stores[i].LongtermShare(longterm.KeyID)
+		require.Nil(t, err)
+		require.Equal(t, output, share.PgpPublic)
+		require.NotEqual(t, uint64(0), share.PgpID)
+		require.Equal(t, info.Timestamp, share.PgpCreated.Unix())
+	}
+	// the key keeps its creation time when certified again
+	l, _ := states[0].longtermShare(longterm.KeyID)
+	require.Equal(t, info.Timestamp, PGPKeyInfo(l, time.Now().Add(time.Hour)).Timestamp)
+	g := l.GroupIdentity(states[0].conf.List, thr)
+	require.Equal(t, output, g.PgpPublic)
+
+	// detached signature of a document with the certified key
+	doc := &SignatureInfo{KeyID: longterm.KeyID, Type: TypePGPText, Message: "sha256 dsign-v1.0.tar.gz\n"}
+	session, err = states[0].NewSignature(doc)
+	require.Nil(t, err)
+	_, err = session.Signature(ctx)
+	require.Nil(t, err)
+	require.True(t, strings.Contains(string(session.Record().Output), "PGP SIGNATURE"))
+}
+
+func TestStateSSH(t *testing.T) {
+	n := 5
+	thr := n/2 + 1
+	privs, gws := test.Gateways(n)
+	defer stopGateways(gws)
+	states, stores := newStates(t, privs, gws, thr)
+	longterm := newLongterm(t, states, stores, &LongtermProposal{FullName: "dsign", Email: "dsign@dsign.io"})
+
+	// a namespace is required
+	_, err := states[0].NewSignature(&SignatureInfo{KeyID: longterm.KeyID, Type: TypeSSH, Message: "commit"})
+	require.NotNil(t, err)
+
+	info := &SignatureInfo{KeyID: longterm.KeyID, Type: TypeSSH, Message: "tree 4b825dc6\n", Namespace: "git"}
+	session, err := states[0].NewSignature(info)
+	require.Nil(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err = session.Signature(ctx)
+	require.Nil(t, err)
+	output := string(session.Record().Output)
+	require.True(t, strings.HasPrefix(output, ssh.ArmorBegin))
+	record, err := stores[0].GetSignature(session.ID())
+	require.Nil(t, err)
+	require.Equal(t, "git", record.Info.Namespace)
+}
+
+func TestStateMinisign(t *testing.T) {
+	n := 5
+	thr := n/2 + 1
+	privs, gws := test.Gateways(n)
+	defer stopGateways(gws)
+	states, stores := newStates(t, privs, gws, thr)
+	longterm := newLongterm(t, states, stores, &LongtermProposal{FullName: "dsign", Email: "dsign@dsign.io"})
+	pub, err := longterm.Share.Public().MarshalBinary()
+	require.Nil(t, err)
+
+	// the minisign signature needs a second round for the global signature
+	info := &SignatureInfo{KeyID: longterm.KeyID, Type: TypeMinisign, Message: "sha256 dsign-v1.0.tar.gz\n"}
+	session, err := states[0].NewSignature(info)
+	require.Nil(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	sig, err := session.Signature(ctx)
+	require.Nil(t, err)
+	lines := strings.Split(string(session.Record().Output), "\n")
+	require.Len(t, lines, 5)
+	data, err := base64.StdEncoding.DecodeString(lines[1])
+	require.Nil(t, err)
+	require.Equal(t, sig, data[10:])
+	trusted := strings.TrimPrefix(lines[2], "trusted comment: ")
+	global, err := base64.StdEncoding.DecodeString(lines[3])
+	require.Nil(t, err)
+	require.True(t, ed25519.Verify(ed25519.PublicKey(pub), append(sig, trusted...), global))
+	for i := range states {
+		remote, ok := states[i].Session(session.ID())
+		require.True(t, ok)
+		<-remote.Done()
+		require.Equal(t, StatusDone, remote.Status())
+	}
+
+	info = &SignatureInfo{KeyID: longterm.KeyID, Type: TypeSignify, Message: "SHA256 (dsign-v1.0.tar.gz) = 01234\n"}
+	session, err = states[0].NewSignature(info)
+	require.Nil(t, err)
+	sig, err = session.Signature(ctx)
+	require.Nil(t, err)
+	require.True(t, ed25519.Verify(ed25519.PublicKey(pub), []byte(info.Message), sig))
+}
+
+func TestStateRefresh(t *testing.T) {
+	n := 5
+	thr := n/2 + 1
+	privs, gws := test.Gateways(n)
+	defer stopGateways(gws)
+	states, stores := newStates(t, privs, gws, thr)
+	longterm := newLongterm(t, states, stores, &LongtermProposal{FullName: "dsign", Email: "dsign@dsign.io"})
+	previous := make([]*key.SharedPrivate, n)
+	for i, st := range stores {
+		var err error
+		previous[i], err = st.LongtermShare(longterm.KeyID)
+		require.Nil(t, err)
+	}
+
+	_, err := states[0].StartRefresh("unknown")
+	require.NotNil(t, err)
+	_, err = states[0].StartNewLongterm(&LongtermProposal{FullName: "dsign", KeyID: longterm.KeyID})
+	require.NotNil(t, err)
+
+	session, err := states[1].StartRefresh(longterm.KeyID)
+	require.Nil(t, err)
+	waitLongterm(t, states, stores, session)
+	checkRefreshed(t, stores, previous)
+
+	// the refreshed shares sign with the same key
+	info := &SignatureInfo{KeyID: longterm.KeyID, Message: "Hello World"}
+	session, err = states[0].NewSignature(info)
+	require.Nil(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	sig, err := session.Signature(ctx)
+	require.Nil(t, err)
+	require.Nil(t, verify(longterm.Share.Public(), []byte(info.Message), sig))
+}
+
+// checkRefreshed checks that the stores hold new shares of the same key as the
+// previous shares.
+func checkRefreshed(t *testing.T, stores []*memStore, previous []*key.SharedPrivate) {
+	for i, st := range stores {
+		refreshed, err := st.LongtermShare(previous[i].KeyID)
+		require.Nil(t, err)
+		require.Equal(t, previous[i].FullName, refreshed.FullName)
+		require.Equal(t, previous[i].Email, refreshed.Email)
+		require.True(t, previous[i].Share.Public().Equal(refreshed.Share.Public()))
+		require.Equal(t, previous[i].Share.Share.I, refreshed.Share.Share.I)
+		require.False(t, previous[i].Share.Share.V.Equal(refreshed.Share.Share.V))
+	}
+}
+
+func TestStateRefreshPeriod(t *testing.T) {
+	n := 5
+	thr := n/2 + 1
+	privs, gws := test.Gateways(n)
+	defer stopGateways(gws)
+	conf := &Config{Config: &dkg.Config{Threshold: thr}, RefreshPeriod: time.Second}
+	states, stores := newStatesWithConfig(t, privs, gws, conf)
+	longterm := newLongterm(t, states, stores, &LongtermProposal{FullName: "dsign"})
+	previous := make([]*key.SharedPrivate, n)
+	for i, st := range stores {
+		var err error
+		previous[i], err = st.LongtermShare(longterm.KeyID)
+		require.Nil(t, err)
+	}
+
+	for i := range stores {
+		select {
+		case <-stores[i].savedCh:
+		case <-time.After(5 * time.Second):
+			t.Fatal("longterm share not refreshed")
+		}
+	}
+	checkRefreshed(t, stores, previous)
+
+	// no refresh once stopped
+	require.Nil(t, states[0].Stop())
+	require.Nil(t, states[0].Stop())
+	select {
+	case <-stores[1].savedCh:
+		t.Fatal("longterm share refreshed after stop")
+	case <-time.After(2 * conf.RefreshPeriod):
+	}
+}
+
+func TestStateReshare(t *testing.T) {
+	n := 5
+	thr := n/2 + 1
+	privs, gws := test.Gateways(n + 1)
+	defer stopGateways(gws)
+	states, stores := newStates(t, privs[:n], gws[:n], thr)
+	longterm := newLongterm(t, states, stores, &LongtermProposal{FullName: "dsign", Email: "dsign@dsign.io"})
+	certified := *longterm
+	certified.PgpID = 0xdeadbeefcafe
+	certified.PgpPublic = "-----BEGIN PGP PUBLIC KEY BLOCK-----"
+	require.Nil(t, states[0].updateLongterm(&certified))
+	<-stores[0].savedCh
+
+	// the first node leaves and a new one joins, with a higher threshold
+	newList := test.ListFromPrivates(privs[1:])
+	newThr := thr + 1
+	newConf := &Config{Config: &dkg.Config{List: newList, Threshold: newThr}}
+	newcomer := newMemStore(privs[n])
+	state, err := NewState(gws[n], newcomer, &okValidator{}, newConf)
+	require.Nil(t, err)
+	states = append(states, state)
+	stores = append(stores, newcomer)
+	time.Sleep(10 * time.Millisecond)
+
+	_, err = states[0].StartReshare("unknown", newList, newThr)
+	require.NotNil(t, err)
+	_, err = states[0].StartReshare(longterm.KeyID, newList, 1)
+	require.NotNil(t, err)
+	session, err := states[0].StartReshare(longterm.KeyID, newList, newThr)
+	require.Nil(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err = session.Longterm(ctx)
+	require.Nil(t, err)
+	for i, st := range stores[1:] {
+		select {
+		case <-st.savedCh:
+		case <-time.After(5 * time.Second):
+			t.Fatal("reshared share not saved")
+		}
+		reshared, err := st.LongtermShare(longterm.KeyID)
+		require.Nil(t, err)
+		require.Equal(t, longterm.FullName, reshared.FullName)
+		require.True(t, longterm.Share.Public().Equal(reshared.Share.Public()))
+		require.Len(t, reshared.Share.Commits, newThr)
+		require.Equal(t, i, reshared.Share.Share.I)
+	}
+	// the newcomer learns the pgp key from the proposal
+	reshared, err := newcomer.LongtermShare(longterm.KeyID)
+	require.Nil(t, err)
+	require.Equal(t, certified.PgpID, reshared.PgpID)
+	require.Equal(t, certified.PgpPublic, reshared.PgpPublic)
+
+	// the members of the new group sign once restarted with its definition
+	require.Nil(t, states[0].Stop())
+	for i := 1; i <= n; i++ {
+		require.Nil(t, states[i].Stop())
+		gw := net.NewGateway(privs[i].Public, noise.NewTCPNoiseTransport(privs[i], test.ListFromPrivates(privs)))
+		defer gw.Stop()
+		states[i], err = NewState(gw, stores[i], &okValidator{}, newConf)
+		require.Nil(t, err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	info := &SignatureInfo{KeyID: longterm.KeyID, Message: "Hello World"}
+	session, err = states[n].NewSignature(info)
+	require.Nil(t, err)
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	sig, err := session.Signature(ctx)
+	require.Nil(t, err)
+	require.Nil(t, verify(longterm.Share.Public(), []byte(info.Message), sig))
+}
+
+func TestStateGroupMismatch(t *testing.T) {
+	n := 5
+	thr := n/2 + 1
+	privs, gws := test.Gateways(n)
+	defer stopGateways(gws)
+	list := test.ListFromPrivates(privs)
+	states := make([]*State, n)
+	for i := range privs {
+		// the last node runs with a different threshold
+		conf := &Config{Config: &dkg.Config{List: list, Threshold: thr}}
+		if i == n-1 {
+			conf.Threshold = thr + 1
+		}
+		s, err := NewState(gws[i], newMemStore(privs[i]), &okValidator{}, conf)
+		require.Nil(t, err)
+		states[i] = s
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	_, err := states[0].StartNewLongterm(&LongtermProposal{FullName: "dsign", Group: []byte("other group")})
+	require.NotNil(t, err)
+
+	lp := &LongtermProposal{FullName: "dsign"}
+	session, err := states[0].StartNewLongterm(lp)
+	require.Nil(t, err)
+	group, err := key.NewGroupIdentity(list, thr).Hash()
+	require.Nil(t, err)
+	require.Equal(t, group, lp.Group)
+	// the dkg can't finish without the last node
+	defer func() {
+		for _, s := range states {
+			if remote, ok := s.Session(session.ID()); ok {
+				remote.Cancel()
+			}
+		}
+	}()
+
+	var remote *Session
+	for remote == nil {
+		time.Sleep(10 * time.Millisecond)
+		remote, _ = states[n-1].Session(session.ID())
+	}
+	select {
+	case <-remote.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("proposal for another group not rejected")
+	}
+	require.Equal(t, StatusFailed, remote.Status())
+}
+
+func TestStateResumeLongterm(t *testing.T) {
+	n := 5
+	thr := n/2 + 1
+	privs, gws := test.Gateways(n)
+	defer stopGateways(gws)
+	states, stores := newStates(t, privs, gws, thr)
+
+	lp := &LongtermProposal{FullName: "dsign", Email: "dsign@dsign.io"}
+	longterm := newLongterm(t, states, stores, lp)
+	last := n - 1
+	for _, s := range stores {
+		_, err := s.LoadCheckpoint()
+		require.Equal(t, ErrNoCheckpoint, err)
+		require.NotNil(t, s.last)
+	}
+	previous, err := stores[last].LongtermShare(longterm.KeyID)
+	require.Nil(t, err)
+
+	// the node restarts before saving its share: the dkg resumes from the
+	// checkpoint and gives the same share again
+	stores[last].checkpoint = stores[last].last
+	require.Nil(t, states[last].resumeLongterm())
+	select {
+	case <-stores[last].savedCh:
+	case <-time.After(5 * time.Second):
+		t.Fatal("longterm share not saved")
+	}
+	resumed, err := stores[last].LongtermShare(longterm.KeyID)
+	require.Nil(t, err)
+	require.True(t, previous.Share.Share.V.Equal(resumed.Share.Share.V))
+	require.Equal(t, lp.Email, resumed.Email)
+
+	// the dkg of the same session never deals with another seed
+	stores[last].checkpoint = stores[last].last
+	c, err := stores[last].LoadCheckpoint()
+	require.Nil(t, err)
+	states[last].Lock()
+	lgs := states[last].newLongtermState(c.SessionID)
+	states[last].Unlock()
+	require.NotNil(t, lgs.checkpoint(lp, &dkg.Transcript{Seed: make([]byte, 32)}))
+	require.Nil(t, lgs.checkpoint(lp, c.Dkg))
+}
+
+func TestStateInvalidConfig(t *testing.T) {
+	privs, gws := test.Gateways(3)
+	list := test.ListFromPrivates(privs)
+	store := newMemStore(privs[0])
+	// threshold too high
+	conf := &Config{Config: &dkg.Config{List: list, Threshold: 4}}
+	_, err := NewState(gws[0], store, &okValidator{}, conf)
+	require.NotNil(t, err)
+	// not part of the group
+	conf = &Config{Config: &dkg.Config{List: list[1:], Threshold: 2}}
+	_, err = NewState(gws[0], store, &okValidator{}, conf)
+	require.NotNil(t, err)
+}
@@ -1,23 +1,131 @@
 package core
 
-import "github.com/nikkolasg/dsign/key"
+import (
+	"errors"
+	"time"
+
+	"github.com/nikkolasg/dsign/dkg"
+	"github.com/nikkolasg/dsign/key"
+	"github.com/nikkolasg/dsign/net"
+)
 
 // Store is an interface that allows to save and load cryptograhic materials as
 // well as signatures.
 type Store interface {
 	KeyStore
 	SignatureStore
+	CheckpointStore
 }
 
-// KeyStore is an interface that allows to retrieve and save longterm key material
+// KeyStore is an interface that allows to retrieve and save longterm key
+// material. A node can hold many longterm shares, each indexed by the KeyID of
+// its distributed key.
 type KeyStore interface {
 	LongtermKey() (*key.Private, error)
-	LongtermShare() (*key.SharedPrivate, error)
+	// LongtermShares returns all the longterm shares of this node.
+	LongtermShares() ([]*key.SharedPrivate, error)
+	// LongtermShare returns the longterm share corresponding to the given key
+	// id or an error if there is none.
+	LongtermShare(keyID string) (*key.SharedPrivate, error)
 	SaveLongterm(*key.SharedPrivate) error
+	// SaveAudit saves the audit of the last creation of the longterm key with
+	// the given id, alongside its share.
+	SaveAudit(keyID string, a *dkg.Audit) error
+	// LongtermAudit returns the audit saved for the given key id or
+	// ErrNoAudit.
+	LongtermAudit(keyID string) (*dkg.Audit, error)
+}
+
+// ErrNoAudit is returned by a KeyStore when no audit is saved for a key.
+var ErrNoAudit = errors.New("dsign: no audit found")
+
+// auditEncoder marshals and unmarshals dkg.Audit protobuf encoded
+var auditEncoder = net.NewSingleProtoEncoder(&dkg.Audit{})
+
+// MarshalAudit returns the protobuf encoding of the audit.
+func MarshalAudit(a *dkg.Audit) ([]byte, error) {
+	return auditEncoder.Marshal(a)
+}
+
+// UnmarshalAudit reads the audit from its protobuf encoding.
+func UnmarshalAudit(buff []byte) (*dkg.Audit, error) {
+	msg, err := auditEncoder.Unmarshal(buff)
+	if err != nil {
+		return nil, err
+	}
+	return msg.(*dkg.Audit), nil
+}
+
+// CheckpointStore is an interface that allows to save the state of the
+// running longterm key creation, so it resumes after a restart of the node.
+// Only one longterm key creation runs at a time, so a checkpoint replaces the
+// previous one.
+type CheckpointStore interface {
+	SaveCheckpoint(c *Checkpoint) error
+	// LoadCheckpoint returns the last saved checkpoint or ErrNoCheckpoint.
+	LoadCheckpoint() (*Checkpoint, error)
+	// DeleteCheckpoint deletes the saved checkpoint if it belongs to the given
+	// session.
+	DeleteCheckpoint(sessionID []byte) error
+}
+
+// ErrNoCheckpoint is returned by a CheckpointStore when no checkpoint is saved.
+var ErrNoCheckpoint = errors.New("dsign: no checkpoint found")
+
+// checkpointEncoder marshals and unmarshals Checkpoint protobuf encoded
+var checkpointEncoder = net.NewSingleProtoEncoder(&Checkpoint{})
+
+// Checkpoint holds the state of a running longterm key creation. It contains
+// the seed of the deals of this node which gives away its contribution to the
+// distributed key: it MUST stay as private as a longterm share.
+type Checkpoint struct {
+	SessionID []byte            // session of the longterm key creation
+	Proposal  *LongtermProposal // the validated proposal
+	Dkg       *dkg.Transcript   // transcript of the dkg so far
+}
+
+// MarshalCheckpoint returns the protobuf encoding of the checkpoint.
+func MarshalCheckpoint(c *Checkpoint) ([]byte, error) {
+	return checkpointEncoder.Marshal(c)
 }
 
-// SignatureStore is an interface that allows to store the distributed
-// signatures generated by dsign.
+// UnmarshalCheckpoint reads the checkpoint from its protobuf encoding.
+func UnmarshalCheckpoint(buff []byte) (*Checkpoint, error) {
+	msg, err := checkpointEncoder.Unmarshal(buff)
+	if err != nil {
+		return nil, err
+	}
+	c := msg.(*Checkpoint)
+	if c.Proposal == nil || c.Dkg == nil {
+		return nil, errors.New("dsign: incomplete checkpoint")
+	}
+	return c, nil
+}
+
+// SignatureStore is an interface that allows to store and retrieve the
+// distributed signatures generated by dsign.
 type SignatureStore interface {
-	SaveSignature()
+	SaveSignature(r *SignatureRecord) error
+	// GetSignature returns the record of the signature created during the given
+	// session or ErrNoSignature.
+	GetSignature(sessionID []byte) (*SignatureRecord, error)
+	// ListSignatures returns the records of the signatures made with the given
+	// key since the given time, ordered by time. An empty key id returns the
+	// signatures of all keys.
+	ListSignatures(keyID string, since time.Time) ([]*SignatureRecord, error)
+}
+
+// ErrNoSignature is returned by a SignatureStore when no signature is found.
+var ErrNoSignature = errors.New("dsign: no signature found")
+
+// SignatureRecord contains a distributed signature as well as everything
+// needed to audit it later on.
+type SignatureRecord struct {
+	SessionID []byte          // session during which the signature was made
+	KeyID     string          // longterm key used to sign
+	Info      *SignatureInfo  // the validated signature info
+	Signature []byte          // the distributed signature
+	Output    []byte          // the signature encoded according to the info type
+	Signers   []*key.Identity // participants whose partial signatures were used
+	Timestamp time.Time       // when the signature was made
 }
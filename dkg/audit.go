@@ -0,0 +1,364 @@
+package dkg
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+
+	"github.com/dedis/kyber"
+	"github.com/dedis/kyber/share"
+	"github.com/dedis/kyber/share/dkg/pedersen"
+	"github.com/dedis/kyber/share/vss/pedersen"
+	"github.com/dedis/kyber/sign/schnorr"
+	"github.com/nikkolasg/dsign/key"
+)
+
+// auditVersion is written first in the signed hash of an audit.
+const auditVersion = "dsign-dkg-audit-v1"
+
+// Audit is the public record of a run of the protocol, as seen by one of its
+// participants and signed by it. It holds the commitments of the deals, those
+// of the qualified dealers giving the distributed key, along with the
+// responses and justifications showing that the participants approved the
+// qualified deals and that the disqualified dealers revealed an invalid deal.
+// It holds no secret and can be published, e.g. encoded with a net.Encoder,
+// for anyone to check with Verify how the distributed key was generated.
+type Audit struct {
+	List      []*key.Identity // participants receiving a share
+	Threshold int             // threshold of the new key
+	// OldList and Public are the current share holders and the public
+	// polynomial of the reshared key, nil for a new key.
+	OldList        []*key.Identity
+	Public         []kyber.Point
+	Commitments    []*Commitment        // commitments of the deals received
+	Responses      []*dkg.Response      // signed responses to the deals
+	Justifications []*dkg.Justification // justifications answering complaints
+	QUAL           []uint32             // indexes of the qualified dealers
+	Disqualified   []uint32             // indexes of the dealers with an invalid justification
+	Key            kyber.Point          // the distributed public key
+	Signer         *key.Identity        // participant signing the audit
+	Signature      []byte               // ed25519 signature of the participant
+}
+
+// Commitment holds the public commitments of the polynomial dealt by a dealer.
+type Commitment struct {
+	Index     uint32        // index of the dealer
+	SessionID []byte        // id of the deal, which binds the commitments
+	Points    []kyber.Point // commitments of the coefficients
+}
+
+// Audit returns the audit of the protocol signed by this node. It returns an
+// error until the distributed key share is created, and for a node leaving
+// the group since it does not see the commitments of the deals.
+func (h *Handler) Audit() (*Audit, error) {
+	h.Lock()
+	defer h.Unlock()
+	if h.dks == nil {
+		return nil, errors.New("dkg: no audit without a distributed key share")
+	}
+	a := &Audit{
+		List:           h.conf.List,
+		Threshold:      h.conf.Threshold,
+		OldList:        h.conf.OldList,
+		Public:         h.conf.Public,
+		Responses:      append(append([]*dkg.Response{}, h.responses...), h.received...),
+		Justifications: h.justifs,
+		Key:            h.dks.Public(),
+		Signer:         h.id,
+	}
+	verifiers := h.state.Verifiers()
+	for i := range h.dealers() {
+		v, ok := verifiers[uint32(i)]
+		if !ok || v.Deal() == nil {
+			continue
+		}
+		a.Commitments = append(a.Commitments, &Commitment{
+			Index:     uint32(i),
+			SessionID: v.Deal().SessionID,
+			Points:    v.Deal().Commitments,
+		})
+		if h.disqualified[uint32(i)] {
+			a.Disqualified = append(a.Disqualified, uint32(i))
+		}
+	}
+	for _, i := range h.final {
+		a.QUAL = append(a.QUAL, uint32(i))
+	}
+	a.Signature = h.priv.Sign(a.hash())
+	return a, nil
+}
+
+// Verify checks the audit and returns the distributed public key recomputed
+// from the commitments of the qualified dealers. It checks that the audit is
+// signed by a participant, that each qualified deal is approved by at least a
+// threshold of participants, either by their signed response or by the
+// justification of the dealer answering their complaint, and that each
+// disqualified dealer signed a justification revealing an invalid deal. The
+// recomputed key must be the key of the audit and, when resharing, the
+// reshared key.
+func (a *Audit) Verify() (kyber.Point, error) {
+	if err := a.validate(); err != nil {
+		return nil, err
+	}
+	if !contains(a.List, a.Signer) && !contains(a.OldList, a.Signer) {
+		return nil, errors.New("dkg: audit signed by a non participant")
+	}
+	if err := a.Signer.VerifySignature(a.hash(), a.Signature); err != nil {
+		return nil, errors.New("dkg: invalid audit signature")
+	}
+	conf := &Config{List: a.List, Threshold: a.Threshold, OldList: a.OldList, Public: a.Public}
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+	dealers, dealThreshold := a.List, a.Threshold
+	if conf.resharing() {
+		dealers, dealThreshold = a.OldList, len(a.Public)
+	}
+	if len(a.QUAL) < dealThreshold {
+		return nil, fmt.Errorf("dkg: only %d qualified dealers (threshold %d)", len(a.QUAL), dealThreshold)
+	}
+	verifiers := key.IdentitiesToPoints(a.List)
+	commitments := make(map[uint32]*Commitment)
+	for _, c := range a.Commitments {
+		if int(c.Index) >= len(dealers) || commitments[c.Index] != nil {
+			return nil, fmt.Errorf("dkg: invalid commitments of dealer %d", c.Index)
+		}
+		dealer := dealers[c.Index].Point()
+		if len(c.Points) != a.Threshold || !bytes.Equal(c.SessionID, sessionID(dealer, verifiers, c.Points, a.Threshold)) {
+			return nil, fmt.Errorf("dkg: commitments of dealer %d do not match its deal", c.Index)
+		}
+		commitments[c.Index] = c
+	}
+	pubs := make([]*share.PubShare, len(dealers))
+	sum := key.Curve.Point().Null()
+	for _, i := range a.QUAL {
+		c, ok := commitments[i]
+		if !ok || pubs[i] != nil {
+			return nil, fmt.Errorf("dkg: invalid qualified dealer %d", i)
+		}
+		approvals, err := a.approvals(c, dealers[i].Point(), verifiers)
+		if err != nil {
+			return nil, err
+		}
+		if idx, err := conf.Index(dealers[i]); err == nil {
+			// a dealer approves its own deal without a response
+			approvals[uint32(idx)] = true
+		}
+		if len(approvals) < a.Threshold {
+			return nil, fmt.Errorf("dkg: deal of dealer %d approved by %d participants (threshold %d)", i, len(approvals), a.Threshold)
+		}
+		pubs[i] = &share.PubShare{I: int(i), V: c.Points[0]}
+		sum.Add(sum, c.Points[0])
+	}
+	for _, i := range a.Disqualified {
+		c, ok := commitments[i]
+		if !ok || pubs[i] != nil {
+			return nil, fmt.Errorf("dkg: invalid disqualified dealer %d", i)
+		}
+		if !a.disqualifies(c, dealers[i].Point(), verifiers) {
+			return nil, fmt.Errorf("dkg: no invalid justification disqualifying dealer %d", i)
+		}
+	}
+	public := sum
+	if conf.resharing() {
+		var err error
+		if public, err = share.RecoverCommit(key.Curve, pubs, dealThreshold, len(dealers)); err != nil {
+			return nil, err
+		}
+		if !public.Equal(a.Public[0]) {
+			return nil, errors.New("dkg: resharing changed the distributed key")
+		}
+	}
+	if !public.Equal(a.Key) {
+		return nil, errors.New("dkg: commitments do not give the distributed key of the audit")
+	}
+	return public, nil
+}
+
+// approvals returns the indexes of the participants approving the deal with
+// the given commitments. It returns an error if a signed complaint against
+// the deal is not answered by a valid justification.
+func (a *Audit) approvals(c *Commitment, dealer kyber.Point, verifiers []kyber.Point) (map[uint32]bool, error) {
+	approvals, complaints := a.responses(c, verifiers)
+	for _, just := range a.justifications(c, dealer, verifiers) {
+		if checkJustification(just, c.SessionID, c.Points) != nil {
+			continue
+		}
+		approvals[just.Index] = true
+		delete(complaints, just.Index)
+	}
+	for i := range complaints {
+		if !approvals[i] {
+			return nil, fmt.Errorf("dkg: complaint of participant %d against dealer %d not justified", i, c.Index)
+		}
+	}
+	return approvals, nil
+}
+
+// disqualifies returns true if the audit holds a justification of the dealer
+// answering a signed complaint against its deal with a deal which does not
+// verify against the given commitments.
+func (a *Audit) disqualifies(c *Commitment, dealer kyber.Point, verifiers []kyber.Point) bool {
+	_, complaints := a.responses(c, verifiers)
+	for _, just := range a.justifications(c, dealer, verifiers) {
+		if complaints[just.Index] && checkJustification(just, c.SessionID, c.Points) != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// responses returns the indexes of the participants approving and complaining
+// against the deal with the given commitments by a signed response.
+func (a *Audit) responses(c *Commitment, verifiers []kyber.Point) (approvals, complaints map[uint32]bool) {
+	approvals = make(map[uint32]bool)
+	complaints = make(map[uint32]bool)
+	for _, r := range a.Responses {
+		resp := r.Response
+		if r.Index != c.Index || !bytes.Equal(resp.SessionID, c.SessionID) || int(resp.Index) >= len(verifiers) {
+			continue
+		}
+		if schnorr.Verify(key.Curve, verifiers[resp.Index], resp.Hash(key.Curve), resp.Signature) != nil {
+			continue
+		}
+		if resp.Status {
+			approvals[resp.Index] = true
+		} else {
+			complaints[resp.Index] = true
+		}
+	}
+	return approvals, complaints
+}
+
+// justifications returns the justifications signed by the dealer for the deal
+// with the given commitments.
+func (a *Audit) justifications(c *Commitment, dealer kyber.Point, verifiers []kyber.Point) []*vss.Justification {
+	var justs []*vss.Justification
+	for _, j := range a.Justifications {
+		just := j.Justification
+		if j.Index != c.Index || !bytes.Equal(just.SessionID, c.SessionID) || int(just.Index) >= len(verifiers) {
+			continue
+		}
+		if schnorr.Verify(key.Curve, dealer, just.Hash(key.Curve), just.Signature) != nil {
+			continue
+		}
+		justs = append(justs, just)
+	}
+	return justs
+}
+
+// checkJustification returns an error if the deal revealed by the
+// justification is not the deal of the complaining participant verifying
+// against the commitments of the deal with the given session id.
+func checkJustification(just *vss.Justification, sid []byte, commitments []kyber.Point) error {
+	deal := just.Deal
+	switch {
+	case deal.SecShare == nil || deal.SecShare.I != int(just.Index):
+		return errors.New("deal not for the complaining verifier")
+	case !bytes.Equal(deal.SessionID, sid) || int(deal.T) != len(commitments):
+		return errors.New("deal not matching the commitments")
+	case !share.NewPubPoly(key.Curve, nil, commitments).Check(deal.SecShare):
+		return errors.New("share does not verify against the commitments")
+	}
+	return nil
+}
+
+// validate returns an error if a field needed to verify the audit is missing.
+func (a *Audit) validate() error {
+	if a.Key == nil || a.Signer == nil {
+		return errors.New("dkg: incomplete audit")
+	}
+	for _, c := range a.Commitments {
+		if c == nil {
+			return errors.New("dkg: incomplete audit commitments")
+		}
+	}
+	for _, r := range a.Responses {
+		if r == nil || r.Response == nil {
+			return errors.New("dkg: incomplete audit response")
+		}
+	}
+	for _, j := range a.Justifications {
+		if j == nil || j.Justification == nil || j.Justification.Deal == nil {
+			return errors.New("dkg: incomplete audit justification")
+		}
+	}
+	return nil
+}
+
+// hash returns the hash of everything in the audit but the signature.
+func (a *Audit) hash() []byte {
+	h := sha256.New()
+	h.Write([]byte(auditVersion))
+	writeUint(h, uint64(a.Threshold))
+	for _, list := range [][]*key.Identity{a.List, a.OldList} {
+		writeUint(h, uint64(len(list)))
+		for _, id := range list {
+			writeBytes(h, id.Key)
+		}
+	}
+	writePoints(h, a.Public)
+	writeUint(h, uint64(len(a.Commitments)))
+	for _, c := range a.Commitments {
+		writeUint(h, uint64(c.Index))
+		writeBytes(h, c.SessionID)
+		writePoints(h, c.Points)
+	}
+	writeUint(h, uint64(len(a.Responses)))
+	for _, r := range a.Responses {
+		writeUint(h, uint64(r.Index))
+		writeBytes(h, r.Response.Hash(key.Curve))
+		writeBytes(h, r.Response.Signature)
+	}
+	writeUint(h, uint64(len(a.Justifications)))
+	for _, j := range a.Justifications {
+		writeUint(h, uint64(j.Index))
+		writeBytes(h, j.Justification.Hash(key.Curve))
+		writeBytes(h, j.Justification.Signature)
+	}
+	for _, list := range [][]uint32{a.QUAL, a.Disqualified} {
+		writeUint(h, uint64(len(list)))
+		for _, i := range list {
+			writeUint(h, uint64(i))
+		}
+	}
+	writePoints(h, []kyber.Point{a.Key})
+	writeBytes(h, a.Signer.Key)
+	return h.Sum(nil)
+}
+
+// sessionID returns the id of a deal as computed by the vss library. The
+// responses refer to the deal by this id, which binds them to its
+// commitments.
+func sessionID(dealer kyber.Point, verifiers, commitments []kyber.Point, t int) []byte {
+	h := key.Curve.Hash()
+	dealer.MarshalTo(h)
+	for _, v := range verifiers {
+		v.MarshalTo(h)
+	}
+	for _, c := range commitments {
+		c.MarshalTo(h)
+	}
+	binary.Write(h, binary.LittleEndian, uint32(t))
+	return h.Sum(nil)
+}
+
+func writeUint(h hash.Hash, i uint64) {
+	binary.Write(h, binary.BigEndian, i)
+}
+
+func writeBytes(h hash.Hash, b []byte) {
+	writeUint(h, uint64(len(b)))
+	h.Write(b)
+}
+
+func writePoints(h hash.Hash, points []kyber.Point) {
+	writeUint(h, uint64(len(points)))
+	for _, p := range points {
+		buff, _ := p.MarshalBinary()
+		writeBytes(h, buff)
+	}
+}
@@ -0,0 +1,179 @@
+package dkg
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dedis/kyber/share/dkg/pedersen"
+	"github.com/dedis/kyber/sign/schnorr"
+	"github.com/nikkolasg/dsign/key"
+	"github.com/nikkolasg/dsign/net"
+	"github.com/nikkolasg/dsign/test"
+	"github.com/stretchr/testify/require"
+)
+
+var audits = net.NewSingleProtoEncoder(&Audit{})
+
+// checkAudits checks the audits of the given networks, once encoded and
+// decoded, give the distributed key of the shares.
+func checkAudits(t *testing.T, nets []*network, shares []Share) []*Audit {
+	var list []*Audit
+	for i, n := range nets {
+		a, err := n.dkg.Audit()
+		require.Nil(t, err)
+		buff, err := audits.Marshal(a)
+		require.Nil(t, err)
+		decoded, err := audits.Unmarshal(buff)
+		require.Nil(t, err)
+		a = decoded.(*Audit)
+		public, err := a.Verify()
+		require.Nil(t, err)
+		require.True(t, shares[i].Public().Equal(public))
+		list = append(list, a)
+	}
+	return list
+}
+
+func TestAudit(t *testing.T) {
+	n := 5
+	thr := n/2 + 1
+	privs, gws := test.Gateways(n)
+	nets := onlineNetworks(privs, gws, n, false, thr, 5*time.Second)
+	defer stopnetworks(nets)
+
+	_, err := nets[0].dkg.Audit()
+	require.NotNil(t, err)
+	shares := waitShares(t, nets)
+	a := checkAudits(t, nets, shares)[0]
+	require.Len(t, a.QUAL, n)
+	require.Len(t, a.Commitments, n)
+
+	// sign the audit again with the key of the first node after tampering
+	resign := func(tamper func(*Audit)) error {
+		decoded, err := audits.Unmarshal(mustMarshal(t, a))
+		require.Nil(t, err)
+		tampered := decoded.(*Audit)
+		tamper(tampered)
+		tampered.Signature = privs[0].Sign(tampered.hash())
+		_, err = tampered.Verify()
+		return err
+	}
+	require.Nil(t, resign(func(*Audit) {}))
+	// the signature covers the whole audit
+	tampered := *a
+	tampered.QUAL = a.QUAL[1:]
+	_, err = tampered.Verify()
+	require.NotNil(t, err)
+	require.NotNil(t, resign(func(a *Audit) {
+		a.Signer = privs[n-1].Public
+	}))
+	require.NotNil(t, resign(func(a *Audit) {
+		a.Key = key.Curve.Point().Pick(key.Curve.RandomStream())
+	}))
+	require.NotNil(t, resign(func(a *Audit) {
+		c := a.Commitments[1]
+		c.Points[1] = key.Curve.Point().Pick(key.Curve.RandomStream())
+	}))
+	require.NotNil(t, resign(func(a *Audit) {
+		a.QUAL = a.QUAL[:thr-1]
+	}))
+	// the deals need a threshold of approvals
+	require.NotNil(t, resign(func(a *Audit) {
+		var responses []*dkg.Response
+		for _, r := range a.Responses {
+			if r.Index != 0 {
+				responses = append(responses, r)
+			}
+		}
+		a.Responses = responses
+	}))
+	// a complaint must be justified
+	require.NotNil(t, resign(func(a *Audit) {
+		for _, r := range a.Responses {
+			if r.Index == 0 && r.Response.Index == 1 {
+				r.Response.Status = false
+				sig, err := schnorr.Sign(key.Curve, privs[1].Scalar(), r.Response.Hash(key.Curve))
+				require.Nil(t, err)
+				r.Response.Signature = sig
+			}
+		}
+	}))
+}
+
+func mustMarshal(t *testing.T, a *Audit) []byte {
+	buff, err := audits.Marshal(a)
+	require.Nil(t, err)
+	return buff
+}
+
+func TestAuditTimeout(t *testing.T) {
+	n := 5
+	thr := n/2 + 1
+	privs, gws := test.Gateways(n)
+	nets := onlineNetworks(privs, gws, n-1, false, thr, time.Second)
+	defer stopnetworks(nets)
+
+	shares := waitShares(t, nets)
+	a := checkAudits(t, nets, shares)[0]
+	require.Len(t, a.QUAL, n-1)
+}
+
+func TestAuditReshare(t *testing.T) {
+	n := 5
+	thr := n/2 + 1
+	privs, gws := test.Gateways(n + 1)
+	nets := onlineNetworks(privs[:n], gws[:n], n, false, thr, 5*time.Second)
+	defer func() { stopnetworks(nets) }()
+	shares := waitShares(t, nets)
+
+	// the first node leaves and a new one joins
+	oldList := test.ListFromPrivates(privs[:n])
+	newList := test.ListFromPrivates(privs[1:])
+	nets = reshareNetworks(nets, privs, gws, oldList, newList, shares, thr, 5*time.Second)
+	newShares := waitShares(t, nets)
+	_, err := nets[0].dkg.Audit()
+	require.NotNil(t, err)
+	for _, a := range checkAudits(t, nets[1:], newShares[1:]) {
+		require.True(t, shares[0].Public().Equal(a.Key))
+		require.Len(t, a.Public, thr)
+	}
+}
+
+func TestAuditDisqualified(t *testing.T) {
+	n := 5
+	handlers := justifiedHandlers(t, 9400, n, true)
+	for _, h := range handlers[1:] {
+		select {
+		case <-h.WaitShare():
+		case err := <-h.WaitError():
+			t.Fatal(err)
+		case <-time.After(time.Second):
+			t.Fatal("dkg not finished")
+		}
+		a, err := h.Audit()
+		require.Nil(t, err)
+		public, err := a.Verify()
+		require.Nil(t, err)
+		require.True(t, public.Equal(a.Key))
+		require.Len(t, a.QUAL, n-1)
+		require.Equal(t, []uint32{0}, a.Disqualified)
+		// the commitments of the disqualified dealer are in the audit
+		require.Len(t, a.Commitments, n)
+		require.Equal(t, uint32(0), a.Commitments[0].Index)
+
+		// the disqualification needs the invalid justification
+		decoded, err := audits.Unmarshal(mustMarshal(t, a))
+		require.Nil(t, err)
+		tampered := decoded.(*Audit)
+		var justifs []*dkg.Justification
+		for _, j := range tampered.Justifications {
+			if j.Index != 0 {
+				justifs = append(justifs, j)
+			}
+		}
+		tampered.Justifications = justifs
+		tampered.Signature = h.priv.Sign(tampered.hash())
+		_, err = tampered.Verify()
+		require.NotNil(t, err)
+	}
+}
@@ -1,25 +1,100 @@
 package dkg
 
 import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/dedis/kyber"
+	"github.com/dedis/kyber/share"
 	"github.com/dedis/kyber/share/dkg/pedersen"
+	"github.com/dedis/kyber/share/vss/pedersen"
+	"github.com/dedis/kyber/sign/schnorr"
 	"github.com/nikkolasg/dsign/key"
 	"github.com/nikkolasg/slog"
 )
 
 // Config is given to a DKG handler and contains all needed parameters to
 // successfully run the DKG protocol.
+//
+// To reshare an existing distributed key instead of creating a new one, OldList
+// and Public must be set, as well as Share for the current share holders. The
+// members of OldList deal sub-shares of their share to the members of List,
+// which end up with new shares of the same distributed key with the new
+// threshold. The shares of OldList are then useless. Using the same list for
+// both refreshes the shares without changing the membership.
 type Config struct {
 	List      []*key.Identity // the list of participants
 	Threshold int             // the threshold of active participants needed
-	// XXX Currently not in use / tested
-	Timeout time.Duration // after timeout, protocol is finished in any cases.
+	// OldList is the list of the current holders of the shares of the key to
+	// reshare, nil to create a new key.
+	OldList []*key.Identity
+	// Public holds the coefficients of the public polynomial of the key to
+	// reshare, the threshold of OldList being its length.
+	Public []kyber.Point
+	// Share is the current share of this node, nil if it is not in OldList.
+	Share *Share
+	// Timeout is the duration of each phase of the protocol, counted from the
+	// sending of the deals. After a first timeout, the missing responses are
+	// considered as complaints and the dealers have another timeout to justify
+	// their deals. The protocol then finishes with the qualified dealers, or
+	// fails with a QualError if there are less than a threshold of them. No
+	// timeout is used if zero.
+	Timeout time.Duration
+	// JoinTimeout is added to the Timeout of the first phase. It leaves time
+	// to the participants which only join the protocol once they validated
+	// it, e.g. after a human approval, to send their deals and responses.
+	JoinTimeout time.Duration
+	// Checkpoint, if set, is called with the transcript of the protocol each
+	// time it changes: before the deals are sent and before each received
+	// packet is processed. A node restarting in the middle of the protocol
+	// resumes it from the last saved transcript with ResumeHandler. The deals
+	// are not sent and the packet is dropped if the transcript can't be saved.
+	Checkpoint func(*Transcript) error
+}
+
+// Transcript holds what a node needs to resume the protocol after a restart:
+// the seed its deals are derived from and the packets received so far, in
+// order. The seed gives away the contribution of the node to the distributed
+// key, so the transcript MUST stay as private as the share.
+type Transcript struct {
+	Seed    []byte      // seed of the polynomial dealt by this node
+	Config  []byte      // hash of the configuration of the protocol
+	Packets []*Received // packets received so far
+}
+
+// Received is a packet received during the protocol along with its sender.
+type Received struct {
+	From   *key.Identity
+	Packet *Packet
+}
+
+// seedSize is the size of the seed of the polynomial dealt by a node.
+const seedSize = 32
+
+// QualError is returned when the protocol finishes with less than a threshold
+// of qualified dealers, i.e. dealers whose deal is used in the distributed key.
+type QualError struct {
+	Threshold    int
+	QUAL         []*key.Identity // dealers whose deal is certified
+	Disqualified []*key.Identity // dealers with an invalid justification
+	Missing      []*key.Identity // dealers whose deal is not certified in time
+}
+
+func (q *QualError) Error() string {
+	addrs := make([]string, len(q.Missing))
+	for i, id := range q.Missing {
+		addrs[i] = id.Address
+	}
+	return fmt.Sprintf("dkg: only %d qualified dealers (threshold %d), %d disqualified, missing [%s]", len(q.QUAL), q.Threshold, len(q.Disqualified), strings.Join(addrs, ", "))
 }
 
 // Share represents the private information that a node holds after a successful
@@ -28,82 +103,220 @@ type Share = dkg.DistKeyShare
 
 // Handler is the stateful struct that runs a DKG with the peers
 type Handler struct {
-	net           Network                    // network to send data out
-	conf          *Config                    // configuration given at init time
-	idx           int                        // the index of the private/public key pair in the list
-	state         *dkg.DistKeyGenerator      // dkg stateful struct
-	n             int                        // number of participants
-	tmpResponses  map[uint32][]*dkg.Response // temporary buffer of responses
-	sentDeals     bool                       // true if the deals have been sent already
-	dealProcessed int                        // how many deals have we processed so far
-	respProcessed int                        // how many responses have we processed so far
-	done          bool                       // is the protocol done
-	shareCh       chan Share                 // share gets sent over shareCh when ready
-	errCh         chan error                 // any fatal error for the protocol gets sent over
+	net           Network                                  // network to send data out
+	conf          *Config                                  // configuration given at init time
+	priv          *key.Private                             // private key of this node, signing the audit
+	id            *key.Identity                            // public identity of this node
+	idx           int                                      // the index of the private/public key pair in the list, -1 if not in it
+	state         *dkg.DistKeyGenerator                    // dkg stateful struct
+	n             int                                      // number of participants
+	tmpResponses  map[uint32][]*dkg.Response               // temporary buffer of responses
+	tmpJustifs    map[uint32]map[uint32]*dkg.Justification // justifications received before the complaint they answer, by dealer and verifier
+	sentDeals     bool                                     // true if the deals have been sent already
+	dealProcessed int                                      // how many deals have we processed so far
+	respProcessed int                                      // how many responses have we processed so far
+	disqualified  map[uint32]bool                          // dealers excluded after an invalid justification
+	justified     map[uint32]*vss.Deal                     // deals to this node revealed by a justification, replacing the invalid ones
+	timer         *time.Timer                              // ends the current phase, nil without timeout
+	complaining   bool                                     // true after the first timeout
+	expired       bool                                     // true after the second timeout
+	done          bool                                     // is the protocol done
+	shareCh       chan Share                               // share gets sent over shareCh when ready
+	errCh         chan error                               // any fatal error for the protocol gets sent over
+	transcript    *Transcript                              // seed and packets received so far
+	deals         map[int]*dkg.Deal                        // deals sent by this node, indexed by recipient
+	responses     []*dkg.Response                          // responses sent by this node
+	received      []*dkg.Response                          // responses received and processed
+	justifs       []*dkg.Justification                     // justifications processed, the invalid ones disqualifying their dealer
+	dks           *dkg.DistKeyShare                        // the share once created
+	final         []int                                    // qualified dealers used to create the share
+	resent        map[uint32]bool                          // dealers to which the packets were sent again
+	replaying     bool                                     // true while the transcript is replayed
 
 	sync.Mutex
 }
 
-// NewHandler returns a fresh dkg handler using this private key.
-func NewHandler(priv *key.Private, conf *Config, n Network) *Handler {
-	if err := validateConf(conf); err != nil {
-		panic(err)
+// NewHandler returns a fresh dkg handler using this private key. It returns an
+// error if the configuration is invalid or if the public key of this node is
+// not in the list, or in the old list when resharing.
+func NewHandler(priv *key.Private, conf *Config, n Network) (*Handler, error) {
+	seed := make([]byte, seedSize)
+	if _, err := rand.Read(seed); err != nil {
+		return nil, err
+	}
+	return newHandler(priv, conf, n, seed)
+}
+
+// ResumeHandler returns a dkg handler resuming the protocol from the given
+// transcript, saved by the Checkpoint of the configuration before a restart.
+// The deals are derived from the seed of the transcript, so they are the same
+// as before the restart: dealing a different polynomial would leave the nodes
+// with inconsistent shares. The deals are sent again and the packets of the
+// transcript are processed again in order, which sends the responses again.
+// The nodes which received the deals before the restart send their own deal
+// and responses again, since they may have been sent while this node was down.
+// The timeout, if any, starts over. It returns an error if the transcript was
+// saved with another configuration.
+func ResumeHandler(priv *key.Private, conf *Config, n Network, t *Transcript) (*Handler, error) {
+	if len(t.Seed) != seedSize {
+		return nil, errors.New("dkg: invalid seed in the transcript")
+	}
+	if !bytes.Equal(t.Config, conf.hash()) {
+		return nil, errors.New("dkg: transcript saved with another configuration")
+	}
+	h, err := newHandler(priv, conf, n, t.Seed)
+	if err != nil {
+		return nil, err
+	}
+	h.Lock()
+	h.replaying = true
+	h.sentDeals = true
+	if err := h.sendDeals(); err != nil {
+		slog.Infof("dkg: %s", err)
+	}
+	h.Unlock()
+	for _, r := range t.Packets {
+		h.Process(r.From, r.Packet)
+	}
+	h.Lock()
+	h.transcript.Packets = append(h.transcript.Packets, t.Packets...)
+	h.replaying = false
+	h.Unlock()
+	return h, nil
+}
+
+// newHandler returns a dkg handler dealing the polynomial derived from the
+// given seed.
+func newHandler(priv *key.Private, conf *Config, n Network, seed []byte) (*Handler, error) {
+	if err := conf.Validate(); err != nil {
+		return nil, err
 	}
 	list := conf.List
-	t := conf.Threshold
-	points := make([]kyber.Point, len(list), len(list))
-	myIdx := -1
-	myPoint := priv.Public.Point()
-	for i := range list {
-		point := list[i].Point()
-		points[i] = point
-		if point.Equal(myPoint) {
-			myIdx = i
-		}
+	myIdx, err := conf.Index(priv.Public)
+	if err != nil && (!conf.resharing() || !contains(conf.OldList, priv.Public)) {
+		return nil, err
+	}
+	if conf.Share != nil && !contains(conf.OldList, priv.Public) {
+		return nil, errors.New("dkg: share given but own public key not in the old list")
+	}
+	suite := &seededSuite{Suite: key.Curve, stream: key.Curve.XOF(seed)}
+	c := &dkg.Config{
+		Suite:     suite,
+		Longterm:  priv.Scalar(),
+		NewNodes:  key.IdentitiesToPoints(list),
+		Threshold: conf.Threshold,
 	}
-	if myIdx == -1 {
-		panic("dkg: no public key corresponding in the given list. BAD.")
+	if conf.resharing() {
+		c.OldNodes = key.IdentitiesToPoints(conf.OldList)
+		c.PublicCoeffs = conf.Public
+		c.Share = conf.Share
 	}
-	state, err := dkg.NewDistKeyGenerator(key.Curve, priv.Scalar(), points, t)
+	state, err := dkg.NewDistKeyHandler(c)
+	// the polynomial is picked, fresh randomness from now on
+	suite.stream = nil
 	if err != nil {
-		panic("dkg: error using dkg library: " + err.Error())
+		return nil, errors.New("dkg: error using dkg library: " + err.Error())
 	}
 	return &Handler{
 		conf:         conf,
 		state:        state,
 		net:          n,
 		tmpResponses: make(map[uint32][]*dkg.Response),
+		tmpJustifs:   make(map[uint32]map[uint32]*dkg.Justification),
+		disqualified: make(map[uint32]bool),
+		justified:    make(map[uint32]*vss.Deal),
+		resent:       make(map[uint32]bool),
+		priv:         priv,
+		id:           priv.Public,
 		idx:          myIdx,
 		n:            len(list),
 		shareCh:      make(chan Share, 1),
 		errCh:        make(chan error, 1),
+		transcript:   &Transcript{Seed: seed, Config: conf.hash()},
+	}, nil
+}
+
+// seededSuite is the suite given to the dkg library so the polynomial dealt by
+// this node is derived from a seed, as long as the stream is set. The
+// randomness used afterwards, e.g. for the signatures, is always fresh.
+type seededSuite struct {
+	dkg.Suite
+	stream cipher.Stream
+}
+
+func (s *seededSuite) RandomStream() cipher.Stream {
+	if s.stream != nil {
+		return s.stream
 	}
+	return s.Suite.RandomStream()
 }
 
 // Process process an incoming message from the network.
 func (h *Handler) Process(id *key.Identity, packet *Packet) {
+	if err := h.record(id, packet); err != nil {
+		slog.Infof("dkg: dropping packet from %s: %s", id.Address, err)
+		return
+	}
 	switch {
 	case packet.Deal != nil:
 		h.processDeal(id, packet.Deal)
 	case packet.Response != nil:
 		h.processResponse(id, packet.Response)
 	case packet.Justification != nil:
-		panic("not yet implemented")
+		h.processJustification(id, packet.Justification)
+	}
+}
+
+// record appends the packet to the transcript and saves it, unless the
+// transcript is being replayed.
+func (h *Handler) record(id *key.Identity, packet *Packet) error {
+	h.Lock()
+	defer h.Unlock()
+	if h.replaying || h.done || h.conf.Checkpoint == nil {
+		return nil
 	}
+	h.transcript.Packets = append(h.transcript.Packets, &Received{From: id, Packet: packet})
+	if err := h.checkpoint(); err != nil {
+		h.transcript.Packets = h.transcript.Packets[:len(h.transcript.Packets)-1]
+		return err
+	}
+	return nil
+}
+
+// checkpoint saves a copy of the transcript, unless it is being replayed. The
+// lock must be held by the caller.
+func (h *Handler) checkpoint() error {
+	if h.replaying || h.conf.Checkpoint == nil {
+		return nil
+	}
+	t := *h.transcript
+	t.Packets = append([]*Received{}, h.transcript.Packets...)
+	if err := h.conf.Checkpoint(&t); err != nil {
+		return fmt.Errorf("dkg: can't save the transcript: %s", err)
+	}
+	return nil
 }
 
-// Start sends the first message to run the protocol
+// Start sends the first message to run the protocol. When resharing, only a
+// member of the old list can start the protocol.
 func (h *Handler) Start() {
-	// XXX catch the error
+	h.Lock()
+	defer h.Unlock()
+	if !h.dealer() {
+		h.errCh <- errors.New("dkg: resharing started without a share to deal")
+		h.stop()
+		return
+	}
 	h.sentDeals = true
 	if err := h.sendDeals(); err != nil {
 		h.errCh <- err
-		h.done = true
+		h.stop()
 	}
 }
 
 // WaitShare returns a channel over which the share will be sent over when
-// ready.
+// ready. When resharing, a member of the old list that is not in the new list
+// gets an empty Share once the protocol is over.
 func (h *Handler) WaitShare() chan Share {
 	return h.shareCh
 }
@@ -118,6 +331,15 @@ func (h *Handler) processDeal(id *key.Identity, deal *dkg.Deal) {
 	h.Lock()
 	h.dealProcessed++
 	slog.Debugf("dkg: processing deal from %s (%d processed)", id.ID, h.dealProcessed)
+	// the dkg library processes its own deal when creating the deals, which
+	// it skips when resharing if it already has a deal from the dealer whose
+	// index in the old list is its index in the new list
+	h.joinProtocol()
+	if _, ok := h.state.Verifiers()[deal.Index]; ok {
+		h.resend(id, deal.Index)
+		h.Unlock()
+		return
+	}
 	resp, err := h.state.ProcessDeal(deal)
 	defer h.processTmpResponses(deal)
 	defer h.Unlock()
@@ -125,12 +347,8 @@ func (h *Handler) processDeal(id *key.Identity, deal *dkg.Deal) {
 		slog.Infof("dkg: error processing deal: %s", err)
 		return
 	}
+	h.responses = append(h.responses, resp)
 
-	if !h.sentDeals {
-		h.sendDeals()
-		h.sentDeals = true
-		slog.Debugf("dkg: sent all deals")
-	}
 	out := &Packet{
 		Response: resp,
 	}
@@ -138,10 +356,53 @@ func (h *Handler) processDeal(id *key.Identity, deal *dkg.Deal) {
 	slog.Debugf("dkg: broadcasted response")
 }
 
+// joinProtocol sends the deals of this node if not done yet, once a packet
+// shows the protocol has started. The lock must be held by the caller.
+func (h *Handler) joinProtocol() {
+	if h.sentDeals {
+		return
+	}
+	if err := h.sendDeals(); err != nil {
+		slog.Infof("dkg: %s", err)
+	}
+	h.sentDeals = true
+	slog.Debugf("dkg: sent all deals")
+}
+
+// resend sends the deal and the responses of this node again to a dealer
+// which sent its deal twice: it resumed the protocol after a restart and missed
+// the packets sent while it was down. It is only done once per dealer, as the
+// dealer may in turn receive a deal twice. The lock must be held by the caller.
+func (h *Handler) resend(id *key.Identity, index uint32) {
+	dealers := h.dealers()
+	if int(index) >= len(dealers) || !dealers[index].Equals(id) || h.resent[index] {
+		slog.Debugf("dkg: ignoring deal sent again by %s", id.Address)
+		return
+	}
+	h.resent[index] = true
+	slog.Infof("dkg: %s dealt again, sending it the deal and responses again", id.Address)
+	var packets []*Packet
+	for i, deal := range h.deals {
+		if h.conf.List[i].Equals(id) {
+			packets = append(packets, &Packet{Deal: deal})
+		}
+	}
+	for _, resp := range h.responses {
+		packets = append(packets, &Packet{Response: resp})
+	}
+	for _, p := range packets {
+		if err := h.net.Send(id, p); err != nil {
+			slog.Debugf("dkg: failed to send again to %s: %s", id.Address, err)
+			return
+		}
+	}
+}
+
 func (h *Handler) processTmpResponses(deal *dkg.Deal) {
 	h.Lock()
 	defer h.checkCertified()
 	defer h.Unlock()
+	defer h.processTmpJustifications(deal.Index)
 	resps, ok := h.tmpResponses[deal.Index]
 	if !ok {
 		return
@@ -151,8 +412,10 @@ func (h *Handler) processTmpResponses(deal *dkg.Deal) {
 	for _, r := range resps {
 		_, err := h.state.ProcessResponse(r)
 		if err != nil {
-			slog.Debugf("dkg: err process temp response: ", err)
+			slog.Debugf("dkg: err process temp response: %s", err)
+			continue
 		}
+		h.received = append(h.received, r)
 	}
 }
 
@@ -161,6 +424,8 @@ func (h *Handler) processResponse(pub *key.Identity, resp *dkg.Response) {
 	defer h.checkCertified()
 	defer h.Unlock()
 	h.respProcessed++
+	// a member leaving the group only receives responses
+	h.joinProtocol()
 	j, err := h.state.ProcessResponse(resp)
 	slog.Debugf("dkg: processing response(%d so far) from %s", h.respProcessed, pub.Address)
 	if err != nil {
@@ -172,6 +437,8 @@ func (h *Handler) processResponse(pub *key.Identity, resp *dkg.Response) {
 		slog.Infof("dkg: error process response: %s", err)
 		return
 	}
+	h.received = append(h.received, resp)
+	h.processTmpJustifications(resp.Index)
 	if j != nil {
 		slog.Debugf("dkg: broadcasting justification")
 		packet := &Packet{
@@ -182,35 +449,402 @@ func (h *Handler) processResponse(pub *key.Identity, resp *dkg.Response) {
 	slog.Debugf("dkg: processResponse(%d/%d) from %s --> Certified() ? %v --> done ? %v", h.respProcessed, h.n*(h.n-1), pub.Address, h.state.Certified(), h.done)
 }
 
+// processJustification processes the justification of a dealer answering a
+// complaint against its deal. A dealer whose justification is invalid is
+// disqualified: its deal is not used to compute the distributed key.
+func (h *Handler) processJustification(id *key.Identity, j *dkg.Justification) {
+	h.Lock()
+	defer h.checkCertified()
+	defer h.Unlock()
+	dealers := h.dealers()
+	if int(j.Index) >= len(dealers) || !dealers[j.Index].Equals(id) {
+		// only the dealer can justify its deal
+		slog.Infof("dkg: justification for dealer %d not sent by the dealer but by %s", j.Index, id.Address)
+		return
+	}
+	h.justify(j)
+}
+
+// justify processes the justification once the complaint it answers has been
+// processed, and disqualifies the dealer if the justified deal does not verify.
+// A justification received before the deal or the complaint is kept until
+// then, and one answering an approval is ignored: the complaint may already be
+// justified. A justification not signed by the dealer for its deal is ignored
+// too, leaving the complaint unanswered, since it could not prove in the audit
+// that the dealer is disqualified. The lock must be held by the caller.
+func (h *Handler) justify(j *dkg.Justification) {
+	just := j.Justification
+	if just == nil || just.Deal == nil || just.Deal.SecShare == nil || int(just.Index) >= len(h.conf.List) {
+		slog.Infof("dkg: invalid justification from dealer %d", j.Index)
+		return
+	}
+	verifier, ok := h.state.Verifiers()[j.Index]
+	if !ok {
+		slog.Debug("dkg: storing justification for unknown deal ", j.Index)
+		h.storeJustification(j)
+		return
+	}
+	resp, ok := verifier.Responses()[just.Index]
+	if !ok {
+		slog.Debugf("dkg: storing justification from dealer %d for unknown complaint of %d", j.Index, just.Index)
+		h.storeJustification(j)
+		return
+	}
+	if resp.Status != vss.StatusComplaint {
+		slog.Debugf("dkg: ignoring justification from dealer %d for an approval of %d", j.Index, just.Index)
+		return
+	}
+	dealer := h.dealers()[j.Index]
+	if !bytes.Equal(just.SessionID, verifier.SessionID()) || schnorr.Verify(key.Curve, dealer.Point(), just.Hash(key.Curve), just.Signature) != nil {
+		slog.Infof("dkg: ignoring justification from dealer %s not signed for its deal", dealer.Address)
+		return
+	}
+	if err := checkJustification(just, verifier.SessionID(), verifier.Deal().Commitments); err != nil {
+		slog.Infof("dkg: disqualifying dealer %s: invalid justification: %s", dealer.Address, err)
+		h.disqualified[j.Index] = true
+		// kept as the proof of the disqualification in the audit
+		h.justifs = append(h.justifs, j)
+		return
+	}
+	if err := h.state.ProcessJustification(j); err != nil {
+		slog.Infof("dkg: ignoring justification from dealer %s: %s", dealer.Address, err)
+		return
+	}
+	if just.Deal.SecShare.I == h.idx {
+		h.justified[j.Index] = just.Deal
+	}
+	h.justifs = append(h.justifs, j)
+}
+
+// storeJustification keeps the justification until the deal and the complaint
+// it answers are processed. The lock must be held by the caller.
+func (h *Handler) storeJustification(j *dkg.Justification) {
+	if h.tmpJustifs[j.Index] == nil {
+		h.tmpJustifs[j.Index] = make(map[uint32]*dkg.Justification)
+	}
+	h.tmpJustifs[j.Index][j.Justification.Index] = j
+}
+
+// processTmpJustifications processes again the justifications stored for the
+// given dealer, once its deal or a response to it is processed. The lock must
+// be held by the caller.
+func (h *Handler) processTmpJustifications(dealer uint32) {
+	justifs, ok := h.tmpJustifs[dealer]
+	if !ok {
+		return
+	}
+	delete(h.tmpJustifs, dealer)
+	for _, j := range justifs {
+		h.justify(j)
+	}
+}
+
+// Disqualified returns the participants whose deals are excluded from the
+// distributed key because of an invalid justification.
+func (h *Handler) Disqualified() []*key.Identity {
+	h.Lock()
+	defer h.Unlock()
+	var ids []*key.Identity
+	for i, id := range h.dealers() {
+		if h.disqualified[uint32(i)] {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// QUAL returns the participants whose deals are used to compute the
+// distributed key so far.
+func (h *Handler) QUAL() []*key.Identity {
+	h.Lock()
+	defer h.Unlock()
+	var ids []*key.Identity
+	for _, i := range h.qual() {
+		ids = append(ids, h.dealers()[i])
+	}
+	return ids
+}
+
+// qual returns the sorted indexes of the certified deals whose dealer is not
+// disqualified. The lock must be held by the caller.
+func (h *Handler) qual() []int {
+	var qual []int
+	for _, i := range h.state.QUAL() {
+		if !h.disqualified[uint32(i)] {
+			qual = append(qual, i)
+		}
+	}
+	sort.Ints(qual)
+	return qual
+}
+
+// qualified returns true if the deal of the given dealer is certified. The lock
+// must be held by the caller.
+func (h *Handler) qualified(id *key.Identity) bool {
+	for _, i := range h.qual() {
+		if h.dealers()[i].Equals(id) {
+			return true
+		}
+	}
+	return false
+}
+
 // checkCertified checks if there has been enough responses and if so, creates
 // the distributed key share, and sends it along the channel returned by
-// WaitShare.
+// WaitShare. When some dealers are disqualified, the key is created once the
+// deals of all the others are certified, as long as there are at least a
+// threshold of them. In any case, the key is only created once the complaints
+// received against the qualified deals are justified, or after the timeout.
 func (h *Handler) checkCertified() {
 	h.Lock()
 	defer h.Unlock()
-	if !h.state.Certified() || h.done {
+	if h.done {
+		return
+	}
+	var dks *dkg.DistKeyShare
+	var err error
+	switch {
+	case h.idx < 0:
+		// leaving the group: there is nothing to compute, the work is done
+		// once the deal of this node is certified
+		if !h.expired && !h.qualified(h.id) {
+			return
+		}
+		dks = &dkg.DistKeyShare{}
+	case !h.expired && h.awaitingJustification():
+		return
+	case !h.conf.resharing() && len(h.disqualified) == 0 && len(h.justified) == 0 && h.state.Certified():
+		dks, err = h.state.DistKeyShare()
+	case h.expired || len(h.qual())+len(h.disqualified) == len(h.dealers()):
+		if len(h.qual()) < h.dealThreshold() {
+			h.stop()
+			h.errCh <- h.qualError()
+			return
+		}
+		if h.conf.resharing() {
+			dks, err = h.reshareQualShare()
+		} else {
+			dks, err = h.qualShare()
+		}
+	default:
 		return
 	}
 	//slog.Debugf("%s: processResponse(%d) from %s #3", d.addr, d.respProcessed, pub.Address)
-	h.done = true
-	slog.Infof("dkg: certified!")
-	dks, err := h.state.DistKeyShare()
+	h.stop()
 	if err != nil {
+		h.errCh <- err
 		return
 	}
+	slog.Infof("dkg: certified!")
+	if h.idx >= 0 {
+		h.dks = dks
+		h.final = h.qual()
+	}
 	share := Share(*dks)
 	h.shareCh <- share
 }
 
+// awaitingJustification returns true if a complaint received against the deal
+// of a qualified dealer is not justified yet: depending on the justification,
+// the dealer may still be disqualified. The complaints created at the first
+// timeout are not awaited. The lock must be held by the caller.
+func (h *Handler) awaitingJustification() bool {
+	qual := make(map[uint32]bool)
+	for _, i := range h.qual() {
+		qual[uint32(i)] = true
+	}
+	verifiers := h.state.Verifiers()
+	for _, r := range append(h.received, h.responses...) {
+		if !qual[r.Index] {
+			continue
+		}
+		resp, ok := verifiers[r.Index].Responses()[r.Response.Index]
+		if ok && resp.Status == vss.StatusComplaint {
+			return true
+		}
+	}
+	return false
+}
+
+// startTimer starts the timer of the first phase once the deals are sent. The
+// lock must be held by the caller.
+func (h *Handler) startTimer() {
+	if h.conf.Timeout == 0 || h.timer != nil {
+		return
+	}
+	h.timer = time.AfterFunc(h.conf.Timeout+h.conf.JoinTimeout, h.timeout)
+}
+
+// timeout ends the current phase. At the end of the first phase, the missing
+// responses are taken as complaints, which leaves the dealers one more phase to
+// justify their deals. At the end of the second phase, the protocol finishes
+// with the qualified dealers.
+func (h *Handler) timeout() {
+	h.Lock()
+	defer h.checkCertified()
+	defer h.Unlock()
+	if h.done {
+		return
+	}
+	if !h.complaining {
+		slog.Infof("dkg: timeout, missing responses taken as complaints")
+		h.complaining = true
+		h.state.SetTimeout()
+		// the missing responses are now complaints which may be justified
+		var dealers []uint32
+		for dealer := range h.tmpJustifs {
+			dealers = append(dealers, dealer)
+		}
+		for _, dealer := range dealers {
+			h.processTmpJustifications(dealer)
+		}
+		h.timer = time.AfterFunc(h.conf.Timeout, h.timeout)
+		return
+	}
+	slog.Infof("dkg: timeout, finishing with %d qualified dealers", len(h.qual()))
+	h.expired = true
+}
+
+// stop marks the protocol as done. The lock must be held by the caller.
+func (h *Handler) stop() {
+	h.done = true
+	if h.timer != nil {
+		h.timer.Stop()
+	}
+}
+
+// qualError returns the error listing the dealers not qualified. The lock must
+// be held by the caller.
+func (h *Handler) qualError() *QualError {
+	qual := make(map[int]bool)
+	for _, i := range h.qual() {
+		qual[i] = true
+	}
+	q := &QualError{Threshold: h.dealThreshold()}
+	for i, id := range h.dealers() {
+		switch {
+		case qual[i]:
+			q.QUAL = append(q.QUAL, id)
+		case h.disqualified[uint32(i)]:
+			q.Disqualified = append(q.Disqualified, id)
+		default:
+			q.Missing = append(q.Missing, id)
+		}
+	}
+	return q
+}
+
+// qualShare computes the distributed key share from the deals of the qualified
+// dealers only. The private polynomial of this node is not available from the
+// dkg library and is left empty. The lock must be held by the caller.
+func (h *Handler) qualShare() (*dkg.DistKeyShare, error) {
+	sh := key.Curve.Scalar().Zero()
+	var pub *share.PubPoly
+	var index int
+	for _, i := range h.qual() {
+		deal := h.deal(i)
+		if deal == nil {
+			return nil, fmt.Errorf("dkg: no certified deal from dealer %d", i)
+		}
+		index = deal.SecShare.I
+		sh.Add(sh, deal.SecShare.V)
+		poly := share.NewPubPoly(key.Curve, key.Curve.Point().Base(), deal.Commitments)
+		if pub == nil {
+			pub = poly
+			continue
+		}
+		var err error
+		if pub, err = pub.Add(poly); err != nil {
+			return nil, err
+		}
+	}
+	_, commits := pub.Info()
+	return &dkg.DistKeyShare{
+		Commits: commits,
+		Share: &share.PriShare{
+			I: index,
+			V: sh,
+		},
+	}, nil
+}
+
+// deal returns the deal of the given dealer to this node, which is the one
+// revealed by its justification if the deal received was invalid. The lock must
+// be held by the caller.
+func (h *Handler) deal(dealer int) *vss.Deal {
+	if deal, ok := h.justified[uint32(dealer)]; ok {
+		return deal
+	}
+	return h.state.Verifiers()[uint32(dealer)].Deal()
+}
+
+// reshareQualShare computes the new share from the deals of the qualified
+// members of the old list: their sub-shares and commitments are interpolated
+// with the old threshold, which preserves the distributed key. The lock must
+// be held by the caller.
+func (h *Handler) reshareQualShare() (*dkg.DistKeyShare, error) {
+	n := len(h.conf.OldList)
+	oldT := h.dealThreshold()
+	shares := make([]*share.PriShare, n)
+	coeffs := make([][]kyber.Point, n)
+	for _, i := range h.qual() {
+		deal := h.deal(i)
+		if deal == nil {
+			return nil, fmt.Errorf("dkg: no certified deal from dealer %d", i)
+		}
+		shares[i] = &share.PriShare{I: i, V: deal.SecShare.V}
+		coeffs[i] = deal.Commitments
+	}
+	poly, err := share.RecoverPriPoly(key.Curve, shares, oldT, n)
+	if err != nil {
+		return nil, err
+	}
+	commits := make([]kyber.Point, h.conf.Threshold)
+	for k := range commits {
+		pubs := make([]*share.PubShare, n)
+		for i := range coeffs {
+			if coeffs[i] != nil {
+				pubs[i] = &share.PubShare{I: i, V: coeffs[i][k]}
+			}
+		}
+		if commits[k], err = share.RecoverCommit(key.Curve, pubs, oldT, n); err != nil {
+			return nil, err
+		}
+	}
+	sh := &share.PriShare{I: h.idx, V: poly.Secret()}
+	if !share.NewPubPoly(key.Curve, nil, commits).Check(sh) {
+		return nil, errors.New("dkg: new share does not match the new public polynomial")
+	}
+	if !commits[0].Equal(h.conf.Public[0]) {
+		return nil, errors.New("dkg: resharing changed the distributed key")
+	}
+	return &dkg.DistKeyShare{
+		Commits: commits,
+		Share:   sh,
+	}, nil
+}
+
 // sendDeals tries to send the deals to each of the nodes.
 // It returns an error if a number of node superior to the threshold have not
 // received the deal. It is basically a no-go.
 func (h *Handler) sendDeals() error {
+	// the seed must be saved before any deal leaves this node
+	if err := h.checkpoint(); err != nil {
+		return err
+	}
 	deals, err := h.state.Deals()
 	if err != nil {
 		return err
 	}
-	var good = 1
+	h.startTimer()
+	if !h.dealer() {
+		return nil
+	}
+	h.deals = deals
+	var good int
+	if h.idx >= 0 {
+		good = 1
+	}
 	for i, deal := range deals {
 		if i == h.idx {
 			panic("end of the universe")
@@ -235,8 +869,8 @@ func (h *Handler) sendDeals() error {
 
 func (h *Handler) broadcast(p *Packet) {
 	var good int
-	for i, id := range h.conf.List {
-		if i == h.idx {
+	for _, id := range h.participants() {
+		if id.Equals(h.id) {
 			continue
 		}
 		if err := h.net.Send(id, p); err != nil {
@@ -250,12 +884,140 @@ func (h *Handler) broadcast(p *Packet) {
 	slog.Debugf("dkg: broadcast done")
 }
 
+// dealers returns the list of the nodes dealing a share: the old list when
+// resharing, otherwise the list.
+func (h *Handler) dealers() []*key.Identity {
+	if h.conf.resharing() {
+		return h.conf.OldList
+	}
+	return h.conf.List
+}
+
+// dealer returns true if this node deals a share.
+func (h *Handler) dealer() bool {
+	return !h.conf.resharing() || h.conf.Share != nil
+}
+
+// dealThreshold returns the number of qualified dealers needed to compute the
+// distributed key: the threshold of the old list when resharing.
+func (h *Handler) dealThreshold() int {
+	if h.conf.resharing() {
+		return len(h.conf.Public)
+	}
+	return h.conf.Threshold
+}
+
+// participants returns the nodes of the list followed by the nodes of the old
+// list that are not in the list.
+func (h *Handler) participants() []*key.Identity {
+	ids := append([]*key.Identity{}, h.conf.List...)
+	for _, id := range h.conf.OldList {
+		if !contains(h.conf.List, id) {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
 // Network is used by the Handler to send a DKG protocol packet over the network.
 type Network interface {
 	Send(id *key.Identity, pack *Packet) error
 }
 
-func validateConf(conf *Config) error {
-	// XXX TODO
+// Validate returns an error if the list of participants is empty, contains
+// duplicates or invalid identities, or if the threshold is out of bounds as
+// checked by key.ValidateThreshold. When resharing, the old list is checked the same
+// way, the public polynomial must have at most one coefficient per member of
+// the old list and the share must match it.
+func (c *Config) Validate() error {
+	if err := validateList(c.List); err != nil {
+		return err
+	}
+	if err := key.ValidateThreshold(c.Threshold, len(c.List)); err != nil {
+		return err
+	}
+	if c.Timeout < 0 || c.JoinTimeout < 0 {
+		return errors.New("dkg: negative timeout")
+	}
+	if !c.resharing() {
+		if c.Public != nil || c.Share != nil {
+			return errors.New("dkg: public polynomial or share given without old list")
+		}
+		return nil
+	}
+	if err := validateList(c.OldList); err != nil {
+		return fmt.Errorf("%s in the old list", err)
+	}
+	if len(c.Public) == 0 || len(c.Public) > len(c.OldList) {
+		return fmt.Errorf("dkg: %d coefficients in the public polynomial for %d old participants", len(c.Public), len(c.OldList))
+	}
+	if c.Share != nil && (c.Share.Share == nil || !share.NewPubPoly(key.Curve, nil, c.Public).Check(c.Share.Share)) {
+		return errors.New("dkg: share does not match the public polynomial")
+	}
+	return nil
+}
+
+// validateList returns an error if the list is empty, contains duplicates or
+// invalid identities.
+func validateList(list []*key.Identity) error {
+	if len(list) == 0 {
+		return errors.New("dkg: empty list of participants")
+	}
+	seen := make(map[string]bool)
+	for i, id := range list {
+		if id == nil {
+			return fmt.Errorf("dkg: participant %d is nil", i)
+		}
+		if err := id.Verify(); err != nil {
+			return fmt.Errorf("dkg: invalid identity of participant %d (%s): %s", i, id.Address, err)
+		}
+		k := string(id.Key)
+		if seen[k] {
+			return fmt.Errorf("dkg: participant %d (%s) appears more than once", i, id.Address)
+		}
+		seen[k] = true
+	}
 	return nil
 }
+
+// hash returns the hash of the participants, thresholds and public polynomial
+// of the configuration, which determine the deals of the protocol.
+func (c *Config) hash() []byte {
+	h := sha256.New()
+	binary.Write(h, binary.BigEndian, uint32(c.Threshold))
+	for _, list := range [][]*key.Identity{c.List, c.OldList} {
+		binary.Write(h, binary.BigEndian, uint32(len(list)))
+		for _, id := range list {
+			h.Write(id.Key)
+		}
+	}
+	for _, p := range c.Public {
+		buff, _ := p.MarshalBinary()
+		h.Write(buff)
+	}
+	return h.Sum(nil)
+}
+
+// resharing returns true if the config reshares an existing key.
+func (c *Config) resharing() bool {
+	return c.OldList != nil
+}
+
+func contains(list []*key.Identity, id *key.Identity) bool {
+	for _, p := range list {
+		if p.Equals(id) {
+			return true
+		}
+	}
+	return false
+}
+
+// Index returns the index of the given identity in the list of participants.
+func (c *Config) Index(id *key.Identity) (int, error) {
+	for i, p := range c.List {
+		if p.Equals(id) {
+			return i, nil
+		}
+	}
+	return -1, errors.New("dkg: own public key not in the list of participants")
+}
@@ -1,13 +1,19 @@
 package dkg
 
 import (
-	"sync"
+	gonet "net"
 	"testing"
 	"time"
 
+	"github.com/dedis/kyber"
+	"github.com/dedis/kyber/share"
+	"github.com/dedis/kyber/share/dkg/pedersen"
+	"github.com/dedis/kyber/share/vss/pedersen"
+	"github.com/dedis/kyber/sign/schnorr"
 	"github.com/nikkolasg/dsign/key"
 	"github.com/nikkolasg/dsign/net"
 	"github.com/nikkolasg/dsign/test"
+	"github.com/stretchr/testify/require"
 )
 
 var encoder = net.NewSingleProtoEncoder(&Packet{})
@@ -15,26 +21,6 @@ var encoder = net.NewSingleProtoEncoder(&Packet{})
 type network struct {
 	gw  net.Gateway
 	dkg *Handler
-	cb  func()
-}
-
-func newDkgNetwork(gw net.Gateway, priv *key.Private, conf *Config, cb func()) *network {
-	n := &network{
-		gw: gw,
-	}
-	//fmt.Printf("Starting gateway %p\n", &gw)
-	gw.Start(n.Process)
-	n.dkg = NewHandler(priv, conf, n)
-	go func() {
-		select {
-		case <-n.dkg.WaitShare():
-			//fmt.Printf("waitshare DONE for gateway %p\n", &gw)
-			cb()
-		case e := <-n.dkg.WaitError():
-			panic(e)
-		}
-	}()
-	return n
 }
 
 func (n *network) Send(id *key.Identity, p *Packet) error {
@@ -54,18 +40,19 @@ func (n *network) Process(from *key.Identity, msg []byte) {
 	n.dkg.Process(from, dkgPacket)
 }
 
-func networks(keys []*key.Private, gws []net.Gateway, threshold int, cb func(), timeout time.Duration) []*network {
-	list := test.ListFromPrivates(keys)
-	nets := make([]*network, len(list), len(list))
-	for i := range keys {
-		conf := &Config{
-			List:      list,
-			Threshold: threshold,
-			Timeout:   timeout,
+// listening waits until the gateways of the given identities accept
+// connections, since Gateway.Start returns before. Otherwise the first packets
+// may be lost and the dkg only finish at its timeout.
+func listening(ids []*key.Identity) {
+	for _, id := range ids {
+		for i := 0; i < 100; i++ {
+			if c, err := gonet.Dial("tcp", id.Address); err == nil {
+				c.Close()
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
 		}
-		nets[i] = newDkgNetwork(gws[i], keys[i], conf, cb)
 	}
-	return nets
 }
 
 func stopnetworks(nets []*network) {
@@ -84,21 +71,535 @@ func TestDKG(t *testing.T) {
 	//slog.Level = slog.LevelDebug
 	//defer func() { slog.Level = slog.LevelPrint }()
 
-	// waits for receiving n shares
-	var wg sync.WaitGroup
-	wg.Add(n)
-	//var i = 1
-	callback := func() {
-		//fmt.Printf("callback called %d times...\n", i)
-		wg.Done()
-		//i++
+	nets := onlineNetworks(privs, gws, n, false, thr, 100*time.Millisecond)
+	defer stopnetworks(nets)
+
+	// the timeout is short enough to end the protocol before all the deals
+	// are certified on a slow machine: every node still finishes, with a
+	// valid share from the qualified dealers or a QualError
+	nets[0].dkg.Start()
+	for _, net := range nets {
+		select {
+		case s := <-net.dkg.WaitShare():
+			require.True(t, share.NewPubPoly(key.Curve, nil, s.Commits).Check(s.Share))
+		case err := <-net.dkg.WaitError():
+			_, ok := err.(*QualError)
+			require.True(t, ok, err.Error())
+		case <-time.After(time.Second):
+			t.Fatal("dkg did not finish after the timeout")
+		}
 	}
-	nets := networks(privs, gws, thr, callback, 100*time.Millisecond)
+}
+
+// badDeal returns the deal of the first participant to the second one with a
+// share which does not verify against the commitments, and the vss dealer of
+// the same polynomial, derived from the seed of the handler, holding this
+// share.
+func badDeal(t *testing.T, h *Handler, priv *key.Private) (*dkg.Deal, *vss.Dealer) {
+	suite := &seededSuite{Suite: key.Curve, stream: key.Curve.XOF(h.transcript.Seed)}
+	secret := suite.Scalar().Pick(suite.RandomStream())
+	dealer, err := vss.NewDealer(suite, priv.Scalar(), secret, key.IdentitiesToPoints(h.conf.List), h.conf.Threshold)
+	require.Nil(t, err)
+	suite.stream = nil
+	plain, err := dealer.PlaintextDeal(1)
+	require.Nil(t, err)
+	plain.SecShare.V = key.Curve.Scalar().Zero()
+	encrypted, err := dealer.EncryptedDeal(1)
+	require.Nil(t, err)
+	deal := &dkg.Deal{Index: 0, Deal: encrypted}
+	buff, err := deal.MarshalBinary()
+	require.Nil(t, err)
+	deal.Signature, err = schnorr.Sign(key.Curve, priv.Scalar(), buff)
+	require.Nil(t, err)
+	return deal, dealer
+}
+
+// justifiedHandlers runs a dkg where the first participant deals an invalid
+// share to the second one, which complains. The third one receives the
+// justification of the first one before the complaint. If invalid is true, the
+// justification is the invalid deal instead of the one of the handler.
+func justifiedHandlers(t *testing.T, port, n int, invalid bool) []*Handler {
+	privs := test.GenerateIDs(port, n)
+	list := test.ListFromPrivates(privs)
+	box, _, handlers, _ := mailboxHandlers(t, privs, n/2+1)
+	deal, dealer := badDeal(t, handlers[0], privs[0])
+
+	handlers[0].Start()
+	box.Edit(func(q *queued) {
+		if q.Packet.Deal != nil && q.To.Equals(list[1]) {
+			q.Packet = &Packet{Deal: deal}
+		}
+	})
+	complaint := func(q *queued) bool {
+		return q.From.Equals(list[1]) && q.Packet.Response != nil && q.Packet.Response.Index == 0
+	}
+	test.Deliver(box, list, handlers, func(q *queued) bool {
+		return q.Packet.Justification == nil && !(complaint(q) && q.To.Equals(list[2]))
+	})
+	// the justification is broadcasted in the background
+	var resp *vss.Response
+	var justifs int
+	for i := 0; i < 100 && justifs < n-1; i++ {
+		time.Sleep(10 * time.Millisecond)
+		justifs = 0
+		box.Edit(func(q *queued) {
+			if complaint(q) {
+				resp = q.Packet.Response.Response
+			}
+			if q.Packet.Justification != nil {
+				justifs++
+			}
+		})
+	}
+	require.Equal(t, n-1, justifs)
+	require.Equal(t, vss.StatusComplaint, resp.Status)
+	if invalid {
+		j, err := dealer.ProcessResponse(resp)
+		require.Nil(t, err)
+		box.Edit(func(q *queued) {
+			if q.Packet.Justification != nil {
+				q.Packet = &Packet{Justification: &dkg.Justification{Index: 0, Justification: j}}
+			}
+		})
+	}
+	test.Deliver(box, list, handlers, func(q *queued) bool {
+		return q.Packet.Justification != nil && q.To.Equals(list[2])
+	})
+	test.Deliver(box, list, handlers, func(*queued) bool { return true })
+	return handlers
+}
+
+func TestDKGJustification(t *testing.T) {
+	n := 5
+	// the justification answers the complaint: the deal of the first node is
+	// used by everyone, even if the justification arrives before the complaint
+	handlers := justifiedHandlers(t, 9200, n, false)
+	checkShares(t, handlers)
+	for _, h := range handlers {
+		require.Len(t, h.Disqualified(), 0)
+	}
+
+	// all honest participants have the same key built without the deal of
+	// the first one
+	handlers = justifiedHandlers(t, 9300, n, true)
+	var public kyber.Point
+	for _, h := range handlers[1:] {
+		select {
+		case s := <-h.WaitShare():
+			require.True(t, share.NewPubPoly(key.Curve, nil, s.Commits).Check(s.Share))
+			if public == nil {
+				public = s.Public()
+			}
+			require.True(t, public.Equal(s.Public()))
+		case err := <-h.WaitError():
+			t.Fatal(err)
+		case <-time.After(time.Second):
+			t.Fatal("dkg not finished")
+		}
+		require.Len(t, h.QUAL(), n-1)
+		disqualified := h.Disqualified()
+		require.Len(t, disqualified, 1)
+		require.True(t, disqualified[0].Equals(handlers[0].id))
+	}
+}
+
+// onlineNetworks returns the networks of the first online participants out of
+// the list of all keys. The others never answer: if reachable, they ignore all
+// messages, otherwise their gateway is not started.
+func onlineNetworks(keys []*key.Private, gws []net.Gateway, online int, reachable bool, threshold int, timeout time.Duration) []*network {
+	list := test.ListFromPrivates(keys)
+	nets := make([]*network, online)
+	for i := range nets {
+		conf := &Config{
+			List:      list,
+			Threshold: threshold,
+			Timeout:   timeout,
+		}
+		nets[i] = &network{gw: gws[i]}
+		var err error
+		if nets[i].dkg, err = NewHandler(keys[i], conf, nets[i]); err != nil {
+			panic(err)
+		}
+		gws[i].Start(nets[i].Process)
+	}
+	if reachable {
+		for _, gw := range gws[online:] {
+			gw.Start(func(*key.Identity, []byte) {})
+			nets = append(nets, &network{gw: gw})
+		}
+	}
+	listening(list[:len(nets)])
+	return nets
+}
+
+func TestDKGTimeout(t *testing.T) {
+	n := 5
+	thr := n/2 + 1
+	privs, gws := test.Gateways(n)
+	nets := onlineNetworks(privs, gws, n-1, false, thr, time.Second)
+	defer stopnetworks(nets)
+
+	nets[0].dkg.Start()
+	var public kyber.Point
+	for _, net := range nets {
+		select {
+		case s := <-net.dkg.WaitShare():
+			require.True(t, share.NewPubPoly(key.Curve, nil, s.Commits).Check(s.Share))
+			if public == nil {
+				public = s.Public()
+			}
+			require.True(t, public.Equal(s.Public()))
+		case err := <-net.dkg.WaitError():
+			t.Fatal(err)
+		case <-time.After(10 * time.Second):
+			t.Fatal("dkg did not finish after the timeout")
+		}
+		require.Len(t, net.dkg.QUAL(), n-1)
+	}
+}
+
+func TestDKGTimeoutQualError(t *testing.T) {
+	n := 5
+	thr := n/2 + 1
+	privs, gws := test.Gateways(n)
+	nets := onlineNetworks(privs, gws, thr-1, true, thr, 500*time.Millisecond)
 	defer stopnetworks(nets)
 
 	nets[0].dkg.Start()
-	//fmt.Println("wg.Wait()...")
-	wg.Wait()
-	//fmt.Println("wg.Wait()... DONE")
+	for _, net := range nets[:thr-1] {
+		select {
+		case <-net.dkg.WaitShare():
+			t.Fatal("dkg finished without a threshold of participants")
+		case err := <-net.dkg.WaitError():
+			qerr, ok := err.(*QualError)
+			require.True(t, ok)
+			require.Equal(t, thr, qerr.Threshold)
+			// the deals of the online participants lack approvals
+			require.Len(t, qerr.QUAL, 0)
+			require.Len(t, qerr.Missing, n)
+		case <-time.After(10 * time.Second):
+			t.Fatal("dkg did not finish after the timeout")
+		}
+	}
+}
+
+// waitShares starts the dkg from the first network and returns the shares of
+// all of them.
+func waitShares(t *testing.T, nets []*network) []Share {
+	nets[0].dkg.Start()
+	shares := make([]Share, len(nets))
+	for i, net := range nets {
+		select {
+		case shares[i] = <-net.dkg.WaitShare():
+		case err := <-net.dkg.WaitError():
+			t.Fatal(err)
+		case <-time.After(10 * time.Second):
+			t.Fatal("dkg not finished")
+		}
+	}
+	return shares
+}
+
+// reshareNetworks returns the networks resharing the shares of the old list
+// to the new list. The networks of the nodes of the old list are reused, the
+// others are appended.
+func reshareNetworks(nets []*network, keys []*key.Private, gws []net.Gateway, oldList, newList []*key.Identity, shares []Share, threshold int, timeout time.Duration) []*network {
+	for i := range keys {
+		conf := &Config{
+			List:      newList,
+			Threshold: threshold,
+			Timeout:   timeout,
+			OldList:   oldList,
+			Public:    shares[0].Commits,
+		}
+		if i < len(shares) {
+			conf.Share = &shares[i]
+		}
+		if i >= len(nets) {
+			nets = append(nets, &network{gw: gws[i]})
+			gws[i].Start(nets[i].Process)
+		}
+		var err error
+		if nets[i].dkg, err = NewHandler(keys[i], conf, nets[i]); err != nil {
+			panic(err)
+		}
+	}
+	listening(test.ListFromPrivates(keys))
+	return nets
+}
+
+func TestDKGReshare(t *testing.T) {
+	n := 5
+	thr := n/2 + 1
+	privs, gws := test.Gateways(n + 2)
+	nets := onlineNetworks(privs[:n], gws[:n], n, false, thr, 5*time.Second)
+	defer func() { stopnetworks(nets) }()
+	shares := waitShares(t, nets)
+	public := shares[0].Public()
+
+	// the first two nodes leave, two new nodes join with a higher threshold
+	oldList := test.ListFromPrivates(privs[:n])
+	newList := test.ListFromPrivates(privs[2:])
+	newThr := thr + 1
+	nets = reshareNetworks(nets, privs, gws, oldList, newList, shares, newThr, 5*time.Second)
+	newShares := waitShares(t, nets)
 
+	for _, s := range newShares[:2] {
+		require.Nil(t, s.Share)
+	}
+	var priShares []*share.PriShare
+	for i, s := range newShares[2:] {
+		require.Len(t, s.Commits, newThr)
+		require.True(t, public.Equal(s.Public()))
+		require.True(t, share.NewPubPoly(key.Curve, nil, s.Commits).Check(s.Share))
+		require.Equal(t, i, s.Share.I)
+		priShares = append(priShares, s.Share)
+	}
+	require.Len(t, nets[2].dkg.QUAL(), n)
+
+	// the new shares hold the same secret with the new threshold
+	var oldShares []*share.PriShare
+	for _, s := range shares {
+		oldShares = append(oldShares, s.Share)
+	}
+	secret, err := share.RecoverSecret(key.Curve, oldShares, thr, n)
+	require.Nil(t, err)
+	newSecret, err := share.RecoverSecret(key.Curve, priShares[:newThr], newThr, len(newList))
+	require.Nil(t, err)
+	require.True(t, secret.Equal(newSecret))
+	_, err = share.RecoverSecret(key.Curve, priShares[:newThr-1], newThr, len(newList))
+	require.NotNil(t, err)
+}
+
+func TestDKGRefresh(t *testing.T) {
+	n := 5
+	thr := n/2 + 1
+	privs, gws := test.Gateways(n)
+	nets := onlineNetworks(privs, gws, n, false, thr, 5*time.Second)
+	defer stopnetworks(nets)
+	shares := waitShares(t, nets)
+
+	list := test.ListFromPrivates(privs)
+	nets = reshareNetworks(nets, privs, gws, list, list, shares, thr, 5*time.Second)
+	newShares := waitShares(t, nets)
+	for i, s := range newShares {
+		require.True(t, shares[i].Public().Equal(s.Public()))
+		require.Equal(t, shares[i].Share.I, s.Share.I)
+		require.False(t, shares[i].Share.V.Equal(s.Share.V))
+		require.True(t, share.NewPubPoly(key.Curve, nil, s.Commits).Check(s.Share))
+	}
+}
+
+type queued = test.Queued[*Packet]
+
+// mailboxHandlers returns the handlers of the given participants sending their
+// packets to the returned mailbox. The transcript of the last one is saved,
+// protobuf encoded, in the returned slice.
+func mailboxHandlers(t *testing.T, privs []*key.Private, thr int) (*test.Mailbox[*Packet], []*Config, []*Handler, *[]byte) {
+	list := test.ListFromPrivates(privs)
+	box := &test.Mailbox[*Packet]{Copy: copyPacket}
+	saved := new([]byte)
+	confs := make([]*Config, len(privs))
+	handlers := make([]*Handler, len(privs))
+	for i := range privs {
+		confs[i] = &Config{List: list, Threshold: thr}
+		if i == len(privs)-1 {
+			confs[i].Checkpoint = func(t *Transcript) error {
+				var err error
+				*saved, err = transcripts.Marshal(t)
+				return err
+			}
+		}
+		var err error
+		handlers[i], err = NewHandler(privs[i], confs[i], &test.Outbox[*Packet]{From: list[i], Box: box})
+		require.Nil(t, err)
+	}
+	return box, confs, handlers, saved
+}
+
+var transcripts = net.NewSingleProtoEncoder(&Transcript{})
+
+// copyPacket returns the copy of the packet received by each handler, as if
+// received over the network.
+func copyPacket(p *Packet) *Packet {
+	buff, err := encoder.Marshal(p)
+	if err != nil {
+		panic(err)
+	}
+	packet, err := encoder.Unmarshal(buff)
+	if err != nil {
+		panic(err)
+	}
+	return packet.(*Packet)
+}
+
+// resume returns the handler of the given participant resumed from the saved
+// transcript.
+func resume(t *testing.T, priv *key.Private, conf *Config, box *test.Mailbox[*Packet], saved []byte) *Handler {
+	decoded, err := transcripts.Unmarshal(saved)
+	require.Nil(t, err)
+	h, err := ResumeHandler(priv, conf, &test.Outbox[*Packet]{From: priv.Public, Box: box}, decoded.(*Transcript))
+	require.Nil(t, err)
+	return h
+}
+
+// checkShares checks all the handlers finish with shares of the same key using
+// the deals of everyone.
+func checkShares(t *testing.T, handlers []*Handler) {
+	var public kyber.Point
+	for i, h := range handlers {
+		select {
+		case s := <-h.WaitShare():
+			require.True(t, share.NewPubPoly(key.Curve, nil, s.Commits).Check(s.Share))
+			if public == nil {
+				public = s.Public()
+			}
+			require.True(t, public.Equal(s.Public()))
+		case err := <-h.WaitError():
+			t.Fatal(err)
+		case <-time.After(time.Second):
+			t.Fatalf("no share for node %d", i)
+		}
+		require.Len(t, h.QUAL(), len(handlers))
+	}
+}
+
+func TestDKGResume(t *testing.T) {
+	n := 5
+	thr := n/2 + 1
+	privs := test.GenerateIDs(9000, n)
+	list := test.ListFromPrivates(privs)
+	box, confs, handlers, saved := mailboxHandlers(t, privs, thr)
+	last := n - 1
+
+	// the last node joins on the deal of the first one, then crashes before
+	// its deals reach the nodes in the middle
+	handlers[0].Start()
+	test.Deliver(box, list, handlers, func(q *queued) bool {
+		return q.To.Equals(list[last])
+	})
+	require.NotNil(t, *saved)
+	box.Lock()
+	var queue []*queued
+	for _, q := range box.Queue {
+		if !q.From.Equals(list[last]) || q.To.Equals(list[0]) || q.To.Equals(list[1]) {
+			queue = append(queue, q)
+		}
+	}
+	box.Queue = queue
+	box.Unlock()
+
+	decoded, err := transcripts.Unmarshal(*saved)
+	require.Nil(t, err)
+	transcript := decoded.(*Transcript)
+	require.Len(t, transcript.Packets, 1)
+	conf := *confs[last]
+	conf.Threshold = thr + 1
+	_, err = ResumeHandler(privs[last], &conf, &test.Outbox[*Packet]{From: list[last], Box: box}, transcript)
+	require.NotNil(t, err)
+	bad := *transcript
+	bad.Seed = bad.Seed[1:]
+	_, err = ResumeHandler(privs[last], confs[last], &test.Outbox[*Packet]{From: list[last], Box: box}, &bad)
+	require.NotNil(t, err)
+
+	// the resumed node deals the same polynomial again
+	handlers[last] = resume(t, privs[last], confs[last], box, *saved)
+	test.Deliver(box, list, handlers, func(*queued) bool { return true })
+	checkShares(t, handlers)
+}
+
+func TestDKGResumeMissedPackets(t *testing.T) {
+	n := 5
+	thr := n/2 + 1
+	privs := test.GenerateIDs(9100, n)
+	list := test.ListFromPrivates(privs)
+	box, confs, handlers, saved := mailboxHandlers(t, privs, thr)
+	last := n - 1
+
+	// the last node joins on the deal of the first one and deals to everyone,
+	// then crashes: the packets sent to it in the meantime are lost
+	handlers[0].Start()
+	test.Deliver(box, list, handlers, func(q *queued) bool {
+		return q.To.Equals(list[last]) && q.Packet.Deal != nil && q.From.Equals(list[0])
+	})
+	test.Deliver(box, list, handlers, func(q *queued) bool {
+		return !q.To.Equals(list[last])
+	})
+	box.Lock()
+	box.Queue = nil
+	box.Unlock()
+
+	// the others send their packets again once they receive its deals again
+	handlers[last] = resume(t, privs[last], confs[last], box, *saved)
+	test.Deliver(box, list, handlers, func(*queued) bool { return true })
+	checkShares(t, handlers)
+}
+
+func TestConfigValidate(t *testing.T) {
+	privs, _ := test.Gateways(5)
+	list := test.ListFromPrivates(privs)
+	conf := func(list []*key.Identity, thr int) *Config {
+		return &Config{List: list, Threshold: thr}
+	}
+	require.Nil(t, conf(list, 3).Validate())
+	require.Nil(t, conf(list, 5).Validate())
+
+	// threshold bounds
+	require.NotNil(t, conf(list, 2).Validate())
+	require.NotNil(t, conf(list, 6).Validate())
+	require.NotNil(t, conf(list[:1], 1).Validate())
+	// empty list
+	require.NotNil(t, conf(nil, 0).Validate())
+	// duplicate identities
+	require.NotNil(t, conf(append([]*key.Identity{list[0]}, list[:4]...), 3).Validate())
+	// invalid self signature
+	forged := *list[1]
+	forged.Address = "127.0.0.1:1"
+	require.NotNil(t, conf([]*key.Identity{list[0], &forged, list[2]}, 2).Validate())
+	// invalid point
+	invalid := *list[1]
+	invalid.Key = make([]byte, len(list[1].Key))
+	require.NotNil(t, conf([]*key.Identity{list[0], &invalid, list[2]}, 2).Validate())
+
+	// not in the list
+	_, err := NewHandler(privs[0], conf(list[1:], 3), nil)
+	require.NotNil(t, err)
+	_, err = NewHandler(privs[0], conf(list, 1), nil)
+	require.NotNil(t, err)
+
+	// resharing
+	poly := share.NewPriPoly(key.Curve, 3, nil, key.Curve.RandomStream())
+	_, commits := poly.Commit(nil).Info()
+	sh := &Share{Commits: commits, Share: poly.Shares(5)[0]}
+	reshare := func(oldList []*key.Identity, public []kyber.Point, s *Share) *Config {
+		c := conf(list, 3)
+		c.OldList = oldList
+		c.Public = public
+		c.Share = s
+		return c
+	}
+	require.Nil(t, reshare(list, commits, sh).Validate())
+	require.Nil(t, reshare(list, commits, nil).Validate())
+	// public polynomial without old list
+	require.NotNil(t, reshare(nil, commits, nil).Validate())
+	require.NotNil(t, reshare(list, nil, sh).Validate())
+	// more coefficients than old participants
+	require.NotNil(t, reshare(list[:2], commits, nil).Validate())
+	// share of another polynomial
+	other := share.NewPriPoly(key.Curve, 3, nil, key.Curve.RandomStream())
+	require.NotNil(t, reshare(list, commits, &Share{Share: other.Shares(5)[0]}).Validate())
+	// share given while not in the old list
+	_, err = NewHandler(privs[0], reshare(list[1:], commits, sh), nil)
+	require.NotNil(t, err)
+	// in none of the lists
+	c := reshare(list[1:], commits, nil)
+	c.List = list[1:]
+	_, err = NewHandler(privs[0], c, nil)
+	require.NotNil(t, err)
+	// only the old list can start the resharing
+	c.List = list
+	h, err := NewHandler(privs[0], c, nil)
+	require.Nil(t, err)
+	h.Start()
+	require.NotNil(t, <-h.WaitError())
 }
@@ -1,12 +1,16 @@
 // Package dss implements a distributed schnorr signature protocol.
 // It basically consists of using one longterm distributed key,
 // running a dkg protocol to get a an ephemeral distributed key
-// and compute the Schnorr signature.
+// and compute the Schnorr signature. With ModeEd25519, the resulting signature
+// is a regular Ed25519 signature as defined in RFC 8032.
 package dss
 
 import (
 	"errors"
+	"fmt"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/dedis/kyber/share/dss"
 	"github.com/nikkolasg/dsign/dkg"
@@ -17,39 +21,75 @@ import (
 // Config is given to a DSS handler and contains all relevant
 // information to correctly run the dss protocol.
 type Config struct {
-	// Basic information, same as DKG
-	// XXX Timeout TODO
+	// Basic information, same as DKG. Its Timeout is not used.
 	*dkg.Config
+	// SignatureTimeout is the deadline to recover the signature, counted from
+	// the sending of our partial signature, after which the handler fails
+	// with a BlameError listing the participants missing. No timeout is used
+	// if zero.
+	SignatureTimeout time.Duration
 	// longterm secret share
 	Longterm *dkg.Share
 	// random ~ ephemeral secret share
 	Random *dkg.Share
 	// message to sign
 	Message []byte
+	// Mode decides how the challenge is computed, ModeSchnorr by default
+	Mode Mode
 }
 
+// Mode is the kind of signature produced by the dss protocol.
+type Mode int
+
+const (
+	// ModeSchnorr produces the schnorr signatures of the kyber dss package,
+	// verifiable with the kyber schnorr package.
+	ModeSchnorr Mode = iota
+	// ModeEd25519 produces signatures verifiable by any RFC 8032 Ed25519
+	// implementation against the distributed public key.
+	ModeEd25519
+)
+
 // Handler holds the relevant information to perform a distributed
 // signature protocol run.
 type Handler struct {
 	net         Network      // the network interface used to send message
 	priv        *key.Private // private key
 	conf        *Config      // config needed to setup the dss
-	state       *dss.DSS     // state containing all DSS info
+	state       signer       // state containing all DSS info
 	sentSigs    bool
-	signatureCh chan []byte // signature is sent over that channel when ready
-	errorCh     chan error  // error is signalled over that channel
-	done        bool        // true when the signature have been recovered and sent
+	signers     []*key.Identity // participants whose partial signature is used
+	blames      []*Blame        // invalid partial signatures received
+	answered    map[int]bool    // participants whose partial signature is processed
+	timer       *time.Timer     // fails the protocol at the deadline, nil without timeout
+	signatureCh chan []byte     // signature is sent over that channel when ready
+	errorCh     chan error      // error is signalled over that channel
+	done        bool            // true when the signature have been recovered and sent
 
 	sync.Mutex
 }
 
-// NewHandler returns a dss handler using the given conf.
-func NewHandler(priv *key.Private, conf *Config, net Network) *Handler {
+// NewHandler returns a dss handler using the given conf. It returns an error if
+// the configuration is invalid or if the public key of this node is not in the
+// list.
+func NewHandler(priv *key.Private, conf *Config, net Network) (*Handler, error) {
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+	if _, err := conf.Index(priv.Public); err != nil {
+		return nil, err
+	}
 	points := key.IdentitiesToPoints(conf.List)
-	state, err := dss.NewDSS(key.Curve, priv.Scalar(), points, conf.Longterm, conf.Random, conf.Message, conf.Threshold)
+	var state signer
+	var err error
+	switch conf.Mode {
+	case ModeEd25519:
+		state, err = newEd25519Signer(priv.Scalar(), points, conf.Longterm, conf.Random, conf.Message, conf.Threshold)
+	default:
+		state, err = dss.NewDSS(key.Curve, priv.Scalar(), points, conf.Longterm, conf.Random, conf.Message, conf.Threshold)
+	}
 	if err != nil {
-		// error only if key is not in list
-		panic("dss: error using dss library: " + err.Error())
+		return nil, errors.New("dss: error using dss library: " + err.Error())
 	}
 	return &Handler{
 		conf:        conf,
@@ -58,75 +98,245 @@ func NewHandler(priv *key.Private, conf *Config, net Network) *Handler {
 		state:       state,
 		signatureCh: make(chan []byte, 1),
 		errorCh:     make(chan error, 1),
+		answered:    make(map[int]bool),
+	}, nil
+}
+
+// Blame is an invalid partial signature received during the protocol.
+type Blame struct {
+	From   *key.Identity // sender of the partial signature
+	Reason string        // why the partial signature is invalid
+}
+
+// BlameError is returned when less than a threshold of valid partial
+// signatures are received, either from every participant or before the
+// timeout.
+type BlameError struct {
+	Threshold int
+	Signers   []*key.Identity // participants with a valid partial signature
+	Blames    []*Blame        // invalid partial signatures
+	Missing   []*key.Identity // participants whose partial signature is not received
+}
+
+func (b *BlameError) Error() string {
+	blames := make([]string, len(b.Blames))
+	for i, bl := range b.Blames {
+		blames[i] = bl.From.Address + ": " + bl.Reason
+	}
+	missing := make([]string, len(b.Missing))
+	for i, id := range b.Missing {
+		missing[i] = id.Address
+	}
+	return fmt.Sprintf("dss: only %d valid partial signatures (threshold %d), invalid [%s], missing [%s]", len(b.Signers), b.Threshold, strings.Join(blames, ", "), strings.Join(missing, ", "))
+}
+
+// Validate returns an error if the dkg configuration is invalid, if a share is
+// missing or does not match the threshold, or if the mode is unknown.
+func (c *Config) Validate() error {
+	if c.Config == nil {
+		return errors.New("dss: missing dkg configuration")
+	}
+	if err := c.Config.Validate(); err != nil {
+		return err
+	}
+	if c.Longterm == nil || c.Longterm.Share == nil || c.Random == nil || c.Random.Share == nil {
+		return errors.New("dss: missing longterm or random share")
 	}
+	if len(c.Longterm.Commits) != c.Threshold || len(c.Random.Commits) != c.Threshold {
+		return errors.New("dss: shares do not match the threshold")
+	}
+	if c.Mode != ModeSchnorr && c.Mode != ModeEd25519 {
+		return errors.New("dss: unknown mode")
+	}
+	return nil
 }
 
 // Start sends the partial signature
 func (h *Handler) Start() {
-	h.sendPartialSig()
+	h.Lock()
+	defer h.Unlock()
+	if !h.sentSigs {
+		h.sendPartialSig()
+	}
 }
 
-// Process gives any incoming dss packet to the state
+// Process gives any incoming dss packet to the state. An invalid partial
+// signature is blamed on its sender, whose packets are ignored from then on,
+// and the protocol continues with the others. If every participant has sent
+// its partial signature without a threshold of valid ones, a BlameError is
+// sent on the error channel.
 func (h *Handler) Process(from *key.Identity, p *Packet) {
 	h.Lock()
 	defer h.Unlock()
-	err := h.state.ProcessPartialSig(p)
-	if err != nil {
-		slog.Debug("dss: error processing partial sig: ", err)
+	if h.done {
+		return
+	}
+	idx, err := h.conf.Index(from)
+	switch {
+	case err != nil:
+		h.blame(from, errors.New("dss: partial signature from a non participant"))
+	case h.answered[idx]:
+		slog.Debugf("dss: ignoring partial signature from %s already processed", from.Address)
+		return
+	default:
+		h.answered[idx] = true
+		if p.Partial == nil || p.Partial.I != idx {
+			h.blame(from, errors.New("dss: partial signature not made by its sender"))
+		} else if err := h.state.ProcessPartialSig(p); err != nil {
+			h.blame(from, err)
+		} else {
+			h.signers = append(h.signers, from)
+		}
 	}
 
 	if !h.sentSigs {
 		h.sendPartialSig()
 	}
-	if !h.state.EnoughPartialSig() || h.done {
+	if h.done {
+		return
+	}
+	if !h.state.EnoughPartialSig() {
+		if len(h.answered) == len(h.conf.List) {
+			h.fail(h.blameError())
+		}
 		return
 	}
 
 	sig, err := h.state.Signature()
 	if err != nil {
-		slog.Debug("dss: error recovering sig: ", err)
-		// XXX This error should not happen ever except a
-		// mistake from DSS library
-		panic(err)
+		// should not happen with a threshold of valid partial signatures
+		h.fail(errors.New("dss: error recovering the signature: " + err.Error()))
+		return
 	}
-	h.done = true
+	h.stop()
 	h.signatureCh <- sig
 }
 
+// timeout fails the protocol if the signature is not recovered yet.
+func (h *Handler) timeout() {
+	h.Lock()
+	defer h.Unlock()
+	if h.done {
+		return
+	}
+	slog.Infof("dss: timeout with %d valid partial signatures", len(h.signers))
+	h.fail(h.blameError())
+}
+
+// fail stops the protocol and sends the error. The lock must be held by the
+// caller.
+func (h *Handler) fail(err error) {
+	h.stop()
+	h.errorCh <- err
+}
+
+// stop marks the protocol as done, so at most one signature or error is ever
+// sent. The lock must be held by the caller.
+func (h *Handler) stop() {
+	h.done = true
+	if h.timer != nil {
+		h.timer.Stop()
+	}
+}
+
+// blameError returns the error blaming the participants that did not send a
+// valid partial signature. The lock must be held by the caller.
+func (h *Handler) blameError() *BlameError {
+	b := &BlameError{
+		Threshold: h.conf.Threshold,
+		Signers:   h.copySigners(),
+		Blames:    h.copyBlames(),
+	}
+	for i, id := range h.conf.List {
+		if !h.answered[i] {
+			b.Missing = append(b.Missing, id)
+		}
+	}
+	return b
+}
+
+// blame records the invalid partial signature sent by the given identity.
+func (h *Handler) blame(from *key.Identity, err error) {
+	slog.Infof("dss: invalid partial signature from %s: %s", from.Address, err)
+	h.blames = append(h.blames, &Blame{From: from, Reason: err.Error()})
+}
+
+// Signers returns the participants whose partial signatures have been used to
+// recover the signature, including ourself.
+func (h *Handler) Signers() []*key.Identity {
+	h.Lock()
+	defer h.Unlock()
+	return h.copySigners()
+}
+
+// Blames returns the invalid partial signatures received so far. Once the
+// signature is recovered, the packets still in flight are not checked.
+func (h *Handler) Blames() []*Blame {
+	h.Lock()
+	defer h.Unlock()
+	return h.copyBlames()
+}
+
+func (h *Handler) copySigners() []*key.Identity {
+	signers := make([]*key.Identity, len(h.signers))
+	copy(signers, h.signers)
+	return signers
+}
+
+func (h *Handler) copyBlames() []*Blame {
+	blames := make([]*Blame, len(h.blames))
+	copy(blames, h.blames)
+	return blames
+}
+
 // WaitSignature returns a channel over which the signature is
 // sent when ready.
 func (h *Handler) WaitSignature() chan []byte {
 	return h.signatureCh
 }
 
-// WaitError returns a channel over which any error is sent to
+// WaitError returns a channel over which the error failing the protocol is
+// sent. At most one of the signature and the error is ever sent.
 func (h *Handler) WaitError() chan error {
 	return h.errorCh
 }
 
+// sendPartialSig sends our partial signature to the other participants and
+// starts the timer. It fails if the partial signature can't be computed or if
+// it reaches less than a threshold of participants, ourself included. The lock
+// must be held by the caller.
 func (h *Handler) sendPartialSig() {
+	h.sentSigs = true
 	ps, err := h.state.PartialSig()
 	if err != nil {
-		h.errorCh <- err
+		h.fail(errors.New("dss: error computing the partial signature: " + err.Error()))
+		return
 	}
-	h.sentSigs = true
-	var errS string
+	h.signers = append(h.signers, h.priv.Public)
+	idx, _ := h.conf.Index(h.priv.Public)
+	h.answered[idx] = true
+	var errs []string
 	var ownID = h.priv.Public.ID
-	var good int
+	var good = 1
 	for _, id := range h.conf.Config.List {
 		if id.ID == ownID {
 			continue
 		}
 		if err := h.net.Send(id, ps); err != nil {
 			slog.Debug("dss: error sending partial sig: ", err)
+			errs = append(errs, id.Address+": "+err.Error())
 		} else {
 			good++
 		}
 	}
+	slog.Debugf("dss: sent %d partial signatures", good-1)
 	if good < h.conf.Threshold {
-		h.errorCh <- errors.New(errS)
+		h.fail(fmt.Errorf("dss: partial signature reached %d participants with ourself (threshold %d): %s", good, h.conf.Threshold, strings.Join(errs, ", ")))
+		return
+	}
+	if h.conf.SignatureTimeout > 0 {
+		h.timer = time.AfterFunc(h.conf.SignatureTimeout, h.timeout)
 	}
-	slog.Debugf("dss: sent %d partial signatures", good)
 }
 
 // Network is used by the Handler to send a DSS protocol packet
@@ -1,11 +1,14 @@
 package dss
 
 import (
+	"errors"
 	"fmt"
 	"testing"
+	"time"
 
 	"github.com/alecthomas/assert"
 	"github.com/dedis/kyber"
+	"github.com/dedis/kyber/share"
 	dkgg "github.com/dedis/kyber/share/dkg/pedersen"
 	"github.com/dedis/kyber/sign/schnorr"
 	"github.com/nikkolasg/dsign/dkg"
@@ -14,6 +17,7 @@ import (
 	"github.com/nikkolasg/dsign/test"
 	"github.com/nikkolasg/slog"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ed25519"
 )
 
 var encoder = net.NewSingleProtoEncoder(&Packet{})
@@ -28,7 +32,10 @@ func newDssNetwork(gw net.Gateway, priv *key.Private, conf *Config) *network {
 		gw: gw,
 	}
 	gw.Start(n.Process)
-	n.dss = NewHandler(priv, conf, n)
+	var err error
+	if n.dss, err = NewHandler(priv, conf, n); err != nil {
+		panic(err)
+	}
 	return n
 }
 
@@ -51,7 +58,7 @@ func (n *network) Process(from *key.Identity, msg []byte) {
 
 func networks(keys []*key.Private, gws []net.Gateway, list []*key.Identity,
 	longterms, randoms []*dkg.Share,
-	threshold int, message []byte) []*network {
+	threshold int, message []byte, mode Mode) []*network {
 	n := len(keys)
 	nets := make([]*network, n, n)
 	for i := range keys {
@@ -64,7 +71,7 @@ func networks(keys []*key.Private, gws []net.Gateway, list []*key.Identity,
 			Longterm: longterms[i],
 			Random:   randoms[i],
 			Message:  message,
-			//  TIMEOUT TODO
+			Mode:     mode,
 		}
 		nets[i] = newDssNetwork(gws[i], keys[i], dssConf)
 	}
@@ -89,7 +96,7 @@ func TestDSS(t *testing.T) {
 	points := key.IdentitiesToPoints(list)
 	longterms := genShares(privs, points, thr, t)
 	randoms := genShares(privs, points, thr, t)
-	nets := networks(privs, gws, list, longterms, randoms, thr, message)
+	nets := networks(privs, gws, list, longterms, randoms, thr, message, ModeSchnorr)
 	defer stopnetworks(nets)
 
 	slog.Level = slog.LevelDebug
@@ -98,9 +105,33 @@ func TestDSS(t *testing.T) {
 	nets[0].dss.Start()
 	sig := <-nets[0].dss.WaitSignature()
 	require.Nil(t, schnorr.Verify(key.Curve, longterms[0].Public(), message, sig))
+	signers := nets[0].dss.Signers()
+	require.Len(t, signers, thr)
+	require.True(t, signers[0].Equals(privs[0].Public))
 	fmt.Println("DONE")
 }
 
+func TestDSSEd25519(t *testing.T) {
+	n := 5
+	thr := n/2 + 1
+	message := []byte("Hello World")
+	privs, gws := test.Gateways(n)
+	list := test.ListFromPrivates(privs)
+	points := key.IdentitiesToPoints(list)
+	longterms := genShares(privs, points, thr, t)
+	randoms := genShares(privs, points, thr, t)
+	nets := networks(privs, gws, list, longterms, randoms, thr, message, ModeEd25519)
+	defer stopnetworks(nets)
+
+	nets[0].dss.Start()
+	sig := <-nets[0].dss.WaitSignature()
+	require.Len(t, sig, ed25519.SignatureSize)
+	pub, err := longterms[0].Public().MarshalBinary()
+	require.Nil(t, err)
+	require.True(t, ed25519.Verify(ed25519.PublicKey(pub), message, sig))
+	require.False(t, ed25519.Verify(ed25519.PublicKey(pub), []byte("Hello Moon"), sig))
+}
+
 func genShares(keys []*key.Private, points []kyber.Point, threshold int, t *testing.T) []*dkg.Share {
 	n := len(keys)
 	dkgs := make([]*dkgg.DistKeyGenerator, n, n)
@@ -149,3 +180,214 @@ func genShares(keys []*key.Private, points []kyber.Point, threshold int, t *test
 	}
 	return dkss
 }
+
+type queued = test.Queued[*Packet]
+
+func mailboxHandlers(t *testing.T, privs []*key.Private, thr int, message []byte, mode Mode, timeout time.Duration) (*test.Mailbox[*Packet], []*Handler, []*dkg.Share) {
+	list := test.ListFromPrivates(privs)
+	points := key.IdentitiesToPoints(list)
+	longterms := genShares(privs, points, thr, t)
+	randoms := genShares(privs, points, thr, t)
+	box := new(test.Mailbox[*Packet])
+	handlers := make([]*Handler, len(privs))
+	for i, priv := range privs {
+		conf := &Config{
+			Config:           &dkg.Config{List: list, Threshold: thr},
+			SignatureTimeout: timeout,
+			Longterm:         longterms[i],
+			Random:           randoms[i],
+			Message:          message,
+			Mode:             mode,
+		}
+		var err error
+		handlers[i], err = NewHandler(priv, conf, &test.Outbox[*Packet]{From: priv.Public, Box: box})
+		require.Nil(t, err)
+	}
+	return box, handlers, longterms
+}
+
+// forge returns a validly signed partial signature of the given index with a
+// wrong value.
+func forge(t *testing.T, priv *key.Private, p *Packet, index int) *Packet {
+	forged := &Packet{
+		Partial:   &share.PriShare{I: index, V: key.Curve.Scalar().Pick(key.Curve.RandomStream())},
+		SessionID: p.SessionID,
+	}
+	var err error
+	forged.Signature, err = schnorr.Sign(key.Curve, priv.Scalar(), forged.Hash(key.Curve))
+	require.Nil(t, err)
+	return forged
+}
+
+func TestDSSBlame(t *testing.T) {
+	n := 5
+	thr := n/2 + 1
+	message := []byte("Hello World")
+	privs := test.GenerateIDs(9000, n)
+	list := test.ListFromPrivates(privs)
+	box, handlers, longterms := mailboxHandlers(t, privs, thr, message, ModeEd25519, 5*time.Second)
+
+	handlers[0].Start()
+	test.Deliver(box, list, handlers, func(q *queued) bool {
+		if q.From.Equals(list[1]) {
+			q.Packet = forge(t, privs[1], q.Packet, 1)
+		}
+		return true
+	})
+	pub, err := longterms[0].Public().MarshalBinary()
+	require.Nil(t, err)
+	for i, h := range handlers {
+		if i == 1 {
+			continue
+		}
+		select {
+		case sig := <-h.WaitSignature():
+			require.True(t, ed25519.Verify(ed25519.PublicKey(pub), message, sig))
+		default:
+			t.Fatal("no signature despite a threshold of honest participants")
+		}
+		for _, s := range h.Signers() {
+			require.False(t, s.Equals(list[1]))
+		}
+	}
+	blames := handlers[0].Blames()
+	require.Len(t, blames, 1)
+	require.True(t, blames[0].From.Equals(list[1]))
+	require.Equal(t, "dss: partial signature not valid", blames[0].Reason)
+
+	// the timer is stopped once the signature is recovered
+	require.False(t, handlers[0].timer.Stop())
+}
+
+func TestDSSBlameError(t *testing.T) {
+	n := 5
+	thr := n - 1
+	message := []byte("Hello World")
+	privs := test.GenerateIDs(9000, n)
+	list := test.ListFromPrivates(privs)
+	box, handlers, _ := mailboxHandlers(t, privs, thr, message, ModeSchnorr, 0)
+
+	handlers[0].Start()
+	test.Deliver(box, list, handlers, func(q *queued) bool {
+		switch {
+		case q.From.Equals(list[1]):
+			// partial signature of another participant
+			q.Packet = forge(t, privs[1], q.Packet, 2)
+		case q.From.Equals(list[2]):
+			q.Packet = forge(t, privs[2], q.Packet, 2)
+		}
+		return true
+	})
+	for _, i := range []int{0, 3, 4} {
+		select {
+		case <-handlers[i].WaitSignature():
+			t.Fatal("signature without a threshold of valid partial signatures")
+		case err := <-handlers[i].WaitError():
+			berr, ok := err.(*BlameError)
+			require.True(t, ok)
+			require.Equal(t, thr, berr.Threshold)
+			require.Len(t, berr.Signers, n-2)
+			require.Len(t, berr.Blames, 2)
+			require.Len(t, berr.Missing, 0)
+			require.Equal(t, berr.Blames, handlers[i].Blames())
+			for _, b := range berr.Blames {
+				require.True(t, b.From.Equals(list[1]) || b.From.Equals(list[2]))
+			}
+		default:
+			t.Fatal("no error after all partial signatures are received")
+		}
+	}
+}
+
+func TestDSSTimeout(t *testing.T) {
+	n := 5
+	thr := n - 1
+	message := []byte("Hello World")
+	privs := test.GenerateIDs(9000, n)
+	list := test.ListFromPrivates(privs)
+	box, handlers, _ := mailboxHandlers(t, privs, thr, message, ModeEd25519, time.Second)
+
+	// the last two participants are offline
+	handlers[0].Start()
+	test.Deliver(box, list, handlers, func(q *queued) bool {
+		return !q.To.Equals(list[3]) && !q.To.Equals(list[4])
+	})
+	for _, h := range handlers[:3] {
+		select {
+		case <-h.WaitSignature():
+			t.Fatal("signature without a threshold of partial signatures")
+		case err := <-h.WaitError():
+			berr, ok := err.(*BlameError)
+			require.True(t, ok)
+			require.Len(t, berr.Signers, 3)
+			require.Len(t, berr.Blames, 0)
+			require.Len(t, berr.Missing, 2)
+			require.True(t, berr.Missing[0].Equals(list[3]))
+			require.True(t, berr.Missing[1].Equals(list[4]))
+		case <-time.After(5 * time.Second):
+			t.Fatal("dss did not fail after the timeout")
+		}
+	}
+}
+
+// failingSigner is a signer unable to recover the signature.
+type failingSigner struct {
+	signer
+}
+
+func (f *failingSigner) Signature() ([]byte, error) {
+	return nil, errors.New("no signature")
+}
+
+func TestDSSSignatureError(t *testing.T) {
+	n := 3
+	thr := 2
+	message := []byte("Hello World")
+	privs := test.GenerateIDs(9000, n)
+	list := test.ListFromPrivates(privs)
+	box, handlers, _ := mailboxHandlers(t, privs, thr, message, ModeSchnorr, 0)
+	handlers[0].state = &failingSigner{handlers[0].state}
+
+	handlers[0].Start()
+	test.Deliver(box, list, handlers, func(*queued) bool { return true })
+	select {
+	case <-handlers[0].WaitSignature():
+		t.Fatal("signature despite the failing signer")
+	case err := <-handlers[0].WaitError():
+		require.NotNil(t, err)
+	default:
+		t.Fatal("no error from the failing signer")
+	}
+}
+
+// failingNetwork can't send any packet.
+type failingNetwork struct{}
+
+func (failingNetwork) Send(*key.Identity, *Packet) error {
+	return errors.New("unreachable")
+}
+
+func TestDSSSendError(t *testing.T) {
+	n := 3
+	thr := n
+	message := []byte("Hello World")
+	privs := test.GenerateIDs(9000, n)
+	list := test.ListFromPrivates(privs)
+	box, handlers, _ := mailboxHandlers(t, privs, thr, message, ModeSchnorr, 0)
+	handlers[0].net = failingNetwork{}
+
+	handlers[0].Start()
+	// the partial signatures received afterwards send nothing more
+	handlers[1].Start()
+	handlers[2].Start()
+	test.Deliver(box, list, handlers, func(*queued) bool { return true })
+	err := <-handlers[0].WaitError()
+	require.Contains(t, err.Error(), "unreachable")
+	select {
+	case <-handlers[0].WaitSignature():
+		t.Fatal("signature after the failure")
+	case err := <-handlers[0].WaitError():
+		t.Fatal("second error sent: ", err)
+	default:
+	}
+}
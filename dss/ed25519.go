@@ -0,0 +1,194 @@
+package dss
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"errors"
+	"math/big"
+
+	"github.com/dedis/kyber"
+	"github.com/dedis/kyber/share"
+	"github.com/dedis/kyber/sign/schnorr"
+	"github.com/nikkolasg/dsign/dkg"
+	"github.com/nikkolasg/dsign/key"
+)
+
+// order of the ed25519 base point, as defined in RFC 8032
+var ed25519Order, _ = new(big.Int).SetString("7237005577332262213973186563042994240857116359379907606001950938285454250989", 10)
+
+// signer computes the partial signatures of a participant and recovers the
+// final signature once enough valid partial signatures are collected.
+type signer interface {
+	PartialSig() (*Packet, error)
+	ProcessPartialSig(*Packet) error
+	EnoughPartialSig() bool
+	Signature() ([]byte, error)
+}
+
+// ed25519Signer is a signer whose final signature is a regular Ed25519
+// signature as defined in RFC 8032, i.e. the challenge is
+// SHA512(R || A || M) reduced modulo the order of the group, with R the
+// distributed random public key, A the distributed longterm public key and M
+// the message. It follows the same protocol as the kyber dss package.
+type ed25519Signer struct {
+	secret       kyber.Scalar
+	participants []kyber.Point
+	index        int
+	long         *dkg.Share
+	random       *dkg.Share
+	longPoly     *share.PubPoly
+	randomPoly   *share.PubPoly
+	msg          []byte
+	t            int
+	partials     []*share.PriShare
+	partialsIdx  map[int]bool
+	signed       bool
+	sessionID    []byte
+}
+
+func newEd25519Signer(secret kyber.Scalar, participants []kyber.Point, long, random *dkg.Share, msg []byte, t int) (*ed25519Signer, error) {
+	public := key.Curve.Point().Mul(secret, nil)
+	index := -1
+	for i, p := range participants {
+		if p.Equal(public) {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		return nil, errors.New("dss: public key not found in list of participants")
+	}
+	base := key.Curve.Point().Base()
+	return &ed25519Signer{
+		secret:       secret,
+		participants: participants,
+		index:        index,
+		long:         long,
+		random:       random,
+		longPoly:     share.NewPubPoly(key.Curve, base, long.Commits),
+		randomPoly:   share.NewPubPoly(key.Curve, base, random.Commits),
+		msg:          msg,
+		t:            t,
+		partialsIdx:  make(map[int]bool),
+		sessionID:    ed25519SessionID(long, random),
+	}, nil
+}
+
+// PartialSig returns the partial signature of this participant,
+// s_i = k * a_i + r_i with k the challenge, a_i and r_i the longterm and random
+// shares.
+func (e *ed25519Signer) PartialSig() (*Packet, error) {
+	k := e.challenge()
+	v := key.Curve.Scalar().Mul(k, e.long.Share.V)
+	v.Add(v, e.random.Share.V)
+	ps := &Packet{
+		Partial: &share.PriShare{
+			I: e.index,
+			V: v,
+		},
+		SessionID: e.sessionID,
+	}
+	var err error
+	ps.Signature, err = schnorr.Sign(key.Curve, e.secret, ps.Hash(key.Curve))
+	if !e.signed {
+		e.partialsIdx[e.index] = true
+		e.partials = append(e.partials, ps.Partial)
+		e.signed = true
+	}
+	return ps, err
+}
+
+// ProcessPartialSig verifies the partial signature against the public
+// polynomials and keeps it if valid.
+func (e *ed25519Signer) ProcessPartialSig(ps *Packet) error {
+	if ps.Partial == nil || ps.Partial.I < 0 || ps.Partial.I >= len(e.participants) {
+		return errors.New("dss: partial signature with invalid index")
+	}
+	public := e.participants[ps.Partial.I]
+	if err := schnorr.Verify(key.Curve, public, ps.Hash(key.Curve), ps.Signature); err != nil {
+		return err
+	}
+	if !bytes.Equal(ps.SessionID, e.sessionID) {
+		return errors.New("dss: session id do not match")
+	}
+	if e.partialsIdx[ps.Partial.I] {
+		return errors.New("dss: partial signature already received from peer")
+	}
+	// s_i * G == k * A_i + R_i
+	k := e.challenge()
+	right := key.Curve.Point().Mul(k, e.longPoly.Eval(ps.Partial.I).V)
+	right.Add(right, e.randomPoly.Eval(ps.Partial.I).V)
+	left := key.Curve.Point().Mul(ps.Partial.V, nil)
+	if !left.Equal(right) {
+		return errors.New("dss: partial signature not valid")
+	}
+	e.partialsIdx[ps.Partial.I] = true
+	e.partials = append(e.partials, ps.Partial)
+	return nil
+}
+
+// EnoughPartialSig returns true if the signature can be recovered.
+func (e *ed25519Signer) EnoughPartialSig() bool {
+	return len(e.partials) >= e.t
+}
+
+// Signature returns the 64 bytes Ed25519 signature R || S.
+func (e *ed25519Signer) Signature() ([]byte, error) {
+	if !e.EnoughPartialSig() {
+		return nil, errors.New("dss: not enough partial signatures to sign")
+	}
+	s, err := share.RecoverSecret(key.Curve, e.partials, e.t, len(e.participants))
+	if err != nil {
+		return nil, err
+	}
+	var buff bytes.Buffer
+	if _, err := e.random.Public().MarshalTo(&buff); err != nil {
+		return nil, err
+	}
+	if _, err := s.MarshalTo(&buff); err != nil {
+		return nil, err
+	}
+	return buff.Bytes(), nil
+}
+
+// challenge returns SHA512(R || A || M) interpreted as a little endian integer
+// and reduced modulo the group order, as in RFC 8032.
+func (e *ed25519Signer) challenge() kyber.Scalar {
+	h := sha512.New()
+	e.random.Public().MarshalTo(h)
+	e.long.Public().MarshalTo(h)
+	h.Write(e.msg)
+	digest := h.Sum(nil)
+
+	// little endian to big endian
+	for i, j := 0, len(digest)-1; i < j; i, j = i+1, j-1 {
+		digest[i], digest[j] = digest[j], digest[i]
+	}
+	k := new(big.Int).SetBytes(digest)
+	k.Mod(k, ed25519Order)
+	// back to the 32 bytes little endian encoding of scalars
+	buff := make([]byte, 32)
+	kb := k.Bytes()
+	for i := range kb {
+		buff[i] = kb[len(kb)-1-i]
+	}
+	scalar := key.Curve.Scalar()
+	if err := scalar.UnmarshalBinary(buff); err != nil {
+		// the value is reduced so it is always a valid scalar
+		panic(err)
+	}
+	return scalar
+}
+
+// ed25519SessionID ties the partial signatures to both distributed keys.
+func ed25519SessionID(long, random *dkg.Share) []byte {
+	h := sha512.New()
+	h.Write([]byte("dsign-ed25519"))
+	for _, p := range long.Commits {
+		p.MarshalTo(h)
+	}
+	for _, p := range random.Commits {
+		p.MarshalTo(h)
+	}
+	return h.Sum(nil)
+}
@@ -1,6 +1,10 @@
 package key
 
 import (
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/dedis/kyber/share"
 	"github.com/dedis/kyber/share/dkg/pedersen"
 )
 
@@ -11,4 +15,102 @@ type SharedPrivate struct {
 	Email    string            // email as in the public key
 	Extra    string            // extra info. as in public key
 	Share    *dkg.DistKeyShare // the private share
+
+	// OpenPGP key of the group, once self certified
+	PgpID      uint64    // key id
+	PgpCreated time.Time // creation time, part of the fingerprint
+	PgpPublic  string    // armored public key
+}
+
+// GroupIdentity returns the identity of the group owning this share, given the
+// list of participants and the threshold.
+func (s *SharedPrivate) GroupIdentity(list []*Identity, t int) *GroupIdentity {
+	g := NewGroupIdentity(list, t)
+	g.Name = s.FullName
+	g.Email = s.Email
+	g.Comment = s.Extra
+	g.Public = s.Share.Commits
+	g.PgpID = s.PgpID
+	g.PgpPublic = s.PgpPublic
+	return g
+}
+
+type sharedPrivateToml struct {
+	KeyID    string
+	FullName string
+	Email    string
+	Extra    string
+	// index of the private share
+	Index int
+	// hex encoded private share
+	Share string
+	// hex encoded coefficients of the public polynomial
+	Commits []string
+	// hex encoded coefficients of the private polynomial of this node
+	PrivatePoly []string
+
+	PgpID      string
+	PgpCreated int64
+	PgpPublic  string
+}
+
+// Toml returns a TOML-able struct containing the hex encoded share as well as
+// the public and private polynomials.
+func (s *SharedPrivate) Toml() interface{} {
+	return &sharedPrivateToml{
+		KeyID:       s.KeyID,
+		FullName:    s.FullName,
+		Email:       s.Email,
+		Extra:       s.Extra,
+		Index:       s.Share.Share.I,
+		Share:       scalarToHex(s.Share.Share.V),
+		Commits:     pointsToHex(s.Share.Commits),
+		PrivatePoly: scalarsToHex(s.Share.PrivatePoly),
+		PgpID:       pgpIDToString(s.PgpID),
+		PgpCreated:  pgpCreatedToUnix(s.PgpCreated),
+		PgpPublic:   s.PgpPublic,
+	}
+}
+
+// FromToml reads the given string to parse the SharedPrivate. It returns
+// ErrEncrypted if the content is encrypted, see FromEncryptedToml.
+func (s *SharedPrivate) FromToml(f string) error {
+	if IsEncrypted(f) {
+		return ErrEncrypted
+	}
+	st := &sharedPrivateToml{}
+	if _, err := toml.Decode(f, st); err != nil {
+		return err
+	}
+	v, err := hexToScalar(st.Share)
+	if err != nil {
+		return err
+	}
+	commits, err := hexToPoints(st.Commits)
+	if err != nil {
+		return err
+	}
+	poly, err := hexToScalars(st.PrivatePoly)
+	if err != nil {
+		return err
+	}
+	pgpID, err := pgpIDFromString(st.PgpID)
+	if err != nil {
+		return err
+	}
+	s.KeyID = st.KeyID
+	s.FullName = st.FullName
+	s.Email = st.Email
+	s.Extra = st.Extra
+	s.Share = &dkg.DistKeyShare{
+		Commits:     commits,
+		Share:       &share.PriShare{I: st.Index, V: v},
+		PrivatePoly: poly,
+	}
+	s.PgpID = pgpID
+	if st.PgpCreated != 0 {
+		s.PgpCreated = time.Unix(st.PgpCreated, 0)
+	}
+	s.PgpPublic = st.PgpPublic
+	return nil
 }
@@ -0,0 +1,213 @@
+package key
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+
+	"github.com/BurntSushi/toml"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// EnvelopeCipher identifies the key derivation function and the AEAD used to
+// encrypt an Envelope.
+const EnvelopeCipher = "argon2id-chacha20poly1305"
+
+// Default argon2id parameters used to derive the encryption key from the
+// passphrase, as recommended by the argon2 draft.
+const (
+	DefaultKdfTime    = 1
+	DefaultKdfMemory  = 64 * 1024 // in KiB
+	DefaultKdfThreads = 4
+)
+
+// Bounds of the argon2id parameters and of the salt accepted when decrypting
+// an Envelope. They are read from the envelope before its authenticity can be
+// checked, so they must not allow a weak key nor an unbounded allocation.
+const (
+	minKdfTime    = 1
+	maxKdfTime    = 16
+	minKdfMemory  = 64 * 1024   // in KiB
+	maxKdfMemory  = 1024 * 1024 // in KiB
+	minKdfThreads = 1
+	maxKdfThreads = 64
+	saltSize      = 16
+	maxSaltSize   = 64
+)
+
+// ErrEncrypted is returned when trying to read encrypted material without a
+// passphrase.
+var ErrEncrypted = errors.New("key: content is encrypted, a passphrase is needed")
+
+// ErrDecryption is returned when the passphrase is wrong or the encrypted
+// content has been tampered with.
+var ErrDecryption = errors.New("key: wrong passphrase or corrupted content")
+
+// Envelope holds some content encrypted with a key derived from a passphrase.
+// It is TOML-able as is. The parameters of the key derivation are saved along
+// so they can evolve without breaking existing envelopes.
+type Envelope struct {
+	Cipher     string
+	Salt       string // base64 encoded
+	Time       uint32
+	Memory     uint32
+	Threads    uint8
+	Nonce      string // base64 encoded
+	Ciphertext string // base64 encoded
+}
+
+// Encrypt returns an Envelope containing the plaintext encrypted with a key
+// derived from the passphrase using argon2id.
+func Encrypt(passphrase, plaintext []byte) (*Envelope, error) {
+	e := &Envelope{
+		Cipher:  EnvelopeCipher,
+		Time:    DefaultKdfTime,
+		Memory:  DefaultKdfMemory,
+		Threads: DefaultKdfThreads,
+	}
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	aead, err := chacha20poly1305.New(e.key(passphrase, salt))
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	e.Salt = base64.StdEncoding.EncodeToString(salt)
+	e.Nonce = base64.StdEncoding.EncodeToString(nonce)
+	ciphertext := aead.Seal(nil, nonce, plaintext, e.additionalData(salt))
+	e.Ciphertext = base64.StdEncoding.EncodeToString(ciphertext)
+	return e, nil
+}
+
+// Decrypt returns the plaintext of the envelope. It returns ErrDecryption if
+// the passphrase is wrong.
+func (e *Envelope) Decrypt(passphrase []byte) ([]byte, error) {
+	if e.Cipher != EnvelopeCipher {
+		return nil, errors.New("key: unknown envelope cipher " + e.Cipher)
+	}
+	salt, err := base64.StdEncoding.DecodeString(e.Salt)
+	if err != nil {
+		return nil, err
+	}
+	if err := e.validate(salt); err != nil {
+		return nil, err
+	}
+	nonce, err := base64.StdEncoding.DecodeString(e.Nonce)
+	if err != nil {
+		return nil, err
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(e.Ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := chacha20poly1305.New(e.key(passphrase, salt))
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != aead.NonceSize() {
+		return nil, ErrDecryption
+	}
+	plaintext, err := aead.Open(nil, nonce, ciphertext, e.additionalData(salt))
+	if err != nil {
+		return nil, ErrDecryption
+	}
+	return plaintext, nil
+}
+
+func (e *Envelope) key(passphrase, salt []byte) []byte {
+	return argon2.IDKey(passphrase, salt, e.Time, e.Memory, e.Threads, chacha20poly1305.KeySize)
+}
+
+// validate returns an error if the key derivation parameters or the salt are
+// out of bounds.
+func (e *Envelope) validate(salt []byte) error {
+	switch {
+	case e.Time < minKdfTime || e.Time > maxKdfTime,
+		e.Memory < minKdfMemory || e.Memory > maxKdfMemory,
+		e.Threads < minKdfThreads || e.Threads > maxKdfThreads:
+		return errors.New("key: envelope key derivation parameters out of bounds")
+	case len(salt) < saltSize || len(salt) > maxSaltSize:
+		return errors.New("key: envelope salt size out of bounds")
+	}
+	return nil
+}
+
+// additionalData binds the ciphertext to the cipher name, the key derivation
+// parameters and the salt so none of them can be changed without being
+// noticed.
+func (e *Envelope) additionalData(salt []byte) []byte {
+	var buff bytes.Buffer
+	buff.WriteByte(byte(len(e.Cipher)))
+	buff.WriteString(e.Cipher)
+	binary.Write(&buff, binary.BigEndian, e.Time)
+	binary.Write(&buff, binary.BigEndian, e.Memory)
+	buff.WriteByte(e.Threads)
+	buff.Write(salt)
+	return buff.Bytes()
+}
+
+// IsEncrypted returns true if the given TOML content is an Envelope.
+func IsEncrypted(f string) bool {
+	e := new(Envelope)
+	if _, err := toml.Decode(f, e); err != nil {
+		return false
+	}
+	return e.Cipher != "" && e.Ciphertext != ""
+}
+
+// encryptToml encodes the TOML-able struct and encrypts it.
+func encryptToml(t interface{}, passphrase []byte) (*Envelope, error) {
+	var buff bytes.Buffer
+	if err := toml.NewEncoder(&buff).Encode(t); err != nil {
+		return nil, err
+	}
+	return Encrypt(passphrase, buff.Bytes())
+}
+
+// decryptToml returns the decrypted TOML content of the envelope given in f.
+func decryptToml(f string, passphrase []byte) (string, error) {
+	e := new(Envelope)
+	if _, err := toml.Decode(f, e); err != nil {
+		return "", err
+	}
+	plaintext, err := e.Decrypt(passphrase)
+	return string(plaintext), err
+}
+
+// EncryptedToml returns a TOML-able Envelope containing the private key
+// encrypted with the given passphrase.
+func (p *Private) EncryptedToml(passphrase []byte) (interface{}, error) {
+	return encryptToml(p.Toml(), passphrase)
+}
+
+// FromEncryptedToml reads the private key from the given encrypted content.
+func (p *Private) FromEncryptedToml(f string, passphrase []byte) error {
+	plain, err := decryptToml(f, passphrase)
+	if err != nil {
+		return err
+	}
+	return p.FromToml(plain)
+}
+
+// EncryptedToml returns a TOML-able Envelope containing the share encrypted
+// with the given passphrase.
+func (s *SharedPrivate) EncryptedToml(passphrase []byte) (interface{}, error) {
+	return encryptToml(s.Toml(), passphrase)
+}
+
+// FromEncryptedToml reads the share from the given encrypted content.
+func (s *SharedPrivate) FromEncryptedToml(f string, passphrase []byte) error {
+	plain, err := decryptToml(f, passphrase)
+	if err != nil {
+		return err
+	}
+	return s.FromToml(plain)
+}
@@ -0,0 +1,71 @@
+package key
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+
+	"github.com/BurntSushi/toml"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEnvelope(t *testing.T) {
+	pass := []byte("correct horse battery staple")
+	msg := []byte("Hello World")
+	e, err := Encrypt(pass, msg)
+	require.Nil(t, err)
+	plain, err := e.Decrypt(pass)
+	require.Nil(t, err)
+	require.Equal(t, msg, plain)
+
+	_, err = e.Decrypt([]byte("wrong"))
+	require.Equal(t, ErrDecryption, err)
+
+	// out of bounds key derivation parameters are rejected before deriving
+	// the key
+	for _, tamper := range []func(*Envelope){
+		func(e *Envelope) { e.Memory = 1<<32 - 1 },
+		func(e *Envelope) { e.Memory = 8 },
+		func(e *Envelope) { e.Threads = 0 },
+		func(e *Envelope) { e.Time = 0 },
+		func(e *Envelope) { e.Time = 1 << 20 },
+		func(e *Envelope) { e.Salt = "" },
+	} {
+		tampered := *e
+		tamper(&tampered)
+		_, err = tampered.Decrypt(pass)
+		require.NotNil(t, err)
+		require.NotEqual(t, ErrDecryption, err)
+	}
+	// the parameters are authenticated
+	tampered := *e
+	tampered.Threads++
+	_, err = tampered.Decrypt(pass)
+	require.Equal(t, ErrDecryption, err)
+
+	e.Cipher = "none"
+	_, err = e.Decrypt(pass)
+	require.NotNil(t, err)
+}
+
+func TestPrivateEncryptedToml(t *testing.T) {
+	pass := []byte("passphrase")
+	priv, _, err := NewPrivateIdentity(rand.Reader)
+	require.Nil(t, err)
+
+	et, err := priv.EncryptedToml(pass)
+	require.Nil(t, err)
+	var buff bytes.Buffer
+	require.Nil(t, toml.NewEncoder(&buff).Encode(et))
+	require.True(t, IsEncrypted(buff.String()))
+
+	priv2 := new(Private)
+	require.Equal(t, ErrEncrypted, priv2.FromToml(buff.String()))
+	require.Equal(t, ErrDecryption, priv2.FromEncryptedToml(buff.String(), []byte("wrong")))
+	require.Nil(t, priv2.FromEncryptedToml(buff.String(), pass))
+	require.True(t, priv.Scalar().Equal(priv2.Scalar()))
+
+	buff.Reset()
+	require.Nil(t, toml.NewEncoder(&buff).Encode(priv.Toml()))
+	require.False(t, IsEncrypted(buff.String()))
+}
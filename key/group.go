@@ -1,8 +1,15 @@
 package key
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/BurntSushi/toml"
 	"github.com/dedis/kyber"
-	"github.com/dedis/kyber/util/encoding"
 )
 
 // GroupIdentity is the identity of a group created with dsign. It is
@@ -24,6 +31,16 @@ type GroupIdentity struct {
 	PgpPublic string
 }
 
+// NewGroupIdentity returns the definition of a group, i.e. its participants
+// and its threshold, before any key is created.
+func NewGroupIdentity(list []*Identity, t int) *GroupIdentity {
+	ids := make([]Identity, len(list))
+	for i, id := range list {
+		ids[i] = *id
+	}
+	return &GroupIdentity{Ids: ids, T: t}
+}
+
 type groupToml struct {
 	Name    string
 	Email   string
@@ -40,16 +57,9 @@ type groupToml struct {
 	PgpPublic string
 }
 
-func (g *GroupIdentity) toml() interface{} {
-	publics := make([]string, len(g.Public))
-	for i, p := range g.Public {
-		s, err := encoding.PointToStringHex(Curve, p)
-		if err != nil {
-			return err
-		}
-		publics[i] = s
-	}
-
+// Toml returns a TOML-able struct containing the hex encoded public
+// polynomial and the identities of the participants.
+func (g *GroupIdentity) Toml() interface{} {
 	ids := make([]identityToml, len(g.Ids))
 	for i, id := range g.Ids {
 		itoml := id.Toml().(*identityToml)
@@ -60,9 +70,172 @@ func (g *GroupIdentity) toml() interface{} {
 		Name:      g.Name,
 		Email:     g.Email,
 		Comment:   g.Comment,
-		Public:    publics,
+		Public:    pointsToHex(g.Public),
 		Ids:       ids,
 		T:         g.T,
+		PgpID:     pgpIDToString(g.PgpID),
 		PgpPublic: g.PgpPublic,
 	}
 }
+
+// FromToml reads the given string to parse the GroupIdentity. It returns an
+// error if the identity of a participant is invalid or if the group is not
+// consistent, see Validate.
+func (g *GroupIdentity) FromToml(f string) error {
+	gt := &groupToml{}
+	if _, err := toml.Decode(f, gt); err != nil {
+		return err
+	}
+	publics, err := hexToPoints(gt.Public)
+	if err != nil {
+		return err
+	}
+	ids := make([]Identity, len(gt.Ids))
+	for i := range gt.Ids {
+		if err := ids[i].fromToml(&gt.Ids[i]); err != nil {
+			return fmt.Errorf("key: participant %d of the group: %s", i, err)
+		}
+	}
+	pgpID, err := pgpIDFromString(gt.PgpID)
+	if err != nil {
+		return err
+	}
+	g.Name = gt.Name
+	g.Email = gt.Email
+	g.Comment = gt.Comment
+	g.Public = publics
+	g.Ids = ids
+	g.T = gt.T
+	g.PgpID = pgpID
+	g.PgpPublic = gt.PgpPublic
+	return g.Validate()
+}
+
+// LoadGroup reads the group file at the given path.
+func LoadGroup(path string) (*GroupIdentity, error) {
+	buff, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	g := new(GroupIdentity)
+	if err := g.FromToml(string(buff)); err != nil {
+		return nil, fmt.Errorf("key: group file %s: %s", path, err)
+	}
+	return g, nil
+}
+
+// Validate returns an error if the group has no participants, contains the
+// same participant more than once, if the threshold is out of bounds, if
+// the public polynomial, when present, does not have a threshold of
+// coefficients or if the group has no canonical encoding.
+func (g *GroupIdentity) Validate() error {
+	if len(g.Ids) == 0 {
+		return errors.New("key: group without participants")
+	}
+	seen := make(map[string]bool)
+	for i := range g.Ids {
+		k := string(g.Ids[i].Key)
+		if seen[k] {
+			return fmt.Errorf("key: participant %d appears more than once in the group", i)
+		}
+		seen[k] = true
+	}
+	if err := ValidateThreshold(g.T, len(g.Ids)); err != nil {
+		return err
+	}
+	if len(g.Public) != 0 && len(g.Public) != g.T {
+		return fmt.Errorf("key: %d coefficients in the public polynomial for a threshold of %d", len(g.Public), g.T)
+	}
+	_, err := g.Canonical()
+	return err
+}
+
+// MinimumThreshold returns the smallest threshold allowed for n participants:
+// half of them, and at least two, for the distributed key to be secure.
+func MinimumThreshold(n int) int {
+	min := (n + 1) / 2
+	if min < 2 {
+		min = 2
+	}
+	return min
+}
+
+// ValidateThreshold returns an error if the threshold t is lower than
+// MinimumThreshold(n) or greater than the number n of participants.
+func ValidateThreshold(t, n int) error {
+	if min := MinimumThreshold(n); t < min || t > n {
+		return fmt.Errorf("key: threshold %d out of bounds [%d, %d]", t, min, n)
+	}
+	return nil
+}
+
+// Canonical returns the canonical binary encoding of the group: every field
+// in the order of the struct, integers in big endian, and variable length
+// fields prefixed by their length. Two groups are equal if and only if their
+// encodings are. It returns an error if a coefficient of the public polynomial
+// can't be encoded.
+func (g *GroupIdentity) Canonical() ([]byte, error) {
+	var b bytes.Buffer
+	writeBytes(&b, []byte(groupEncodingVersion))
+	writeBytes(&b, []byte(g.Name))
+	writeBytes(&b, []byte(g.Email))
+	writeBytes(&b, []byte(g.Comment))
+	writeUint(&b, uint64(len(g.Public)))
+	for i, p := range g.Public {
+		buff, err := p.MarshalBinary()
+		if err != nil {
+			return nil, fmt.Errorf("key: coefficient %d of the public polynomial: %s", i, err)
+		}
+		writeBytes(&b, buff)
+	}
+	if err := g.writeDefinition(&b); err != nil {
+		return nil, err
+	}
+	writeUint(&b, g.PgpID)
+	writeBytes(&b, []byte(g.PgpPublic))
+	return b.Bytes(), nil
+}
+
+// Hash returns the SHA-256 hash of the definition of the group, i.e. the
+// canonical encoding of its threshold and of its participants in order.
+// Unlike the canonical encoding, it does not depend on the outcome of the dkg,
+// so nodes can compare it before running the dkg.
+func (g *GroupIdentity) Hash() ([]byte, error) {
+	var b bytes.Buffer
+	writeBytes(&b, []byte(groupEncodingVersion))
+	if err := g.writeDefinition(&b); err != nil {
+		return nil, err
+	}
+	h := sha256.Sum256(b.Bytes())
+	return h[:], nil
+}
+
+// groupEncodingVersion prefixes the canonical encodings of groups.
+const groupEncodingVersion = "dsign-group-v1"
+
+// writeDefinition writes the threshold and the participants. It returns an
+// error if the threshold is negative.
+func (g *GroupIdentity) writeDefinition(b *bytes.Buffer) error {
+	if g.T < 0 {
+		return fmt.Errorf("key: negative threshold %d", g.T)
+	}
+	writeUint(b, uint64(g.T))
+	writeUint(b, uint64(len(g.Ids)))
+	for i := range g.Ids {
+		writeBytes(b, g.Ids[i].Key)
+		writeBytes(b, g.Ids[i].Signature)
+		writeBytes(b, []byte(g.Ids[i].Address))
+	}
+	return nil
+}
+
+func writeUint(b *bytes.Buffer, i uint64) {
+	var buff [8]byte
+	binary.BigEndian.PutUint64(buff[:], i)
+	b.Write(buff[:])
+}
+
+func writeBytes(b *bytes.Buffer, data []byte) {
+	writeUint(b, uint64(len(data)))
+	b.Write(data)
+}
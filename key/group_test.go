@@ -0,0 +1,132 @@
+package key
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/BurntSushi/toml"
+	"github.com/dedis/kyber"
+	"github.com/stretchr/testify/require"
+)
+
+func newGroup(t *testing.T, n, thr int) *GroupIdentity {
+	list := make([]*Identity, n)
+	for i := range list {
+		_, id, err := NewPrivateIdentityWithAddr(fmt.Sprintf("127.0.0.1:%d", 8000+i), rand.Reader)
+		require.Nil(t, err)
+		list[i] = id
+	}
+	g := NewGroupIdentity(list, thr)
+	g.Name = "dsign"
+	g.Email = "dsign@dsign.io"
+	for i := 0; i < thr; i++ {
+		g.Public = append(g.Public, Curve.Point().Pick(Curve.RandomStream()))
+	}
+	g.PgpID = 0xdeadbeefcafe
+	g.PgpPublic = "-----BEGIN PGP PUBLIC KEY BLOCK-----"
+	return g
+}
+
+func canonical(t *testing.T, g *GroupIdentity) []byte {
+	buff, err := g.Canonical()
+	require.Nil(t, err)
+	return buff
+}
+
+func hash(t *testing.T, g *GroupIdentity) []byte {
+	h, err := g.Hash()
+	require.Nil(t, err)
+	return h
+}
+
+// unencodablePoint is a point which can't be marshalled.
+type unencodablePoint struct {
+	kyber.Point
+}
+
+func (unencodablePoint) MarshalBinary() ([]byte, error) {
+	return nil, errors.New("unencodable")
+}
+
+func TestGroupToml(t *testing.T) {
+	g := newGroup(t, 3, 2)
+	var buff bytes.Buffer
+	require.Nil(t, toml.NewEncoder(&buff).Encode(g.Toml()))
+
+	g2 := new(GroupIdentity)
+	require.Nil(t, g2.FromToml(buff.String()))
+	require.Equal(t, canonical(t, g), canonical(t, g2))
+	require.Equal(t, hash(t, g), hash(t, g2))
+	require.Equal(t, g.PgpID, g2.PgpID)
+	require.Equal(t, g.PgpPublic, g2.PgpPublic)
+
+	dir, err := ioutil.TempDir("", "dsign")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "group.toml")
+	require.Nil(t, ioutil.WriteFile(path, buff.Bytes(), 0644))
+	g3, err := LoadGroup(path)
+	require.Nil(t, err)
+	require.Equal(t, canonical(t, g), canonical(t, g3))
+	_, err = LoadGroup(filepath.Join(dir, "none.toml"))
+	require.NotNil(t, err)
+}
+
+func TestGroupHash(t *testing.T) {
+	g := newGroup(t, 3, 2)
+	list := make([]*Identity, len(g.Ids))
+	for i := range g.Ids {
+		list[i] = &g.Ids[i]
+	}
+	// the hash only depends on the participants and the threshold
+	def := NewGroupIdentity(list, g.T)
+	require.Equal(t, hash(t, g), hash(t, def))
+	require.NotEqual(t, canonical(t, g), canonical(t, def))
+
+	require.NotEqual(t, hash(t, g), hash(t, NewGroupIdentity(list, 3)))
+	swapped := []*Identity{list[1], list[0], list[2]}
+	require.NotEqual(t, hash(t, g), hash(t, NewGroupIdentity(swapped, g.T)))
+	require.NotEqual(t, hash(t, g), hash(t, NewGroupIdentity(list[:2], g.T)))
+	_, err := NewGroupIdentity(list, -1).Hash()
+	require.NotNil(t, err)
+}
+
+func TestGroupValidate(t *testing.T) {
+	g := newGroup(t, 3, 2)
+	require.Nil(t, g.Validate())
+
+	bad := *g
+	bad.T = 4
+	require.NotNil(t, bad.Validate())
+	bad.T = 1
+	require.NotNil(t, bad.Validate())
+	bad = *newGroup(t, 5, 2)
+	require.NotNil(t, bad.Validate())
+	bad.T = 3
+	bad.Public = nil
+	require.Nil(t, bad.Validate())
+
+	bad = *g
+	bad.Ids = append([]Identity{g.Ids[0]}, g.Ids...)
+	require.NotNil(t, bad.Validate())
+
+	bad = *g
+	bad.Public = []kyber.Point{g.Public[0]}
+	require.NotNil(t, bad.Validate())
+	bad.Public = nil
+	require.Nil(t, bad.Validate())
+
+	bad = *g
+	bad.Public = []kyber.Point{g.Public[0], unencodablePoint{g.Public[1]}}
+	_, err := bad.Canonical()
+	require.NotNil(t, err)
+	require.NotNil(t, bad.Validate())
+
+	require.NotNil(t, new(GroupIdentity).Validate())
+}
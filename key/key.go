@@ -8,6 +8,7 @@ import (
 	"crypto/sha512"
 	"encoding/base64"
 	"encoding/hex"
+	"errors"
 	"io"
 
 	"golang.org/x/crypto/curve25519"
@@ -101,18 +102,84 @@ type Identity struct {
 	Address string
 }
 
+// NewIdentity returns the identity with the given public key, self signature
+// and address, and the ID derived from the signature. It returns an error if
+// the identity is not valid, see Verify.
+func NewIdentity(public, signature []byte, address string) (*Identity, error) {
+	i := &Identity{Key: public, Signature: signature, Address: address}
+	i.ID = i.deriveID()
+	if err := i.Verify(); err != nil {
+		return nil, err
+	}
+	return i, nil
+}
+
 // selfsign marshals the identity's public key, and the address if present, and
 // then signs the resulting buffer. The signature can be accessed through the
 // Signature field of the Identity. It is a regular Eddsa signature.
 func (i *Identity) selfsign(p *Private, r io.Reader) {
+	i.Signature = ed25519.Sign(*p.seed, i.selfsignMessage())
+	i.ID = i.deriveID()
+}
+
+// deriveID returns the ID corresponding to the self signature.
+func (i *Identity) deriveID() string {
+	b := sha256.Sum256(i.Signature)
+	return hex.EncodeToString(b[:])
+}
+
+// selfsignMessage returns the message of the self signature.
+func (i *Identity) selfsignMessage() []byte {
 	var buff bytes.Buffer
 	buff.Write(i.Key)
 	if i.Address != "" {
 		buff.Write([]byte(i.Address))
 	}
-	i.Signature = ed25519.Sign(*p.seed, buff.Bytes())
-	b := sha256.Sum256(i.Signature)
-	i.ID = hex.EncodeToString(b[:])
+	return buff.Bytes()
+}
+
+// Verify returns an error if the public key of the identity is not a valid
+// ed25519 point, if the self signature is invalid or if the ID, when set, does
+// not correspond to the signature.
+func (i *Identity) Verify() error {
+	if len(i.Key) != ed25519.PublicKeySize {
+		return errors.New("key: invalid public key length")
+	}
+	p := Curve.Point()
+	if err := p.UnmarshalBinary(i.Key); err != nil {
+		return errors.New("key: invalid public key: " + err.Error())
+	}
+	// reject the points of small order, the identity included
+	cofactor := Curve.Scalar().SetInt64(8)
+	if Curve.Point().Mul(cofactor, p).Equal(Curve.Point().Null()) {
+		return errors.New("key: public key of small order")
+	}
+	if !ed25519.Verify(ed25519.PublicKey(i.Key), i.selfsignMessage(), i.Signature) {
+		return errors.New("key: invalid self signature")
+	}
+	if i.ID != "" && i.ID != i.deriveID() {
+		return errors.New("key: identity id does not match its signature")
+	}
+	return nil
+}
+
+// Sign returns the ed25519 signature of the message by this private key.
+func (p *Private) Sign(msg []byte) []byte {
+	return ed25519.Sign(*p.seed, msg)
+}
+
+// VerifySignature returns an error if the signature is not a valid ed25519
+// signature of the message by this identity.
+func (i *Identity) VerifySignature(msg, sig []byte) error {
+	if len(i.Key) != ed25519.PublicKeySize || !ed25519.Verify(ed25519.PublicKey(i.Key), msg, sig) {
+		return errors.New("key: invalid signature")
+	}
+	return nil
+}
+
+// Equals returns true if both identities refer to the same ed25519 public key.
+func (i *Identity) Equals(i2 *Identity) bool {
+	return bytes.Equal(i.Key, i2.Key)
 }
 
 // PublicCurve25519 returns a ed25519 public key.
@@ -140,8 +207,12 @@ func (p *Private) Toml() interface{} {
 }
 
 // FromToml reads the given input string to parse the private
-// key.
+// key. It returns ErrEncrypted if the content is encrypted, see
+// FromEncryptedToml.
 func (p *Private) FromToml(f string) error {
+	if IsEncrypted(f) {
+		return ErrEncrypted
+	}
 	pt := &privateToml{}
 	_, err := toml.Decode(f, pt)
 	if err != nil {
@@ -173,13 +244,18 @@ func (i *Identity) Toml() interface{} {
 	}
 }
 
-// FromToml reads the given string to parse the Identity.
+// FromToml reads the given string to parse the Identity. The self signature is
+// verified and the ID derived from it.
 func (i *Identity) FromToml(f string) error {
 	it := &identityToml{}
 	_, err := toml.Decode(f, it)
 	if err != nil {
 		return err
 	}
+	return i.fromToml(it)
+}
+
+func (i *Identity) fromToml(it *identityToml) error {
 	public, err := base64.StdEncoding.DecodeString(it.Key)
 	if err != nil {
 		return err
@@ -188,9 +264,11 @@ func (i *Identity) FromToml(f string) error {
 	if err != nil {
 		return err
 	}
-	i.Key = public
-	i.Address = it.Address
-	i.Signature = signature
+	id, err := NewIdentity(public, signature, it.Address)
+	if err != nil {
+		return err
+	}
+	*i = *id
 	return nil
 }
 
@@ -0,0 +1,61 @@
+package key
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/BurntSushi/toml"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIdentityVerify(t *testing.T) {
+	_, id, err := NewPrivateIdentityWithAddr("127.0.0.1:8000", rand.Reader)
+	require.Nil(t, err)
+	require.Nil(t, id.Verify())
+
+	forged := *id
+	forged.Address = "127.0.0.1:8001"
+	require.NotNil(t, forged.Verify())
+
+	short := *id
+	short.Key = id.Key[:16]
+	require.NotNil(t, short.Verify())
+
+	// the neutral element is of small order
+	null, err := Curve.Point().Null().MarshalBinary()
+	require.Nil(t, err)
+	small := *id
+	small.Key = null
+	require.NotNil(t, small.Verify())
+
+	id2, err := NewIdentity(id.Key, id.Signature, id.Address)
+	require.Nil(t, err)
+	require.Equal(t, id, id2)
+	_, err = NewIdentity(id.Key, id.Signature, forged.Address)
+	require.NotNil(t, err)
+}
+
+func TestIdentityToml(t *testing.T) {
+	_, id, err := NewPrivateIdentityWithAddr("127.0.0.1:8000", rand.Reader)
+	require.Nil(t, err)
+	var buff bytes.Buffer
+	require.Nil(t, toml.NewEncoder(&buff).Encode(id.Toml()))
+
+	id2 := new(Identity)
+	require.Nil(t, id2.FromToml(buff.String()))
+	require.Equal(t, id.ID, id2.ID)
+	require.Nil(t, id2.Verify())
+
+	// the id must match the signature
+	id2.ID = "00"
+	require.NotNil(t, id2.Verify())
+
+	// key swapped in the file
+	_, other, err := NewPrivateIdentityWithAddr("127.0.0.1:8000", rand.Reader)
+	require.Nil(t, err)
+	tampered := strings.Replace(buff.String(), base64.StdEncoding.EncodeToString(id.Key), base64.StdEncoding.EncodeToString(other.Key), 1)
+	require.NotNil(t, new(Identity).FromToml(tampered))
+}
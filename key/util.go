@@ -1,6 +1,12 @@
 package key
 
-import "github.com/dedis/kyber"
+import (
+	"strconv"
+	"time"
+
+	"github.com/dedis/kyber"
+	"github.com/dedis/kyber/util/encoding"
+)
 
 // IdentitiesToPoints returns a list of kyber.Point from a list of Identity
 func IdentitiesToPoints(list []*Identity) []kyber.Point {
@@ -11,3 +17,86 @@ func IdentitiesToPoints(list []*Identity) []kyber.Point {
 	}
 	return p
 }
+
+// pointsToHex returns the hex representation of the given points. Marshalling
+// a point of the curve never fails.
+func pointsToHex(points []kyber.Point) []string {
+	s := make([]string, len(points))
+	for i, p := range points {
+		str, err := encoding.PointToStringHex(Curve, p)
+		if err != nil {
+			panic(err)
+		}
+		s[i] = str
+	}
+	return s
+}
+
+func hexToPoints(s []string) ([]kyber.Point, error) {
+	points := make([]kyber.Point, len(s))
+	for i, str := range s {
+		p, err := encoding.StringHexToPoint(Curve, str)
+		if err != nil {
+			return nil, err
+		}
+		points[i] = p
+	}
+	return points, nil
+}
+
+// scalarToHex returns the hex representation of the given scalar.
+// Marshalling a scalar of the curve never fails.
+func scalarToHex(scalar kyber.Scalar) string {
+	str, err := encoding.ScalarToStringHex(Curve, scalar)
+	if err != nil {
+		panic(err)
+	}
+	return str
+}
+
+func hexToScalar(s string) (kyber.Scalar, error) {
+	return encoding.StringHexToScalar(Curve, s)
+}
+
+func scalarsToHex(scalars []kyber.Scalar) []string {
+	s := make([]string, len(scalars))
+	for i, scalar := range scalars {
+		s[i] = scalarToHex(scalar)
+	}
+	return s
+}
+
+func hexToScalars(s []string) ([]kyber.Scalar, error) {
+	scalars := make([]kyber.Scalar, len(s))
+	for i, str := range s {
+		scalar, err := hexToScalar(str)
+		if err != nil {
+			return nil, err
+		}
+		scalars[i] = scalar
+	}
+	return scalars, nil
+}
+
+// pgpIDToString returns the hexadecimal representation of the pgp key id, or
+// an empty string if there is none.
+func pgpIDToString(id uint64) string {
+	if id == 0 {
+		return ""
+	}
+	return strconv.FormatUint(id, 16)
+}
+
+func pgpIDFromString(s string) (uint64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	return strconv.ParseUint(s, 16, 64)
+}
+
+func pgpCreatedToUnix(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
@@ -0,0 +1,167 @@
+// Package minisign encodes the group key and the distributed signatures of
+// dsign in the formats of minisign and of OpenBSD signify, both using Ed25519.
+//
+// Nothing is signed here: the messages to sign with the distributed Ed25519 key
+// are given by each Signature and the resulting signatures are turned into the
+// content of the ".minisig" and ".sig" files. A minisign signature needs two
+// signatures: one of the file and a global one covering the first signature and
+// the trusted comment.
+package minisign
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/dedis/kyber"
+	"golang.org/x/crypto/blake2b"
+)
+
+const (
+	// algorithm of the public keys and of the signify signatures
+	algoEd = "Ed"
+	// algorithm of the minisign signatures of the hashed file
+	algoEdHashed = "ED"
+
+	untrustedPrefix = "untrusted comment: "
+	trustedPrefix   = "trusted comment: "
+)
+
+// KeyID returns the 8 bytes key id of the given key. Both formats use a random
+// key id when generating a key: the one of the group key is derived from the
+// key itself so all nodes agree on it.
+func KeyID(public kyber.Point) ([]byte, error) {
+	buff, err := public.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.Sum256(buff)
+	return h[:8], nil
+}
+
+// PublicKey returns the content of the minisign public key file of the given
+// key.
+func PublicKey(public kyber.Point) (string, error) {
+	blob, id, err := publicBlob(public)
+	if err != nil {
+		return "", err
+	}
+	comment := "minisign public key " + hexID(id)
+	return encode(comment, blob), nil
+}
+
+// SignifyPublicKey returns the content of the signify public key file of the
+// given key with the given untrusted comment.
+func SignifyPublicKey(public kyber.Point, comment string) (string, error) {
+	blob, _, err := publicBlob(public)
+	if err != nil {
+		return "", err
+	}
+	return encode(comment, blob), nil
+}
+
+// Signature is a minisign signature of a file. The file must first be signed
+// with Message, then the global signature covering the trusted comment must be
+// signed with GlobalMessage.
+type Signature struct {
+	id      []byte
+	digest  []byte // BLAKE2b-512 hash of the file
+	trusted string // trusted comment
+}
+
+// NewSignature returns the minisign signature of the given file by the given
+// key. The trusted comment is signed along with the file, e.g. "timestamp:..."
+// as written by minisign.
+func NewSignature(public kyber.Point, file []byte, trusted string) (*Signature, error) {
+	if strings.ContainsAny(trusted, "\r\n") {
+		return nil, errors.New("minisign: trusted comment on multiple lines")
+	}
+	id, err := KeyID(public)
+	if err != nil {
+		return nil, err
+	}
+	digest := blake2b.Sum512(file)
+	return &Signature{
+		id:      id,
+		digest:  digest[:],
+		trusted: trusted,
+	}, nil
+}
+
+// Message returns the message of the first signature, i.e. the hash of the
+// file.
+func (s *Signature) Message() []byte {
+	return s.digest
+}
+
+// GlobalMessage returns the message of the global signature, i.e. the first
+// signature followed by the trusted comment.
+func (s *Signature) GlobalMessage(sig []byte) []byte {
+	return append(append([]byte{}, sig...), s.trusted...)
+}
+
+// File returns the content of the ".minisig" file from the signature of the
+// file and the global signature.
+func (s *Signature) File(sig, global []byte) (string, error) {
+	if len(sig) != 64 || len(global) != 64 {
+		return "", errors.New("minisign: invalid ed25519 signature length")
+	}
+	var b bytes.Buffer
+	b.WriteString(algoEdHashed)
+	b.Write(s.id)
+	b.Write(sig)
+	content := encode("signature from dsign group key "+hexID(s.id), b.Bytes())
+	content += trustedPrefix + s.trusted + "\n"
+	content += base64.StdEncoding.EncodeToString(global) + "\n"
+	return content, nil
+}
+
+// SignifyFile returns the content of the signify ".sig" file from the
+// signature of the message by the given key. Signify signs the message itself,
+// without hashing it first. The comment is usually "verify with key.pub".
+func SignifyFile(public kyber.Point, sig []byte, comment string) (string, error) {
+	if len(sig) != 64 {
+		return "", errors.New("minisign: invalid ed25519 signature length")
+	}
+	id, err := KeyID(public)
+	if err != nil {
+		return "", err
+	}
+	var b bytes.Buffer
+	b.WriteString(algoEd)
+	b.Write(id)
+	b.Write(sig)
+	return encode(comment, b.Bytes()), nil
+}
+
+func publicBlob(public kyber.Point) ([]byte, []byte, error) {
+	buff, err := public.MarshalBinary()
+	if err != nil {
+		return nil, nil, err
+	}
+	id, err := KeyID(public)
+	if err != nil {
+		return nil, nil, err
+	}
+	var b bytes.Buffer
+	b.WriteString(algoEd)
+	b.Write(id)
+	b.Write(buff)
+	return b.Bytes(), id, nil
+}
+
+// encode returns the untrusted comment line followed by the base64 encoded
+// data.
+func encode(comment string, data []byte) string {
+	return untrustedPrefix + comment + "\n" + base64.StdEncoding.EncodeToString(data) + "\n"
+}
+
+// hexID returns the key id as printed by minisign, i.e. as a little endian
+// integer.
+func hexID(id []byte) string {
+	return fmt.Sprintf("%016X", binary.LittleEndian.Uint64(id))
+}
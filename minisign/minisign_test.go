@@ -0,0 +1,93 @@
+package minisign
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/dedis/kyber"
+	"github.com/nikkolasg/dsign/key"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/ed25519"
+)
+
+func newKey(t *testing.T) (kyber.Point, ed25519.PrivateKey) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.Nil(t, err)
+	point := key.Curve.Point()
+	require.Nil(t, point.UnmarshalBinary(pub))
+	return point, priv
+}
+
+// decode returns the comment and the decoded data of the two lines
+func decode(t *testing.T, lines []string) (string, []byte) {
+	require.True(t, strings.HasPrefix(lines[0], untrustedPrefix))
+	data, err := base64.StdEncoding.DecodeString(lines[1])
+	require.Nil(t, err)
+	return strings.TrimPrefix(lines[0], untrustedPrefix), data
+}
+
+func TestPublicKey(t *testing.T) {
+	point, priv := newKey(t)
+	id, err := KeyID(point)
+	require.Nil(t, err)
+
+	content, err := PublicKey(point)
+	require.Nil(t, err)
+	comment, data := decode(t, strings.Split(content, "\n"))
+	require.Equal(t, "minisign public key "+hexID(id), comment)
+	require.Len(t, data, 42)
+	require.Equal(t, algoEd, string(data[:2]))
+	require.Equal(t, id, data[2:10])
+	require.Equal(t, []byte(priv.Public().(ed25519.PublicKey)), data[10:])
+
+	content, err = SignifyPublicKey(point, "dsign public key")
+	require.Nil(t, err)
+	comment, data2 := decode(t, strings.Split(content, "\n"))
+	require.Equal(t, "dsign public key", comment)
+	require.Equal(t, data, data2)
+}
+
+func TestSignature(t *testing.T) {
+	point, priv := newKey(t)
+	file := []byte("sha256 dsign-v1.0.tar.gz\n")
+
+	_, err := NewSignature(point, file, "timestamp:1\nfile:x")
+	require.NotNil(t, err)
+
+	s, err := NewSignature(point, file, "timestamp:1500000000")
+	require.Nil(t, err)
+	digest := blake2b.Sum512(file)
+	require.Equal(t, digest[:], s.Message())
+	sig := ed25519.Sign(priv, s.Message())
+	global := ed25519.Sign(priv, s.GlobalMessage(sig))
+	_, err = s.File(sig, global[:32])
+	require.NotNil(t, err)
+
+	content, err := s.File(sig, global)
+	require.Nil(t, err)
+	lines := strings.Split(content, "\n")
+	require.Len(t, lines, 5)
+	_, data := decode(t, lines)
+	require.Equal(t, algoEdHashed, string(data[:2]))
+	require.Equal(t, s.id, data[2:10])
+	require.True(t, ed25519.Verify(priv.Public().(ed25519.PublicKey), digest[:], data[10:]))
+	require.Equal(t, trustedPrefix+"timestamp:1500000000", lines[2])
+	g, err := base64.StdEncoding.DecodeString(lines[3])
+	require.Nil(t, err)
+	require.True(t, ed25519.Verify(priv.Public().(ed25519.PublicKey), append(data[10:], "timestamp:1500000000"...), g))
+}
+
+func TestSignifyFile(t *testing.T) {
+	point, priv := newKey(t)
+	msg := []byte("SHA256 (dsign-v1.0.tar.gz) = 01234\n")
+	sig := ed25519.Sign(priv, msg)
+	content, err := SignifyFile(point, sig, "verify with dsign.pub")
+	require.Nil(t, err)
+	comment, data := decode(t, strings.Split(content, "\n"))
+	require.Equal(t, "verify with dsign.pub", comment)
+	require.Equal(t, algoEd, string(data[:2]))
+	require.Equal(t, sig, data[10:])
+}
@@ -225,8 +225,12 @@ func rcvBytes(c net.Conn) ([]byte, error) {
 var readTimeout = 1 * time.Minute
 
 // MaxPacketSize represents the maximum number of bytes can we receive or write
-// to a net.Conn in bytes.
-const MaxPacketSize = 1300
+// to a net.Conn in bytes. The largest packet is the proposal to reshare a key,
+// which carries the identities of the old and the new group: about 400 bytes
+// per member, so 64 KiB fits groups of about 160 members. Reading a packet
+// allocates up to twice its announced size, so a peer can make each of its
+// connections hold at most 128 KiB while a packet is received.
+const MaxPacketSize = 64 * 1024
 
 // globalOrder is the endianess used to write the size of a message.
 var globalOrder = binary.BigEndian
@@ -2,6 +2,8 @@ package net
 
 import (
 	"crypto/rand"
+	"encoding/binary"
+	"net"
 	"strconv"
 	"testing"
 	"time"
@@ -105,6 +107,25 @@ func TestGatewayBroadcast(t *testing.T) {
 	}
 }
 
+func TestGatewayPacketSize(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	sent := make(chan error, 1)
+	go func() { sent <- sendBytes(c1, make([]byte, MaxPacketSize)) }()
+	buff, err := rcvBytes(c2)
+	require.Nil(t, err)
+	require.Len(t, buff, MaxPacketSize)
+	require.Nil(t, <-sent)
+
+	require.NotNil(t, sendBytes(c1, make([]byte, MaxPacketSize+1)))
+	// a bigger packet is refused before reading it
+	go binary.Write(c1, globalOrder, uint32(MaxPacketSize+1))
+	_, err = rcvBytes(c2)
+	require.NotNil(t, err)
+}
+
 // Gateways returns n test Gateway using encrypted noise communication
 func Gateways(n int) ([]*key.Private, []Gateway) {
 	keys := GenerateIDs(8000, n)
@@ -7,6 +7,7 @@ import (
 	"github.com/nikkolasg/dsign/key"
 	"github.com/nikkolasg/dsign/net/transport"
 	"github.com/nikkolasg/dsign/net/transport/tcp"
+	"github.com/nikkolasg/slog"
 )
 
 type noiseTransport struct {
@@ -16,7 +17,8 @@ type noiseTransport struct {
 }
 
 // newNoiseTransport returns a Transport that encrypts connection from the
-// underlying transport using the noise framework.
+// underlying transport using the noise framework. Only the identities of the
+// list with a valid self signature are accepted.
 // XXX So far non-exported because it may be unsafe to use noise with another
 // non-controllable transport...
 func newNoiseTransport(priv *key.Private, list []*key.Identity, tr transport.Transport) transport.Transport {
@@ -26,6 +28,10 @@ func newNoiseTransport(priv *key.Private, list []*key.Identity, tr transport.Tra
 	}
 	lookup := make(map[string]*key.Identity, len(list))
 	for i := range list {
+		if err := list[i].Verify(); err != nil {
+			slog.Infof("noise: ignoring identity %s: %s", list[i].Address, err)
+			continue
+		}
 		c := list[i].PublicCurve25519()
 		s := string(c[:])
 		lookup[s] = list[i]
@@ -44,6 +50,9 @@ func NewTCPNoiseTransport(priv *key.Private, list []*key.Identity) transport.Tra
 }
 
 func (nt *noiseTransport) Dial(id *key.Identity) (transport.Conn, error) {
+	if err := id.Verify(); err != nil {
+		return nil, err
+	}
 	conn, err := nt.tr.Dial(id)
 	if err != nil {
 		return nil, err
@@ -81,7 +90,10 @@ func (nt *noiseTransport) Listen(h transport.Handler) error {
 		}
 		identity, present := nt.lookup[string(static)]
 		if !present {
-			panic("this is bad. Run. ")
+			// the verifier only accepts known keys
+			slog.Infof("noise: connection from unknown key")
+			conn.Close()
+			return
 		}
 		localHandler(identity, noiseConn)
 	}
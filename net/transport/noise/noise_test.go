@@ -6,6 +6,7 @@ import (
 	"github.com/nikkolasg/dsign/key"
 	"github.com/nikkolasg/dsign/net/transport"
 	"github.com/nikkolasg/dsign/net/transport/internal"
+	"github.com/stretchr/testify/require"
 )
 
 type noiseFactory struct{}
@@ -26,3 +27,18 @@ func (nf *noiseFactory) NewTransports(n int) ([]*key.Private, []transport.Transp
 func TestNoiseGeneric(t *testing.T) {
 	internal.TestTransport(t, new(noiseFactory))
 }
+
+func TestNoiseInvalidIdentity(t *testing.T) {
+	ids := internal.GenerateIDs(8100, 2)
+	forged := *ids[1].Public
+	forged.Address = "127.0.0.1:9000"
+	list := []*key.Identity{ids[0].Public, &forged}
+	tr := NewTCPNoiseTransport(ids[0], list)
+	defer tr.Close()
+
+	// forged identities are not part of the known peers
+	curve := forged.PublicCurve25519()
+	require.False(t, tr.(*noiseTransport).isIncluded(curve[:]))
+	_, err := tr.Dial(&forged)
+	require.NotNil(t, err)
+}
@@ -0,0 +1,323 @@
+// Package pgp encodes the group key and the distributed signatures of dsign in
+// the OpenPGP format (RFC 4880) using the EdDSA algorithm as specified in
+// draft-ietf-openpgp-rfc4880bis, so they can be used with GnuPG.
+//
+// Nothing is signed here: each Signature gives the digest that must be signed
+// with the distributed Ed25519 key and turns the resulting signature into an
+// OpenPGP signature packet.
+package pgp
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"math/big"
+	"time"
+
+	"github.com/dedis/kyber"
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+// Armor block types
+const (
+	ArmorPublicKey = "PGP PUBLIC KEY BLOCK"
+	ArmorSignature = "PGP SIGNATURE"
+)
+
+// Signature types
+const (
+	BinarySignature   = 0x00
+	TextSignature     = 0x01
+	PositiveCertifKey = 0x13
+)
+
+const (
+	tagSignature = 2
+	tagPublicKey = 6
+	tagUserID    = 13
+
+	algoEdDSA  = 22
+	hashSHA256 = 8
+
+	subCreationTime  = 2
+	subIssuer        = 16
+	subPreferredHash = 21
+	subKeyFlags      = 27
+	subIssuerFpr     = 33
+
+	flagCertify = 0x01
+	flagSign    = 0x02
+)
+
+// oid of the Ed25519 curve: 1.3.6.1.4.1.11591.15.1
+var ed25519Oid = []byte{0x2B, 0x06, 0x01, 0x04, 0x01, 0xDA, 0x47, 0x0F, 0x01}
+
+// PublicKey is an OpenPGP v4 EdDSA public key. Its fingerprint depends on its
+// creation time, so the same creation time must always be used for a given key.
+type PublicKey struct {
+	key     []byte // 32 bytes ed25519 public key
+	created time.Time
+}
+
+// NewPublicKey returns the OpenPGP public key of the given ed25519 point.
+func NewPublicKey(public kyber.Point, created time.Time) (*PublicKey, error) {
+	buff, err := public.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	if len(buff) != 32 {
+		return nil, errors.New("pgp: public key is not an ed25519 point")
+	}
+	return &PublicKey{key: buff, created: created}, nil
+}
+
+// Created returns the creation time of the key.
+func (p *PublicKey) Created() time.Time {
+	return p.created
+}
+
+// body returns the content of the public key packet.
+func (p *PublicKey) body() []byte {
+	var b bytes.Buffer
+	b.WriteByte(4)
+	binary.Write(&b, binary.BigEndian, uint32(p.created.Unix()))
+	b.WriteByte(algoEdDSA)
+	b.WriteByte(byte(len(ed25519Oid)))
+	b.Write(ed25519Oid)
+	// native point format
+	writeMPI(&b, append([]byte{0x40}, p.key...))
+	return b.Bytes()
+}
+
+// Packet returns the public key packet.
+func (p *PublicKey) Packet() []byte {
+	return packet(tagPublicKey, p.body())
+}
+
+// Fingerprint returns the v4 fingerprint of the key.
+func (p *PublicKey) Fingerprint() []byte {
+	h := sha1.New()
+	h.Write(p.hashPrefix())
+	return h.Sum(nil)
+}
+
+// KeyID returns the key id of the key, i.e. the low 64 bits of its
+// fingerprint.
+func (p *PublicKey) KeyID() uint64 {
+	fpr := p.Fingerprint()
+	return binary.BigEndian.Uint64(fpr[12:20])
+}
+
+// hashPrefix returns the key as it is hashed in fingerprints and
+// certifications.
+func (p *PublicKey) hashPrefix() []byte {
+	body := p.body()
+	var b bytes.Buffer
+	b.WriteByte(0x99)
+	binary.Write(&b, binary.BigEndian, uint16(len(body)))
+	b.Write(body)
+	return b.Bytes()
+}
+
+// UserID returns the OpenPGP user id "Name (Comment) <Email>" with the empty
+// parts left out.
+func UserID(name, comment, email string) string {
+	var b bytes.Buffer
+	b.WriteString(name)
+	if comment != "" {
+		if b.Len() > 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteString("(" + comment + ")")
+	}
+	if email != "" {
+		if b.Len() > 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteString("<" + email + ">")
+	}
+	return b.String()
+}
+
+// UserIDPacket returns the user id packet of the given user id.
+func UserIDPacket(uid string) []byte {
+	return packet(tagUserID, []byte(uid))
+}
+
+// Signature is an OpenPGP v4 EdDSA signature made by the group key. The
+// digest must be signed with Ed25519, the resulting signature is then given to
+// Packet.
+type Signature struct {
+	sigType byte
+	issuer  *PublicKey
+	created time.Time
+	data    []byte // hashed before the signature fields
+}
+
+// NewCertification returns the positive self certification of the user id by
+// the given key. The signature creation time is the same as the key's.
+func NewCertification(pub *PublicKey, uid string) *Signature {
+	var b bytes.Buffer
+	b.Write(pub.hashPrefix())
+	b.WriteByte(0xB4)
+	binary.Write(&b, binary.BigEndian, uint32(len(uid)))
+	b.WriteString(uid)
+	return &Signature{
+		sigType: PositiveCertifKey,
+		issuer:  pub,
+		created: pub.created,
+		data:    b.Bytes(),
+	}
+}
+
+// NewDocumentSignature returns the signature of the given document by the
+// given key, created at the given time. A text signature signs the document
+// with its line endings converted to <CR><LF>, as GnuPG does with --textmode.
+func NewDocumentSignature(pub *PublicKey, doc []byte, text bool, created time.Time) *Signature {
+	sigType := byte(BinarySignature)
+	if text {
+		sigType = TextSignature
+		doc = canonicalText(doc)
+	}
+	return &Signature{
+		sigType: sigType,
+		issuer:  pub,
+		created: created,
+		data:    doc,
+	}
+}
+
+// ArmoredPacket returns the armored signature packet, as found in detached
+// ".asc" signature files.
+func (s *Signature) ArmoredPacket(sig []byte) (string, error) {
+	packet, err := s.Packet(sig)
+	if err != nil {
+		return "", err
+	}
+	return Armor(ArmorSignature, packet)
+}
+
+// canonicalText converts all line endings to <CR><LF>.
+func canonicalText(doc []byte) []byte {
+	doc = bytes.Replace(doc, []byte("\r\n"), []byte("\n"), -1)
+	return bytes.Replace(doc, []byte("\n"), []byte("\r\n"), -1)
+}
+
+// hashedPart returns the signature fields covered by the digest.
+func (s *Signature) hashedPart() []byte {
+	var sub bytes.Buffer
+	created := make([]byte, 4)
+	binary.BigEndian.PutUint32(created, uint32(s.created.Unix()))
+	writeSubpacket(&sub, subCreationTime, created)
+	writeSubpacket(&sub, subIssuerFpr, append([]byte{4}, s.issuer.Fingerprint()...))
+	if s.sigType == PositiveCertifKey {
+		writeSubpacket(&sub, subKeyFlags, []byte{flagCertify | flagSign})
+		writeSubpacket(&sub, subPreferredHash, []byte{hashSHA256})
+	}
+	var b bytes.Buffer
+	b.WriteByte(4)
+	b.WriteByte(s.sigType)
+	b.WriteByte(algoEdDSA)
+	b.WriteByte(hashSHA256)
+	binary.Write(&b, binary.BigEndian, uint16(sub.Len()))
+	b.Write(sub.Bytes())
+	return b.Bytes()
+}
+
+// Digest returns the SHA-256 digest to sign with the group key.
+func (s *Signature) Digest() []byte {
+	hashed := s.hashedPart()
+	h := sha256.New()
+	h.Write(s.data)
+	h.Write(hashed)
+	// trailer
+	h.Write([]byte{4, 0xFF})
+	binary.Write(h, binary.BigEndian, uint32(len(hashed)))
+	return h.Sum(nil)
+}
+
+// Packet returns the signature packet containing the given 64 bytes Ed25519
+// signature of the digest.
+func (s *Signature) Packet(sig []byte) ([]byte, error) {
+	if len(sig) != 64 {
+		return nil, errors.New("pgp: invalid ed25519 signature length")
+	}
+	var b bytes.Buffer
+	b.Write(s.hashedPart())
+	var unhashed bytes.Buffer
+	issuer := make([]byte, 8)
+	binary.BigEndian.PutUint64(issuer, s.issuer.KeyID())
+	writeSubpacket(&unhashed, subIssuer, issuer)
+	binary.Write(&b, binary.BigEndian, uint16(unhashed.Len()))
+	b.Write(unhashed.Bytes())
+	b.Write(s.Digest()[:2])
+	writeMPI(&b, sig[:32])
+	writeMPI(&b, sig[32:])
+	return packet(tagSignature, b.Bytes()), nil
+}
+
+// PublicKeyBlock returns the armored public key block containing the key, the
+// user id and its certification packet.
+func PublicKeyBlock(pub *PublicKey, uid string, certification []byte) (string, error) {
+	var b bytes.Buffer
+	b.Write(pub.Packet())
+	b.Write(UserIDPacket(uid))
+	b.Write(certification)
+	return Armor(ArmorPublicKey, b.Bytes())
+}
+
+// Armor returns the ASCII armored data.
+func Armor(blockType string, data []byte) (string, error) {
+	var b bytes.Buffer
+	w, err := armor.Encode(&b, blockType, nil)
+	if err != nil {
+		return "", err
+	}
+	if _, err := w.Write(data); err != nil {
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+	b.WriteByte('\n')
+	return b.String(), nil
+}
+
+// packet returns the packet with the given tag, using the new packet format.
+func packet(tag byte, body []byte) []byte {
+	var b bytes.Buffer
+	b.WriteByte(0xC0 | tag)
+	writeLength(&b, len(body))
+	b.Write(body)
+	return b.Bytes()
+}
+
+func writeLength(b *bytes.Buffer, l int) {
+	switch {
+	case l < 192:
+		b.WriteByte(byte(l))
+	case l < 8384:
+		l -= 192
+		b.WriteByte(byte(l>>8) + 192)
+		b.WriteByte(byte(l))
+	default:
+		b.WriteByte(0xFF)
+		binary.Write(b, binary.BigEndian, uint32(l))
+	}
+}
+
+func writeSubpacket(b *bytes.Buffer, typ byte, content []byte) {
+	writeLength(b, len(content)+1)
+	b.WriteByte(typ)
+	b.Write(content)
+}
+
+// writeMPI writes the big endian integer as a multiprecision integer, i.e. its
+// length in bits followed by its bytes without the leading zeros.
+func writeMPI(b *bytes.Buffer, i []byte) {
+	n := new(big.Int).SetBytes(i)
+	binary.Write(b, binary.BigEndian, uint16(n.BitLen()))
+	b.Write(n.Bytes())
+}
@@ -0,0 +1,87 @@
+package pgp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nikkolasg/dsign/key"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+func newKey(t *testing.T) (*PublicKey, ed25519.PrivateKey) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.Nil(t, err)
+	point := key.Curve.Point()
+	require.Nil(t, point.UnmarshalBinary(pub))
+	p, err := NewPublicKey(point, time.Unix(1500000000, 0))
+	require.Nil(t, err)
+	return p, priv
+}
+
+func TestUserID(t *testing.T) {
+	require.Equal(t, "dsign (release key) <dsign@dsign.io>", UserID("dsign", "release key", "dsign@dsign.io"))
+	require.Equal(t, "dsign <dsign@dsign.io>", UserID("dsign", "", "dsign@dsign.io"))
+	require.Equal(t, "<dsign@dsign.io>", UserID("", "", "dsign@dsign.io"))
+}
+
+func TestPublicKey(t *testing.T) {
+	pub, _ := newKey(t)
+	packet := pub.Packet()
+	// new format public key packet, v4 EdDSA
+	require.Equal(t, byte(0xC6), packet[0])
+	require.Equal(t, int(packet[1]), len(packet)-2)
+	require.Equal(t, byte(4), packet[2])
+	require.Equal(t, byte(algoEdDSA), packet[7])
+	require.Len(t, pub.Fingerprint(), 20)
+	require.Equal(t, binary.BigEndian.Uint64(pub.Fingerprint()[12:]), pub.KeyID())
+}
+
+func TestCertification(t *testing.T) {
+	pub, priv := newKey(t)
+	uid := UserID("dsign", "", "dsign@dsign.io")
+	cert := NewCertification(pub, uid)
+	digest := cert.Digest()
+	require.Len(t, digest, 32)
+	sig := ed25519.Sign(priv, digest)
+
+	packet, err := cert.Packet(sig)
+	require.Nil(t, err)
+	require.Equal(t, byte(0xC2), packet[0])
+	_, err = cert.Packet(sig[:10])
+	require.NotNil(t, err)
+
+	block, err := PublicKeyBlock(pub, uid, packet)
+	require.Nil(t, err)
+	require.True(t, strings.Contains(block, ArmorPublicKey))
+	decoded, err := armor.Decode(strings.NewReader(block))
+	require.Nil(t, err)
+	var buff bytes.Buffer
+	_, err = buff.ReadFrom(decoded.Body)
+	require.Nil(t, err)
+	expected := append(append(pub.Packet(), UserIDPacket(uid)...), packet...)
+	require.Equal(t, expected, buff.Bytes())
+}
+
+func TestDocumentSignature(t *testing.T) {
+	pub, priv := newKey(t)
+	created := time.Unix(1600000000, 0)
+	doc := []byte("sha256 dsign-v1.0.tar.gz\nsha256 dsign-v1.1.tar.gz\n")
+
+	binary := NewDocumentSignature(pub, doc, false, created)
+	text := NewDocumentSignature(pub, doc, true, created)
+	crlf := NewDocumentSignature(pub, bytes.Replace(doc, []byte("\n"), []byte("\r\n"), -1), true, created)
+	require.NotEqual(t, binary.Digest(), text.Digest())
+	// line endings do not matter for text signatures
+	require.Equal(t, text.Digest(), crlf.Digest())
+
+	sig := ed25519.Sign(priv, text.Digest())
+	armored, err := text.ArmoredPacket(sig)
+	require.Nil(t, err)
+	require.True(t, strings.Contains(armored, ArmorSignature))
+}
@@ -0,0 +1,183 @@
+// Package ssh encodes the group key and the distributed signatures of dsign in
+// the OpenSSH formats: the group key as an "ssh-ed25519" authorized_keys line
+// and the signatures as armored SSHSIG blobs, as produced by "ssh-keygen -Y
+// sign" and accepted by "ssh-keygen -Y verify" and git.
+//
+// Nothing is signed here: each Signature gives the data that must be signed
+// with the distributed Ed25519 key and turns the resulting signature into an
+// armored SSHSIG blob.
+package ssh
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"strings"
+
+	"github.com/dedis/kyber"
+	"github.com/nikkolasg/dsign/key"
+)
+
+// KeyType is the OpenSSH name of the Ed25519 keys.
+const KeyType = "ssh-ed25519"
+
+// Hash algorithms supported in SSHSIG blobs.
+const (
+	HashSHA256 = "sha256"
+	HashSHA512 = "sha512"
+)
+
+// Armor lines of SSHSIG blobs.
+const (
+	ArmorBegin = "-----BEGIN SSH SIGNATURE-----"
+	ArmorEnd   = "-----END SSH SIGNATURE-----"
+)
+
+const (
+	magicPreamble = "SSHSIG"
+	sigVersion    = 1
+	armorWidth    = 70
+)
+
+// PublicKey returns the OpenSSH wire encoding of the given ed25519 point.
+func PublicKey(public kyber.Point) ([]byte, error) {
+	buff, err := public.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	var b bytes.Buffer
+	writeString(&b, []byte(KeyType))
+	writeString(&b, buff)
+	return b.Bytes(), nil
+}
+
+// AuthorizedKey returns the authorized_keys line of the given ed25519 point,
+// followed by the comment if not empty.
+func AuthorizedKey(public kyber.Point, comment string) (string, error) {
+	pub, err := PublicKey(public)
+	if err != nil {
+		return "", err
+	}
+	line := KeyType + " " + base64.StdEncoding.EncodeToString(pub)
+	if comment != "" {
+		line += " " + comment
+	}
+	return line, nil
+}
+
+// GroupAuthorizedKey returns the authorized_keys line of the public key of the
+// group, commented with the email of the group, or its name if there is none.
+func GroupAuthorizedKey(g *key.GroupIdentity) (string, error) {
+	if len(g.Public) == 0 {
+		return "", errors.New("ssh: group without public key")
+	}
+	comment := g.Email
+	if comment == "" {
+		comment = g.Name
+	}
+	return AuthorizedKey(g.Public[0], strings.Replace(comment, " ", "_", -1))
+}
+
+// Signature is a SSHSIG signature made by the group key. The data given by
+// SignedData must be signed with Ed25519, the resulting signature is then given
+// to Armored.
+type Signature struct {
+	pub       []byte // wire encoding of the public key
+	namespace string
+	hash      string
+	digest    []byte // hash of the message
+}
+
+// NewSignature returns the signature of the message by the given key, within
+// the given namespace, e.g. "git" or "file". The message is hashed with the
+// given hash algorithm, HashSHA512 being the default of ssh-keygen.
+func NewSignature(public kyber.Point, namespace, hash string, msg []byte) (*Signature, error) {
+	if namespace == "" {
+		return nil, errors.New("ssh: empty namespace")
+	}
+	var digest []byte
+	switch hash {
+	case HashSHA256:
+		d := sha256.Sum256(msg)
+		digest = d[:]
+	case HashSHA512:
+		d := sha512.Sum512(msg)
+		digest = d[:]
+	default:
+		return nil, errors.New("ssh: unsupported hash algorithm " + hash)
+	}
+	pub, err := PublicKey(public)
+	if err != nil {
+		return nil, err
+	}
+	return &Signature{
+		pub:       pub,
+		namespace: namespace,
+		hash:      hash,
+		digest:    digest,
+	}, nil
+}
+
+// SignedData returns the data to sign with the group key.
+func (s *Signature) SignedData() []byte {
+	var b bytes.Buffer
+	b.WriteString(magicPreamble)
+	writeString(&b, []byte(s.namespace))
+	writeString(&b, nil) // reserved
+	writeString(&b, []byte(s.hash))
+	writeString(&b, s.digest)
+	return b.Bytes()
+}
+
+// Blob returns the SSHSIG blob containing the given 64 bytes Ed25519
+// signature of the signed data.
+func (s *Signature) Blob(sig []byte) ([]byte, error) {
+	if len(sig) != 64 {
+		return nil, errors.New("ssh: invalid ed25519 signature length")
+	}
+	var inner bytes.Buffer
+	writeString(&inner, []byte(KeyType))
+	writeString(&inner, sig)
+
+	var b bytes.Buffer
+	b.WriteString(magicPreamble)
+	var version [4]byte
+	binary.BigEndian.PutUint32(version[:], sigVersion)
+	b.Write(version[:])
+	writeString(&b, s.pub)
+	writeString(&b, []byte(s.namespace))
+	writeString(&b, nil) // reserved
+	writeString(&b, []byte(s.hash))
+	writeString(&b, inner.Bytes())
+	return b.Bytes(), nil
+}
+
+// Armored returns the armored SSHSIG blob, as found in ".sig" files written by
+// ssh-keygen.
+func (s *Signature) Armored(sig []byte) (string, error) {
+	blob, err := s.Blob(sig)
+	if err != nil {
+		return "", err
+	}
+	encoded := base64.StdEncoding.EncodeToString(blob)
+	var b bytes.Buffer
+	b.WriteString(ArmorBegin + "\n")
+	for len(encoded) > armorWidth {
+		b.WriteString(encoded[:armorWidth] + "\n")
+		encoded = encoded[armorWidth:]
+	}
+	b.WriteString(encoded + "\n")
+	b.WriteString(ArmorEnd + "\n")
+	return b.String(), nil
+}
+
+// writeString writes the data as a SSH string, i.e. prefixed by its length.
+func writeString(b *bytes.Buffer, data []byte) {
+	var l [4]byte
+	binary.BigEndian.PutUint32(l[:], uint32(len(data)))
+	b.Write(l[:])
+	b.Write(data)
+}
@@ -0,0 +1,83 @@
+package ssh
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/dedis/kyber"
+	"github.com/nikkolasg/dsign/key"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ed25519"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+func newKey(t *testing.T) (kyber.Point, ed25519.PrivateKey) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.Nil(t, err)
+	point := key.Curve.Point()
+	require.Nil(t, point.UnmarshalBinary(pub))
+	return point, priv
+}
+
+func TestAuthorizedKey(t *testing.T) {
+	point, priv := newKey(t)
+	line, err := AuthorizedKey(point, "dsign@dsign.io")
+	require.Nil(t, err)
+	parsed, comment, _, _, err := gossh.ParseAuthorizedKey([]byte(line))
+	require.Nil(t, err)
+	require.Equal(t, "dsign@dsign.io", comment)
+	require.Equal(t, KeyType, parsed.Type())
+
+	signer, err := gossh.NewSignerFromKey(priv)
+	require.Nil(t, err)
+	require.Equal(t, signer.PublicKey().Marshal(), parsed.Marshal())
+
+	g := &key.GroupIdentity{Name: "dsign group", Public: []kyber.Point{point}}
+	line, err = GroupAuthorizedKey(g)
+	require.Nil(t, err)
+	require.True(t, strings.HasSuffix(line, " dsign_group"))
+
+	_, err = GroupAuthorizedKey(&key.GroupIdentity{})
+	require.NotNil(t, err)
+}
+
+func TestSignature(t *testing.T) {
+	point, priv := newKey(t)
+	msg := []byte("tree 4b825dc642cb6eb9a060e54bf8d69288fbee4904\n")
+
+	_, err := NewSignature(point, "", HashSHA512, msg)
+	require.NotNil(t, err)
+	_, err = NewSignature(point, "git", "md5", msg)
+	require.NotNil(t, err)
+
+	s, err := NewSignature(point, "git", HashSHA512, msg)
+	require.Nil(t, err)
+	data := s.SignedData()
+	digest := sha512.Sum512(msg)
+	require.True(t, bytes.HasPrefix(data, []byte(magicPreamble)))
+	require.True(t, bytes.HasSuffix(data, digest[:]))
+
+	sig := ed25519.Sign(priv, data)
+	_, err = s.Armored(sig[:10])
+	require.NotNil(t, err)
+	armored, err := s.Armored(sig)
+	require.Nil(t, err)
+	lines := strings.Split(strings.TrimSpace(armored), "\n")
+	require.Equal(t, ArmorBegin, lines[0])
+	require.Equal(t, ArmorEnd, lines[len(lines)-1])
+	for _, l := range lines[1 : len(lines)-1] {
+		require.True(t, len(l) <= armorWidth)
+	}
+
+	blob, err := base64.StdEncoding.DecodeString(strings.Join(lines[1:len(lines)-1], ""))
+	require.Nil(t, err)
+	expected, err := s.Blob(sig)
+	require.Nil(t, err)
+	require.Equal(t, expected, blob)
+	// the signature is at the end of the blob, after the key type
+	require.True(t, bytes.HasSuffix(blob, sig))
+}
@@ -0,0 +1,735 @@
+// Package store provides a file based implementation of the core.Store
+// interface. It is the default store to use for any daemon built on
+// core.State.
+package store
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/nikkolasg/dsign/core"
+	"github.com/nikkolasg/dsign/dkg"
+	"github.com/nikkolasg/dsign/key"
+)
+
+const (
+	privateFile    = "key.private"
+	publicFile     = "key.public"
+	groupFile      = "group.toml"
+	checkpointFile = "checkpoint.toml"
+	journalFile    = "passphrase.journal"
+	longtermDir    = "longterms"
+	signatureDir   = "signatures"
+	fileExtension  = ".toml"
+	auditExtension = ".audit"
+
+	dirPerm     = 0700
+	privatePerm = 0600
+	publicPerm  = 0644
+)
+
+// FileStore is a core.Store saving everything under a single directory:
+//
+//	key.private          private key of the node
+//	key.public           public identity of the node
+//	group.toml           identity of the group
+//	checkpoint.toml      state of the running longterm key creation
+//	passphrase.journal   files to replace to finish a change of passphrase
+//	longterms/<id>.toml  longterm shares indexed by their key id
+//	longterms/<id>.audit audits of the creation of the longterm keys
+//	signatures/<id>.toml signature records indexed by their session id
+//
+// Every file is written atomically and private material is only readable by
+// its owner. If a passphrase is given, the private key, the longterm shares and
+// the checkpoint are also encrypted with it.
+type FileStore struct {
+	dir        string
+	passphrase []byte
+}
+
+var _ core.Store = (*FileStore)(nil)
+
+// ErrNotEncrypted is returned when reading private material which is not
+// encrypted although the store has a passphrase: it may have been replaced by
+// someone without the passphrase.
+var ErrNotEncrypted = errors.New("store: content is not encrypted with the passphrase")
+
+// NewFileStore returns a FileStore using the given directory. The directory is
+// created if it does not exist yet. A change of passphrase interrupted after
+// all the files have been encrypted again is finished first.
+func NewFileStore(dir string) (*FileStore, error) {
+	for _, d := range []string{dir, filepath.Join(dir, longtermDir), filepath.Join(dir, signatureDir)} {
+		if err := os.MkdirAll(d, dirPerm); err != nil {
+			return nil, err
+		}
+	}
+	f := &FileStore{dir: dir}
+	if err := f.recoverJournal(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// NewEncryptedFileStore returns a FileStore using the given directory which
+// encrypts the private key and the longterm shares with the passphrase.
+func NewEncryptedFileStore(dir string, passphrase []byte) (*FileStore, error) {
+	f, err := NewFileStore(dir)
+	if err != nil {
+		return nil, err
+	}
+	f.passphrase = passphrase
+	return f, nil
+}
+
+// ChangePassphrase encrypts the private key, the longterm shares and the
+// checkpoint with the new passphrase. A nil passphrase removes the encryption.
+// Every file is decrypted and encrypted again into a temporary file before any
+// of them is replaced, so a wrong current passphrase leaves the store
+// untouched. The temporary files are then listed in a journal, written
+// atomically, before replacing the files: if the process stops in between,
+// NewFileStore finishes the replacement. The store either uses the old or the
+// new passphrase for all its files.
+func (f *FileStore) ChangePassphrase(passphrase []byte) error {
+	next := &FileStore{dir: f.dir, passphrase: passphrase}
+	files := make(map[string]interface{})
+	if _, err := os.Stat(filepath.Join(f.dir, privateFile)); err == nil {
+		priv, err := f.LongtermKey()
+		if err != nil {
+			return err
+		}
+		if files[privateFile], err = next.privateToml(priv); err != nil {
+			return err
+		}
+	}
+	shares, err := f.LongtermShares()
+	if err != nil {
+		return err
+	}
+	for _, s := range shares {
+		name, err := longtermFile(s.KeyID)
+		if err != nil {
+			return err
+		}
+		if files[name], err = next.shareToml(s); err != nil {
+			return err
+		}
+	}
+	if c, err := f.LoadCheckpoint(); err == nil {
+		if files[checkpointFile], err = next.encodeCheckpoint(c); err != nil {
+			return err
+		}
+	} else if err != core.ErrNoCheckpoint {
+		return err
+	}
+
+	j := new(journalToml)
+	committed := false
+	defer func() {
+		if committed {
+			return
+		}
+		for _, r := range j.Renames {
+			os.Remove(filepath.Join(f.dir, r.From))
+		}
+	}()
+	for name, t := range files {
+		buff, err := encodeToml(t)
+		if err != nil {
+			return err
+		}
+		tmp, err := writeTemp(filepath.Join(f.dir, name), buff, privatePerm)
+		if err != nil {
+			return err
+		}
+		j.Renames = append(j.Renames, renameToml{From: filepath.Join(filepath.Dir(name), filepath.Base(tmp)), To: name})
+	}
+	if err := f.saveToml(journalFile, j, privatePerm); err != nil {
+		return err
+	}
+	committed = true
+	f.passphrase = passphrase
+	return f.replayJournal(j)
+}
+
+// journalToml lists the temporary files replacing the files of the store,
+// with paths relative to the directory of the store.
+type journalToml struct {
+	Renames []renameToml
+}
+
+type renameToml struct {
+	From string // temporary file
+	To   string // file replaced
+}
+
+// recoverJournal finishes the change of passphrase whose journal has been
+// written, if any.
+func (f *FileStore) recoverJournal() error {
+	buff, err := f.read(journalFile)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	j := new(journalToml)
+	if _, err := toml.Decode(buff, j); err != nil {
+		return err
+	}
+	for _, r := range j.Renames {
+		// only the private files are replaced, by temporary files next to them
+		if !isPrivateFile(r.To) || filepath.Dir(r.From) != filepath.Dir(r.To) ||
+			!strings.HasPrefix(filepath.Base(r.From), "."+filepath.Base(r.To)) {
+			return errors.New("store: invalid passphrase journal")
+		}
+	}
+	return f.replayJournal(j)
+}
+
+// replayJournal replaces the files listed in the journal and deletes it. The
+// files already replaced are skipped, so it can be run again after a crash.
+func (f *FileStore) replayJournal(j *journalToml) error {
+	for _, r := range j.Renames {
+		err := os.Rename(filepath.Join(f.dir, r.From), filepath.Join(f.dir, r.To))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	for _, d := range []string{f.dir, filepath.Join(f.dir, longtermDir)} {
+		if err := syncDir(d); err != nil {
+			return err
+		}
+	}
+	if err := os.Remove(filepath.Join(f.dir, journalFile)); err != nil {
+		return err
+	}
+	return syncDir(f.dir)
+}
+
+// isPrivateFile returns true if the given path, relative to the directory of
+// the store, is one of the files encrypted with the passphrase.
+func isPrivateFile(name string) bool {
+	if name == privateFile || name == checkpointFile {
+		return true
+	}
+	keyID := strings.TrimSuffix(filepath.Base(name), fileExtension)
+	expected, err := longtermFile(keyID)
+	return err == nil && expected == name
+}
+
+// SavePrivate saves the private key of the node as well as its public
+// identity.
+func (f *FileStore) SavePrivate(p *key.Private) error {
+	t, err := f.privateToml(p)
+	if err != nil {
+		return err
+	}
+	if err := f.saveToml(privateFile, t, privatePerm); err != nil {
+		return err
+	}
+	return f.saveToml(publicFile, p.Public.Toml(), publicPerm)
+}
+
+// LongtermKey implements the core.KeyStore interface. It returns the private
+// key saved with SavePrivate.
+func (f *FileStore) LongtermKey() (*key.Private, error) {
+	buff, err := f.read(privateFile)
+	if err != nil {
+		return nil, err
+	}
+	priv := new(key.Private)
+	switch {
+	case f.passphrase == nil:
+		err = priv.FromToml(buff)
+	case key.IsEncrypted(buff):
+		err = priv.FromEncryptedToml(buff, f.passphrase)
+	default:
+		err = ErrNotEncrypted
+	}
+	if err != nil {
+		return nil, err
+	}
+	if buff, err = f.read(publicFile); err != nil {
+		return nil, err
+	}
+	id := new(key.Identity)
+	if err := id.FromToml(buff); err != nil {
+		return nil, err
+	}
+	if !key.Curve.Point().Mul(priv.Scalar(), nil).Equal(id.Point()) {
+		return nil, errors.New("store: public identity does not match the private key")
+	}
+	priv.Public = id
+	return priv, nil
+}
+
+// LongtermShares implements the core.KeyStore interface.
+func (f *FileStore) LongtermShares() ([]*key.SharedPrivate, error) {
+	files, err := ioutil.ReadDir(filepath.Join(f.dir, longtermDir))
+	if err != nil {
+		return nil, err
+	}
+	var shares []*key.SharedPrivate
+	for _, fi := range files {
+		name := fi.Name()
+		if fi.IsDir() || !strings.HasSuffix(name, fileExtension) {
+			continue
+		}
+		s, err := f.LongtermShare(strings.TrimSuffix(name, fileExtension))
+		if err != nil {
+			return nil, err
+		}
+		shares = append(shares, s)
+	}
+	return shares, nil
+}
+
+// LongtermShare implements the core.KeyStore interface.
+func (f *FileStore) LongtermShare(keyID string) (*key.SharedPrivate, error) {
+	name, err := longtermFile(keyID)
+	if err != nil {
+		return nil, err
+	}
+	buff, err := f.read(name)
+	if err != nil {
+		return nil, err
+	}
+	s := new(key.SharedPrivate)
+	switch {
+	case f.passphrase == nil:
+		err = s.FromToml(buff)
+	case key.IsEncrypted(buff):
+		err = s.FromEncryptedToml(buff, f.passphrase)
+	default:
+		err = ErrNotEncrypted
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// SaveLongterm implements the core.KeyStore interface.
+func (f *FileStore) SaveLongterm(s *key.SharedPrivate) error {
+	name, err := longtermFile(s.KeyID)
+	if err != nil {
+		return err
+	}
+	t, err := f.shareToml(s)
+	if err != nil {
+		return err
+	}
+	return f.saveToml(name, t, privatePerm)
+}
+
+type auditToml struct {
+	KeyID string
+	// audit protobuf encoded then base64 encoded
+	Data string
+}
+
+// SaveAudit implements the core.KeyStore interface. The audit holds no secret
+// so it is never encrypted.
+func (f *FileStore) SaveAudit(keyID string, a *dkg.Audit) error {
+	name, err := auditFile(keyID)
+	if err != nil {
+		return err
+	}
+	buff, err := core.MarshalAudit(a)
+	if err != nil {
+		return err
+	}
+	t := &auditToml{KeyID: keyID, Data: base64.StdEncoding.EncodeToString(buff)}
+	return f.saveToml(name, t, publicPerm)
+}
+
+// LongtermAudit implements the core.KeyStore interface.
+func (f *FileStore) LongtermAudit(keyID string) (*dkg.Audit, error) {
+	name, err := auditFile(keyID)
+	if err != nil {
+		return nil, err
+	}
+	buff, err := f.read(name)
+	if os.IsNotExist(err) {
+		return nil, core.ErrNoAudit
+	} else if err != nil {
+		return nil, err
+	}
+	t := new(auditToml)
+	if _, err := toml.Decode(buff, t); err != nil {
+		return nil, err
+	}
+	if t.KeyID != keyID {
+		return nil, errors.New("store: audit of key " + t.KeyID + " saved for key " + keyID)
+	}
+	data, err := base64.StdEncoding.DecodeString(t.Data)
+	if err != nil {
+		return nil, err
+	}
+	return core.UnmarshalAudit(data)
+}
+
+// SaveGroup saves the identity of the group.
+func (f *FileStore) SaveGroup(g *key.GroupIdentity) error {
+	return f.saveToml(groupFile, g.Toml(), publicPerm)
+}
+
+// LoadGroup returns the identity of the group saved with SaveGroup.
+func (f *FileStore) LoadGroup() (*key.GroupIdentity, error) {
+	buff, err := f.read(groupFile)
+	if err != nil {
+		return nil, err
+	}
+	g := new(key.GroupIdentity)
+	if err := g.FromToml(buff); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+type checkpointToml struct {
+	SessionID string // hex encoded
+	// checkpoint protobuf encoded then base64 encoded, empty if encrypted
+	Data      string
+	Encrypted *key.Envelope
+}
+
+// SaveCheckpoint implements the core.CheckpointStore interface.
+func (f *FileStore) SaveCheckpoint(c *core.Checkpoint) error {
+	t, err := f.encodeCheckpoint(c)
+	if err != nil {
+		return err
+	}
+	return f.saveToml(checkpointFile, t, privatePerm)
+}
+
+// LoadCheckpoint implements the core.CheckpointStore interface.
+func (f *FileStore) LoadCheckpoint() (*core.Checkpoint, error) {
+	t, err := f.readCheckpoint()
+	if err != nil {
+		return nil, err
+	}
+	var buff []byte
+	switch {
+	case t.Encrypted != nil && f.passphrase == nil:
+		return nil, key.ErrEncrypted
+	case t.Encrypted != nil:
+		buff, err = t.Encrypted.Decrypt(f.passphrase)
+	case f.passphrase != nil:
+		return nil, ErrNotEncrypted
+	default:
+		buff, err = base64.StdEncoding.DecodeString(t.Data)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return core.UnmarshalCheckpoint(buff)
+}
+
+// DeleteCheckpoint implements the core.CheckpointStore interface.
+func (f *FileStore) DeleteCheckpoint(sessionID []byte) error {
+	t, err := f.readCheckpoint()
+	if err == core.ErrNoCheckpoint {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if t.SessionID != hex.EncodeToString(sessionID) {
+		return nil
+	}
+	return os.Remove(filepath.Join(f.dir, checkpointFile))
+}
+
+func (f *FileStore) readCheckpoint() (*checkpointToml, error) {
+	buff, err := f.read(checkpointFile)
+	if os.IsNotExist(err) {
+		return nil, core.ErrNoCheckpoint
+	} else if err != nil {
+		return nil, err
+	}
+	t := new(checkpointToml)
+	_, err = toml.Decode(buff, t)
+	return t, err
+}
+
+type signatureToml struct {
+	SessionID string
+	KeyID     string
+	Type      uint32
+	Message   string
+	Namespace string
+	// timestamp of the signature info
+	InfoTimestamp int64
+	Signature     string
+	// signature encoded according to its type, base64 encoded
+	Output    string
+	Signers   []signerToml
+	Timestamp string // RFC 3339 with nanoseconds
+}
+
+// signerToml holds the public part of the identity of a signer.
+type signerToml struct {
+	Key       string
+	Signature string
+	Address   string
+}
+
+// SaveSignature implements the core.SignatureStore interface. The record is
+// saved in a file named after its session id.
+func (f *FileStore) SaveSignature(r *core.SignatureRecord) error {
+	st := &signatureToml{
+		SessionID: hex.EncodeToString(r.SessionID),
+		KeyID:     r.KeyID,
+		Signature: hex.EncodeToString(r.Signature),
+		Output:    base64.StdEncoding.EncodeToString(r.Output),
+		Timestamp: r.Timestamp.Format(time.RFC3339Nano),
+	}
+	if r.Info != nil {
+		st.Type = r.Info.Type
+		st.Message = r.Info.Message
+		st.Namespace = r.Info.Namespace
+		st.InfoTimestamp = r.Info.Timestamp
+	}
+	for _, id := range r.Signers {
+		st.Signers = append(st.Signers, signerToml{
+			Key:       base64.StdEncoding.EncodeToString(id.Key),
+			Signature: base64.StdEncoding.EncodeToString(id.Signature),
+			Address:   id.Address,
+		})
+	}
+	return f.saveToml(signatureFile(r.SessionID), st, publicPerm)
+}
+
+// GetSignature implements the core.SignatureStore interface.
+func (f *FileStore) GetSignature(sessionID []byte) (*core.SignatureRecord, error) {
+	buff, err := f.read(signatureFile(sessionID))
+	if os.IsNotExist(err) {
+		return nil, core.ErrNoSignature
+	} else if err != nil {
+		return nil, err
+	}
+	return readSignature(buff)
+}
+
+// ListSignatures implements the core.SignatureStore interface.
+func (f *FileStore) ListSignatures(keyID string, since time.Time) ([]*core.SignatureRecord, error) {
+	files, err := ioutil.ReadDir(filepath.Join(f.dir, signatureDir))
+	if err != nil {
+		return nil, err
+	}
+	var records []*core.SignatureRecord
+	for _, fi := range files {
+		if fi.IsDir() || !strings.HasSuffix(fi.Name(), fileExtension) {
+			continue
+		}
+		buff, err := f.read(filepath.Join(signatureDir, fi.Name()))
+		if err != nil {
+			return nil, err
+		}
+		r, err := readSignature(buff)
+		if err != nil {
+			return nil, err
+		}
+		if keyID != "" && r.KeyID != keyID {
+			continue
+		}
+		if r.Timestamp.Before(since) {
+			continue
+		}
+		records = append(records, r)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Timestamp.Before(records[j].Timestamp)
+	})
+	return records, nil
+}
+
+func readSignature(buff string) (*core.SignatureRecord, error) {
+	st := new(signatureToml)
+	if _, err := toml.Decode(buff, st); err != nil {
+		return nil, err
+	}
+	sessionID, err := hex.DecodeString(st.SessionID)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := hex.DecodeString(st.Signature)
+	if err != nil {
+		return nil, err
+	}
+	output, err := base64.StdEncoding.DecodeString(st.Output)
+	if err != nil {
+		return nil, err
+	}
+	ts, err := time.Parse(time.RFC3339Nano, st.Timestamp)
+	if err != nil {
+		return nil, err
+	}
+	signers := make([]*key.Identity, len(st.Signers))
+	for i, s := range st.Signers {
+		public, err := base64.StdEncoding.DecodeString(s.Key)
+		if err != nil {
+			return nil, err
+		}
+		signature, err := base64.StdEncoding.DecodeString(s.Signature)
+		if err != nil {
+			return nil, err
+		}
+		if signers[i], err = key.NewIdentity(public, signature, s.Address); err != nil {
+			return nil, errors.New("store: invalid signer identity: " + err.Error())
+		}
+	}
+	return &core.SignatureRecord{
+		SessionID: sessionID,
+		KeyID:     st.KeyID,
+		Info: &core.SignatureInfo{
+			KeyID:     st.KeyID,
+			Type:      st.Type,
+			Message:   st.Message,
+			Namespace: st.Namespace,
+			Timestamp: st.InfoTimestamp,
+		},
+		Signature: sig,
+		Output:    output,
+		Signers:   signers,
+		Timestamp: ts,
+	}, nil
+}
+
+func signatureFile(sessionID []byte) string {
+	return filepath.Join(signatureDir, hex.EncodeToString(sessionID)+fileExtension)
+}
+
+// longtermFile returns the name of the file holding the longterm share of the
+// given key id. Key ids are hexadecimal so they can't escape the directory.
+func longtermFile(keyID string) (string, error) {
+	if _, err := hex.DecodeString(keyID); err != nil || keyID == "" {
+		return "", errors.New("store: invalid key id " + keyID)
+	}
+	return filepath.Join(longtermDir, keyID+fileExtension), nil
+}
+
+// auditFile returns the name of the file holding the audit of the given key id,
+// next to its longterm share.
+func auditFile(keyID string) (string, error) {
+	name, err := longtermFile(keyID)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(name, fileExtension) + auditExtension, nil
+}
+
+func (f *FileStore) read(name string) (string, error) {
+	buff, err := ioutil.ReadFile(filepath.Join(f.dir, name))
+	return string(buff), err
+}
+
+// privateToml returns the TOML-able private key, encrypted if the store has a
+// passphrase.
+func (f *FileStore) privateToml(p *key.Private) (interface{}, error) {
+	if f.passphrase == nil {
+		return p.Toml(), nil
+	}
+	return p.EncryptedToml(f.passphrase)
+}
+
+// shareToml returns the TOML-able share, encrypted if the store has a
+// passphrase.
+func (f *FileStore) shareToml(s *key.SharedPrivate) (interface{}, error) {
+	if f.passphrase == nil {
+		return s.Toml(), nil
+	}
+	return s.EncryptedToml(f.passphrase)
+}
+
+// encodeCheckpoint returns the TOML-able checkpoint, encrypted if the store
+// has a passphrase.
+func (f *FileStore) encodeCheckpoint(c *core.Checkpoint) (*checkpointToml, error) {
+	buff, err := core.MarshalCheckpoint(c)
+	if err != nil {
+		return nil, err
+	}
+	t := &checkpointToml{SessionID: hex.EncodeToString(c.SessionID)}
+	if f.passphrase == nil {
+		t.Data = base64.StdEncoding.EncodeToString(buff)
+		return t, nil
+	}
+	t.Encrypted, err = key.Encrypt(f.passphrase, buff)
+	return t, err
+}
+
+func (f *FileStore) saveToml(name string, t interface{}, perm os.FileMode) error {
+	buff, err := encodeToml(t)
+	if err != nil {
+		return err
+	}
+	return writeFile(filepath.Join(f.dir, name), buff, perm)
+}
+
+func encodeToml(t interface{}) ([]byte, error) {
+	var buff bytes.Buffer
+	err := toml.NewEncoder(&buff).Encode(t)
+	return buff.Bytes(), err
+}
+
+// writeFile atomically writes the data to the given path: the data is first
+// written to a temporary file in the same directory which is then renamed.
+func writeFile(path string, data []byte, perm os.FileMode) error {
+	tmp, err := writeTemp(path, data, perm)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	// make the rename durable
+	return syncDir(filepath.Dir(path))
+}
+
+// syncDir flushes the entries of the directory, e.g. after a rename.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// writeTemp writes the data to a temporary file next to the given path and
+// returns its name.
+func writeTemp(path string, data []byte, perm os.FileMode) (string, error) {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return "", err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return tmp.Name(), nil
+}
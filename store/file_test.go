@@ -0,0 +1,414 @@
+package store
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dedis/kyber"
+	"github.com/dedis/kyber/share"
+	dkgg "github.com/dedis/kyber/share/dkg/pedersen"
+	"github.com/nikkolasg/dsign/core"
+	"github.com/nikkolasg/dsign/dkg"
+	"github.com/nikkolasg/dsign/key"
+	"github.com/nikkolasg/dsign/test"
+	"github.com/stretchr/testify/require"
+)
+
+func newFileStore(t *testing.T) (*FileStore, func()) {
+	dir, err := ioutil.TempDir("", "dsign-store")
+	require.Nil(t, err)
+	f, err := NewFileStore(dir)
+	require.Nil(t, err)
+	return f, func() { os.RemoveAll(dir) }
+}
+
+func fakeShare(keyID string) *key.SharedPrivate {
+	c := key.Curve
+	return &key.SharedPrivate{
+		KeyID:    keyID,
+		FullName: "dsign",
+		Email:    "dsign@dsign.io",
+		Share: &dkgg.DistKeyShare{
+			Commits:     []kyber.Point{c.Point().Pick(c.RandomStream()), c.Point().Pick(c.RandomStream())},
+			Share:       &share.PriShare{I: 2, V: c.Scalar().Pick(c.RandomStream())},
+			PrivatePoly: []kyber.Scalar{c.Scalar().Pick(c.RandomStream()), c.Scalar().Pick(c.RandomStream())},
+		},
+	}
+}
+
+func TestFileStorePrivate(t *testing.T) {
+	f, clean := newFileStore(t)
+	defer clean()
+
+	_, err := f.LongtermKey()
+	require.NotNil(t, err)
+
+	priv, _ := test.FakeID("127.0.0.1:8000")
+	require.Nil(t, f.SavePrivate(priv))
+	priv2, err := f.LongtermKey()
+	require.Nil(t, err)
+	require.True(t, priv.Scalar().Equal(priv2.Scalar()))
+	require.Equal(t, priv.Public.Key, priv2.Public.Key)
+	require.Equal(t, priv.Public.Address, priv2.Public.Address)
+	require.Equal(t, priv.Public.ID, priv2.Public.ID)
+
+	fi, err := os.Stat(filepath.Join(f.dir, privateFile))
+	require.Nil(t, err)
+	require.Equal(t, os.FileMode(privatePerm), fi.Mode().Perm())
+
+	// public identity swapped
+	_, other := test.FakeID("127.0.0.1:8000")
+	require.Nil(t, f.saveToml(publicFile, other.Toml(), publicPerm))
+	_, err = f.LongtermKey()
+	require.NotNil(t, err)
+}
+
+func TestFileStoreLongterm(t *testing.T) {
+	f, clean := newFileStore(t)
+	defer clean()
+
+	shares, err := f.LongtermShares()
+	require.Nil(t, err)
+	require.Len(t, shares, 0)
+
+	s1 := fakeShare("0123456789abcdef")
+	s2 := fakeShare("fedcba9876543210")
+	require.Nil(t, f.SaveLongterm(s1))
+	require.Nil(t, f.SaveLongterm(s2))
+
+	s, err := f.LongtermShare(s1.KeyID)
+	require.Nil(t, err)
+	require.Equal(t, s1.FullName, s.FullName)
+	require.Equal(t, s1.Email, s.Email)
+	require.Equal(t, s1.Share.Share.I, s.Share.Share.I)
+	require.True(t, s1.Share.Share.V.Equal(s.Share.Share.V))
+	require.True(t, s1.Share.Public().Equal(s.Share.Public()))
+	require.Len(t, s.Share.PrivatePoly, len(s1.Share.PrivatePoly))
+	for i := range s1.Share.PrivatePoly {
+		require.True(t, s1.Share.PrivatePoly[i].Equal(s.Share.PrivatePoly[i]))
+	}
+
+	shares, err = f.LongtermShares()
+	require.Nil(t, err)
+	require.Len(t, shares, 2)
+
+	_, err = f.LongtermShare("unknown")
+	require.NotNil(t, err)
+	_, err = f.LongtermShare("../key")
+	require.NotNil(t, err)
+
+	path := filepath.Join(f.dir, longtermDir, s1.KeyID+fileExtension)
+	fi, err := os.Stat(path)
+	require.Nil(t, err)
+	require.Equal(t, os.FileMode(privatePerm), fi.Mode().Perm())
+
+	// no half decoded share
+	require.Nil(t, ioutil.WriteFile(path, []byte("FullName = \"dsign\"\nShare = 42\n"), privatePerm))
+	s, err = f.LongtermShare(s1.KeyID)
+	require.NotNil(t, err)
+	require.Nil(t, s)
+}
+
+func TestFileStoreGroup(t *testing.T) {
+	f, clean := newFileStore(t)
+	defer clean()
+
+	_, id1 := test.FakeID("127.0.0.1:8000")
+	_, id2 := test.FakeID("127.0.0.1:8001")
+	g := &key.GroupIdentity{
+		Name:   "dsign",
+		Email:  "dsign@dsign.io",
+		Public: fakeShare("00").Share.Commits,
+		Ids:    []key.Identity{*id1, *id2},
+		T:      2,
+	}
+	require.Nil(t, f.SaveGroup(g))
+	g2, err := f.LoadGroup()
+	require.Nil(t, err)
+	require.Equal(t, g.Name, g2.Name)
+	require.Equal(t, g.T, g2.T)
+	require.Len(t, g2.Public, len(g.Public))
+	for i := range g.Public {
+		require.True(t, g.Public[i].Equal(g2.Public[i]))
+	}
+	require.Len(t, g2.Ids, 2)
+	require.Equal(t, id2.Key, g2.Ids[1].Key)
+	require.Equal(t, id2.Address, g2.Ids[1].Address)
+	require.Equal(t, id2.ID, g2.Ids[1].ID)
+
+	// tampered identity
+	g.Ids[1].Address = "127.0.0.1:9000"
+	require.Nil(t, f.SaveGroup(g))
+	_, err = f.LoadGroup()
+	require.NotNil(t, err)
+}
+
+func TestFileStoreSignature(t *testing.T) {
+	f, clean := newFileStore(t)
+	defer clean()
+
+	_, err := f.GetSignature([]byte("session"))
+	require.Equal(t, core.ErrNoSignature, err)
+
+	_, id := test.FakeID("127.0.0.1:8000")
+	now := time.Now()
+	newRecord := func(session, keyID string, ts time.Time) *core.SignatureRecord {
+		return &core.SignatureRecord{
+			SessionID: []byte(session),
+			KeyID:     keyID,
+			Info:      &core.SignatureInfo{KeyID: keyID, Message: "Hello " + session},
+			Signature: []byte("signature " + session),
+			Output:    []byte("output " + session),
+			Signers:   []*key.Identity{id},
+			Timestamp: ts,
+		}
+	}
+	r1 := newRecord("session1", "0123456789abcdef", now.Add(-time.Hour))
+	r2 := newRecord("session2", "0123456789abcdef", now)
+	r3 := newRecord("session3", "fedcba9876543210", now.Add(-time.Minute))
+	for _, r := range []*core.SignatureRecord{r2, r1, r3} {
+		require.Nil(t, f.SaveSignature(r))
+	}
+
+	r, err := f.GetSignature(r1.SessionID)
+	require.Nil(t, err)
+	require.Equal(t, r1.SessionID, r.SessionID)
+	require.Equal(t, r1.Signature, r.Signature)
+	require.Equal(t, r1.Output, r.Output)
+	require.Equal(t, r1.Info.Message, r.Info.Message)
+	require.True(t, r1.Timestamp.Equal(r.Timestamp))
+	require.Len(t, r.Signers, 1)
+	require.True(t, id.Equals(r.Signers[0]))
+	require.Equal(t, id.Address, r.Signers[0].Address)
+	require.Equal(t, id.ID, r.Signers[0].ID)
+
+	records, err := f.ListSignatures(r1.KeyID, time.Time{})
+	require.Nil(t, err)
+	require.Len(t, records, 2)
+	require.Equal(t, r1.SessionID, records[0].SessionID)
+	require.Equal(t, r2.SessionID, records[1].SessionID)
+
+	records, err = f.ListSignatures(r1.KeyID, now.Add(-30*time.Minute))
+	require.Nil(t, err)
+	require.Len(t, records, 1)
+	require.Equal(t, r2.SessionID, records[0].SessionID)
+
+	records, err = f.ListSignatures("", time.Time{})
+	require.Nil(t, err)
+	require.Len(t, records, 3)
+
+	// tampered signer
+	id.Address = "127.0.0.1:9000"
+	require.Nil(t, f.SaveSignature(r1))
+	_, err = f.GetSignature(r1.SessionID)
+	require.NotNil(t, err)
+}
+
+func TestFileStoreAudit(t *testing.T) {
+	f, clean := newFileStore(t)
+	defer clean()
+
+	keyID := "0123456789abcdef"
+	_, err := f.LongtermAudit(keyID)
+	require.Equal(t, core.ErrNoAudit, err)
+
+	_, id := test.FakeID("127.0.0.1:8000")
+	a := &dkg.Audit{
+		Threshold: 2,
+		QUAL:      []uint32{0, 2},
+		Key:       key.Curve.Point().Pick(key.Curve.RandomStream()),
+		Signer:    id,
+		Signature: []byte("signature"),
+	}
+	require.Nil(t, f.SaveLongterm(fakeShare(keyID)))
+	require.Nil(t, f.SaveAudit(keyID, a))
+	require.NotNil(t, f.SaveAudit("../key", a))
+	a2, err := f.LongtermAudit(keyID)
+	require.Nil(t, err)
+	require.Equal(t, a.QUAL, a2.QUAL)
+	require.True(t, a.Key.Equal(a2.Key))
+	require.True(t, a.Signer.Equals(a2.Signer))
+	require.Equal(t, a.Signature, a2.Signature)
+
+	// the audit is public and not taken for a share
+	fi, err := os.Stat(filepath.Join(f.dir, longtermDir, keyID+auditExtension))
+	require.Nil(t, err)
+	require.Equal(t, os.FileMode(publicPerm), fi.Mode().Perm())
+	shares, err := f.LongtermShares()
+	require.Nil(t, err)
+	require.Len(t, shares, 1)
+}
+
+func fakeCheckpoint(session string) *core.Checkpoint {
+	_, id := test.FakeID("127.0.0.1:8000")
+	return &core.Checkpoint{
+		SessionID: []byte(session),
+		Proposal:  &core.LongtermProposal{FullName: "dsign", KeyID: "0123456789abcdef"},
+		Dkg: &dkg.Transcript{
+			Seed: []byte("seed"),
+			Packets: []*dkg.Received{{
+				From:   id,
+				Packet: &dkg.Packet{Response: &dkgg.Response{Index: 3}},
+			}},
+		},
+	}
+}
+
+func TestFileStoreCheckpoint(t *testing.T) {
+	f, clean := newFileStore(t)
+	defer clean()
+
+	_, err := f.LoadCheckpoint()
+	require.Equal(t, core.ErrNoCheckpoint, err)
+	require.Nil(t, f.DeleteCheckpoint([]byte("session")))
+
+	c := fakeCheckpoint("session")
+	require.Nil(t, f.SaveCheckpoint(c))
+	fi, err := os.Stat(filepath.Join(f.dir, checkpointFile))
+	require.Nil(t, err)
+	require.Equal(t, os.FileMode(privatePerm), fi.Mode().Perm())
+	c2, err := f.LoadCheckpoint()
+	require.Nil(t, err)
+	require.Equal(t, c.SessionID, c2.SessionID)
+	require.Equal(t, c.Proposal.KeyID, c2.Proposal.KeyID)
+	require.Equal(t, c.Dkg.Seed, c2.Dkg.Seed)
+	require.Len(t, c2.Dkg.Packets, 1)
+	require.True(t, c.Dkg.Packets[0].From.Equals(c2.Dkg.Packets[0].From))
+	require.Equal(t, uint32(3), c2.Dkg.Packets[0].Packet.Response.Index)
+
+	// only the checkpoint of the given session is deleted
+	require.Nil(t, f.DeleteCheckpoint([]byte("other")))
+	_, err = f.LoadCheckpoint()
+	require.Nil(t, err)
+	require.Nil(t, f.DeleteCheckpoint(c.SessionID))
+	_, err = f.LoadCheckpoint()
+	require.Equal(t, core.ErrNoCheckpoint, err)
+}
+
+func TestFileStoreEncrypted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dsign-store")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	pass := []byte("passphrase")
+	f, err := NewEncryptedFileStore(dir, pass)
+	require.Nil(t, err)
+
+	priv, _ := test.FakeID("127.0.0.1:8000")
+	s := fakeShare("0123456789abcdef")
+	require.Nil(t, f.SavePrivate(priv))
+	require.Nil(t, f.SaveLongterm(s))
+	c := fakeCheckpoint("session")
+	require.Nil(t, f.SaveCheckpoint(c))
+
+	// nothing readable without the passphrase
+	plain, err := NewFileStore(dir)
+	require.Nil(t, err)
+	_, err = plain.LongtermKey()
+	require.Equal(t, key.ErrEncrypted, err)
+	_, err = plain.LongtermShare(s.KeyID)
+	require.Equal(t, key.ErrEncrypted, err)
+	_, err = plain.LoadCheckpoint()
+	require.Equal(t, key.ErrEncrypted, err)
+	wrong, err := NewEncryptedFileStore(dir, []byte("wrong"))
+	require.Nil(t, err)
+	_, err = wrong.LongtermKey()
+	require.Equal(t, key.ErrDecryption, err)
+	require.NotNil(t, wrong.ChangePassphrase([]byte("new")))
+
+	priv2, err := f.LongtermKey()
+	require.Nil(t, err)
+	require.True(t, priv.Scalar().Equal(priv2.Scalar()))
+	s2, err := f.LongtermShare(s.KeyID)
+	require.Nil(t, err)
+	require.True(t, s.Share.Share.V.Equal(s2.Share.Share.V))
+
+	newPass := []byte("new passphrase")
+	require.Nil(t, f.ChangePassphrase(newPass))
+	_, err = f.LongtermShare(s.KeyID)
+	require.Nil(t, err)
+	_, err = f.LongtermKey()
+	require.Nil(t, err)
+	old, err := NewEncryptedFileStore(dir, pass)
+	require.Nil(t, err)
+	_, err = old.LongtermShare(s.KeyID)
+	require.Equal(t, key.ErrDecryption, err)
+	_, err = old.LoadCheckpoint()
+	require.Equal(t, key.ErrDecryption, err)
+
+	// removing the passphrase
+	require.Nil(t, f.ChangePassphrase(nil))
+	_, err = plain.LongtermKey()
+	require.Nil(t, err)
+	_, err = plain.LongtermShare(s.KeyID)
+	require.Nil(t, err)
+	c2, err := plain.LoadCheckpoint()
+	require.Nil(t, err)
+	require.Equal(t, c.Dkg.Seed, c2.Dkg.Seed)
+
+	// plaintext files are refused when a passphrase is expected
+	_, err = old.LongtermKey()
+	require.Equal(t, ErrNotEncrypted, err)
+	_, err = old.LongtermShare(s.KeyID)
+	require.Equal(t, ErrNotEncrypted, err)
+	_, err = old.LoadCheckpoint()
+	require.Equal(t, ErrNotEncrypted, err)
+}
+
+func TestFileStoreChangePassphraseRecovery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dsign-store")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	pass := []byte("passphrase")
+	f, err := NewEncryptedFileStore(dir, pass)
+	require.Nil(t, err)
+	priv, _ := test.FakeID("127.0.0.1:8000")
+	s := fakeShare("0123456789abcdef")
+	require.Nil(t, f.SavePrivate(priv))
+	require.Nil(t, f.SaveLongterm(s))
+
+	// the process stops once the journal is written, before replacing any
+	// file
+	newPass := []byte("new passphrase")
+	next := &FileStore{dir: dir, passphrase: newPass}
+	privToml, err := next.privateToml(priv)
+	require.Nil(t, err)
+	shareToml, err := next.shareToml(s)
+	require.Nil(t, err)
+	shareFile, err := longtermFile(s.KeyID)
+	require.Nil(t, err)
+	j := new(journalToml)
+	for name, t2 := range map[string]interface{}{privateFile: privToml, shareFile: shareToml} {
+		buff, err := encodeToml(t2)
+		require.Nil(t, err)
+		tmp, err := writeTemp(filepath.Join(dir, name), buff, privatePerm)
+		require.Nil(t, err)
+		j.Renames = append(j.Renames, renameToml{From: filepath.Join(filepath.Dir(name), filepath.Base(tmp)), To: name})
+	}
+	require.Nil(t, f.saveToml(journalFile, j, privatePerm))
+	_, err = f.LongtermKey()
+	require.Nil(t, err)
+
+	// the change is finished when the store is opened again
+	f, err = NewEncryptedFileStore(dir, newPass)
+	require.Nil(t, err)
+	_, err = os.Stat(filepath.Join(dir, journalFile))
+	require.True(t, os.IsNotExist(err))
+	priv2, err := f.LongtermKey()
+	require.Nil(t, err)
+	require.True(t, priv.Scalar().Equal(priv2.Scalar()))
+	_, err = f.LongtermShare(s.KeyID)
+	require.Nil(t, err)
+	old, err := NewEncryptedFileStore(dir, pass)
+	require.Nil(t, err)
+	_, err = old.LongtermShare(s.KeyID)
+	require.Equal(t, key.ErrDecryption, err)
+
+	// a journal replacing other files is refused
+	j = &journalToml{Renames: []renameToml{{From: "." + groupFile + "123", To: groupFile}}}
+	require.Nil(t, f.saveToml(journalFile, j, privatePerm))
+	_, err = NewFileStore(dir)
+	require.NotNil(t, err)
+}
@@ -0,0 +1,86 @@
+package test
+
+import (
+	"sync"
+
+	"github.com/nikkolasg/dsign/key"
+)
+
+// Mailbox keeps the packets sent between handlers until the test delivers
+// them, without any gateway. The test chooses the order of the packets and can
+// modify, delay or drop them, e.g. to restart a node at a precise point of a
+// protocol.
+type Mailbox[P any] struct {
+	Queue []*Queued[P]
+	// Copy, if set, returns the copy of a packet given to its recipient, as if
+	// received over the network.
+	Copy func(P) P
+	sync.Mutex
+}
+
+// Queued is a packet waiting in a Mailbox.
+type Queued[P any] struct {
+	From, To *key.Identity
+	Packet   P
+}
+
+// Outbox is the Network of a handler sending its packets to a Mailbox.
+type Outbox[P any] struct {
+	From *key.Identity
+	Box  *Mailbox[P]
+}
+
+// Send queues the packet in the mailbox.
+func (o *Outbox[P]) Send(to *key.Identity, p P) error {
+	o.Box.Lock()
+	defer o.Box.Unlock()
+	o.Box.Queue = append(o.Box.Queue, &Queued[P]{From: o.From, To: to, Packet: p})
+	return nil
+}
+
+// Edit calls f on every queued packet.
+func (m *Mailbox[P]) Edit(f func(*Queued[P])) {
+	m.Lock()
+	defer m.Unlock()
+	for _, q := range m.Queue {
+		f(q)
+	}
+}
+
+// Processor processes the packets of type P, as the dkg and dss handlers do.
+type Processor[P any] interface {
+	Process(from *key.Identity, packet P)
+}
+
+// Deliver gives the queued packets accepted by the filter, in order, to the
+// handler of their recipient until there is none left. handlers[i] is the
+// handler of list[i]. The other packets stay in the queue. The filter may
+// modify the packet it accepts.
+func Deliver[P any, H Processor[P]](m *Mailbox[P], list []*key.Identity, handlers []H, filter func(*Queued[P]) bool) {
+	for {
+		m.Lock()
+		next := -1
+		for i, q := range m.Queue {
+			if filter(q) {
+				next = i
+				break
+			}
+		}
+		if next < 0 {
+			m.Unlock()
+			return
+		}
+		q := m.Queue[next]
+		m.Queue = append(m.Queue[:next], m.Queue[next+1:]...)
+		m.Unlock()
+		packet := q.Packet
+		if m.Copy != nil {
+			packet = m.Copy(packet)
+		}
+		for i, id := range list {
+			if id.Equals(q.To) {
+				handlers[i].Process(q.From, packet)
+			}
+		}
+	}
+}
@@ -0,0 +1,307 @@
+package validator
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nikkolasg/dsign/core"
+)
+
+// DefaultApprovalTimeout is the time given to a human to answer a request if
+// none is given to NewApproval. It is shorter than core.DefaultSessionTimeout
+// so the session is still running once answered. The approval timeout is the
+// ValidationTimeout to give to core.Config.
+const DefaultApprovalTimeout = 4 * time.Minute
+
+// ErrUnknownRequest is returned when answering a request which is not
+// pending.
+var ErrUnknownRequest = errors.New("validator: unknown or already answered request")
+
+// Request is a longterm proposal or a signature info waiting for a human
+// approval. Only one of Longterm or Signature is set.
+type Request struct {
+	// random hex encoded identifier, so it can not be guessed by someone not
+	// allowed to list the pending requests
+	ID        string
+	Longterm  *core.LongtermProposal `json:",omitempty"`
+	Signature *core.SignatureInfo    `json:",omitempty"`
+	Received  time.Time
+	// hex encoded sha256 hash of the message to sign, so it can be compared
+	// with the hash of the file the custodian expects to sign
+	Hash string `json:",omitempty"`
+
+	answer chan answer
+	// order of arrival, to list the requests oldest first
+	seq uint64
+}
+
+type answer struct {
+	ok     bool
+	reason string
+}
+
+// Approval is a core.Validator asking a human to approve every request. Each
+// incoming request is kept in a pending queue until it is approved, denied or
+// the timeout is reached; meanwhile the validation blocks. Pending requests can
+// be listed and answered with Pending, Approve and Deny, or over HTTP through
+// ServeHTTP.
+//
+// An optional Validator can be given to NewApproval: its rules are checked
+// first and only requests accepted by it are presented to the human.
+type Approval struct {
+	timeout time.Duration
+	next    core.Validator
+	nextSeq uint64
+	pending map[string]*Request
+	notify  chan *Request
+	token   string
+	host    string
+
+	sync.Mutex
+}
+
+var _ core.Validator = (*Approval)(nil)
+
+// NewApproval returns an Approval validator. Requests not answered after the
+// timeout are denied; DefaultApprovalTimeout is used if timeout is zero. next
+// can be nil.
+func NewApproval(timeout time.Duration, next core.Validator) *Approval {
+	if timeout <= 0 {
+		timeout = DefaultApprovalTimeout
+	}
+	return &Approval{
+		timeout: timeout,
+		next:    next,
+		pending: make(map[string]*Request),
+		notify:  make(chan *Request, 16),
+		token:   randomHex(32),
+	}
+}
+
+// Token returns the secret generated for this process which must be given in
+// the Authorization header of every HTTP request, as "Bearer <token>".
+func (a *Approval) Token() string {
+	return a.token
+}
+
+// SetHost sets the host, with its port, the HTTP API is served on. Requests
+// with another Host or Origin header are rejected. If unset, only loopback
+// hosts are accepted.
+func (a *Approval) SetHost(host string) {
+	a.Lock()
+	defer a.Unlock()
+	a.host = host
+}
+
+// ValidateLongtermInfo implements the core.Validator interface. It blocks
+// until the proposal is answered or the timeout is reached.
+func (a *Approval) ValidateLongtermInfo(lp *core.LongtermProposal) (bool, string) {
+	if a.next != nil {
+		if ok, reason := a.next.ValidateLongtermInfo(lp); !ok {
+			return false, reason
+		}
+	}
+	return a.wait(&Request{Longterm: lp})
+}
+
+// ValidateSignatureInfo implements the core.Validator interface. It blocks
+// until the signature info is answered or the timeout is reached.
+func (a *Approval) ValidateSignatureInfo(si *core.SignatureInfo) (bool, string) {
+	if a.next != nil {
+		if ok, reason := a.next.ValidateSignatureInfo(si); !ok {
+			return false, reason
+		}
+	}
+	h := sha256.Sum256([]byte(si.Message))
+	return a.wait(&Request{Signature: si, Hash: hex.EncodeToString(h[:])})
+}
+
+// Notify returns a channel over which every new pending request is sent, so a
+// CLI can prompt the human as soon as possible. Requests are dropped from the
+// channel if nobody reads it, but they stay in the pending queue.
+func (a *Approval) Notify() <-chan *Request {
+	return a.notify
+}
+
+// Pending returns the requests waiting for an answer, oldest first.
+func (a *Approval) Pending() []*Request {
+	a.Lock()
+	defer a.Unlock()
+	requests := make([]*Request, 0, len(a.pending))
+	for _, r := range a.pending {
+		requests = append(requests, r)
+	}
+	sort.Slice(requests, func(i, j int) bool {
+		return requests[i].seq < requests[j].seq
+	})
+	return requests
+}
+
+// Approve accepts the given pending request.
+func (a *Approval) Approve(id string) error {
+	return a.answer(id, answer{ok: true})
+}
+
+// Deny rejects the given pending request. The reason is given back to the
+// session.
+func (a *Approval) Deny(id, reason string) error {
+	if reason == "" {
+		reason = "no reason given"
+	}
+	return a.answer(id, answer{reason: "Approval: denied: " + reason})
+}
+
+func (a *Approval) answer(id string, ans answer) error {
+	a.Lock()
+	defer a.Unlock()
+	r, ok := a.pending[id]
+	if !ok {
+		return ErrUnknownRequest
+	}
+	delete(a.pending, id)
+	r.answer <- ans
+	return nil
+}
+
+func (a *Approval) wait(r *Request) (bool, string) {
+	a.Lock()
+	a.nextSeq++
+	r.seq = a.nextSeq
+	r.ID = randomHex(16)
+	r.Received = time.Now()
+	r.answer = make(chan answer, 1)
+	a.pending[r.ID] = r
+	a.Unlock()
+
+	select {
+	case a.notify <- r:
+	default:
+	}
+
+	select {
+	case ans := <-r.answer:
+		return ans.ok, ans.reason
+	case <-time.After(a.timeout):
+	}
+	a.Lock()
+	defer a.Unlock()
+	// the answer may have been given in the meantime
+	select {
+	case ans := <-r.answer:
+		return ans.ok, ans.reason
+	default:
+	}
+	delete(a.pending, r.ID)
+	return false, fmt.Sprintf("Approval: no answer after %s", a.timeout)
+}
+
+// ServeHTTP implements the http.Handler interface to answer pending requests
+// from a local API:
+//
+//	GET  /pending             lists the pending requests in JSON
+//	POST /approve/<id>        approves the request
+//	POST /deny/<id>?reason=.. denies the request
+//
+// Every request must carry the Token in its Authorization header. Requests
+// whose Host or Origin is not the expected one are rejected, so a web page
+// can not answer through the browser of the custodian, even by rebinding its
+// domain name to a local address. It must still only be served on a local
+// interface or a unix socket.
+func (a *Approval) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if !a.allowedHost(req) {
+		http.Error(w, "forbidden host or origin", http.StatusForbidden)
+		return
+	}
+	if !a.authorized(req) {
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return
+	}
+	path := strings.Trim(req.URL.Path, "/")
+	if path == "pending" && req.Method == http.MethodGet {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(a.Pending())
+		return
+	}
+	parts := strings.Split(path, "/")
+	if len(parts) != 2 || req.Method != http.MethodPost {
+		http.NotFound(w, req)
+		return
+	}
+	id := parts[1]
+	var err error
+	switch parts[0] {
+	case "approve":
+		err = a.Approve(id)
+	case "deny":
+		err = a.Deny(id, req.FormValue("reason"))
+	default:
+		http.NotFound(w, req)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *Approval) authorized(req *http.Request) bool {
+	token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) == 1
+}
+
+// allowedHost checks the Host header is the expected one and, if the Origin
+// header is set as by browsers, that it designates the same host.
+func (a *Approval) allowedHost(req *http.Request) bool {
+	a.Lock()
+	expected := a.host
+	a.Unlock()
+	if expected != "" {
+		if !strings.EqualFold(req.Host, expected) {
+			return false
+		}
+	} else if !isLoopback(req.Host) {
+		return false
+	}
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, req.Host)
+}
+
+func isLoopback(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(strings.Trim(host, "[]"))
+	return ip != nil && ip.IsLoopback()
+}
+
+// randomHex returns n random bytes hex encoded.
+func randomHex(n int) string {
+	buff := make([]byte, n)
+	if _, err := rand.Read(buff); err != nil {
+		panic("validator: no randomness available: " + err.Error())
+	}
+	return hex.EncodeToString(buff)
+}
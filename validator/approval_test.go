@@ -0,0 +1,143 @@
+package validator
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nikkolasg/dsign/core"
+	"github.com/stretchr/testify/require"
+)
+
+type result struct {
+	ok     bool
+	reason string
+}
+
+func validateAsync(a *Approval, si *core.SignatureInfo) chan result {
+	ch := make(chan result, 1)
+	go func() {
+		ok, reason := a.ValidateSignatureInfo(si)
+		ch <- result{ok, reason}
+	}()
+	return ch
+}
+
+func TestApproval(t *testing.T) {
+	a := NewApproval(time.Second, nil)
+
+	approved := validateAsync(a, &core.SignatureInfo{Message: "release v1.0"})
+	r := <-a.Notify()
+	require.Equal(t, "release v1.0", r.Signature.Message)
+	require.Len(t, r.Hash, 64)
+	denied := validateAsync(a, &core.SignatureInfo{Message: "release v6.6.6"})
+	<-a.Notify()
+
+	pending := a.Pending()
+	require.Len(t, pending, 2)
+	require.Equal(t, r.ID, pending[0].ID)
+	require.NotEqual(t, pending[0].ID, pending[1].ID)
+
+	require.Nil(t, a.Approve(pending[0].ID))
+	require.Nil(t, a.Deny(pending[1].ID, "not a release"))
+	require.Equal(t, ErrUnknownRequest, a.Approve(pending[0].ID))
+
+	res := <-approved
+	require.True(t, res.ok)
+	res = <-denied
+	require.False(t, res.ok)
+	require.True(t, strings.Contains(res.reason, "not a release"))
+	require.Len(t, a.Pending(), 0)
+}
+
+func TestApprovalTimeout(t *testing.T) {
+	a := NewApproval(10*time.Millisecond, nil)
+	ok, reason := a.ValidateLongtermInfo(&core.LongtermProposal{FullName: "dsign"})
+	require.False(t, ok)
+	require.True(t, strings.HasPrefix(reason, "Approval"))
+	require.Len(t, a.Pending(), 0)
+}
+
+func TestApprovalNext(t *testing.T) {
+	p, err := PolicyFromToml(`
+[Signature]
+Types = [0]
+`)
+	require.Nil(t, err)
+	a := NewApproval(time.Second, p)
+	// rejected by the policy without asking anyone
+	ok, reason := a.ValidateSignatureInfo(&core.SignatureInfo{Type: 1})
+	require.False(t, ok)
+	require.True(t, strings.HasPrefix(reason, "Signature.Types"))
+	require.Len(t, a.Pending(), 0)
+}
+
+// do sends a request to the server with the given token, host and origin,
+// and returns the status code.
+func do(t *testing.T, method, url, token, host, origin string) int {
+	req, err := http.NewRequest(method, url, nil)
+	require.Nil(t, err)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	if host != "" {
+		req.Host = host
+	}
+	if origin != "" {
+		req.Header.Set("Origin", origin)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	require.Nil(t, err)
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestApprovalHTTP(t *testing.T) {
+	a := NewApproval(time.Second, nil)
+	server := httptest.NewServer(a)
+	defer server.Close()
+	token := a.Token()
+	require.Len(t, token, 64)
+	require.NotEqual(t, token, NewApproval(time.Second, nil).Token())
+
+	approved := validateAsync(a, &core.SignatureInfo{Message: "release v1.0"})
+	r := <-a.Notify()
+	denied := validateAsync(a, &core.SignatureInfo{Message: "release v6.6.6"})
+	r2 := <-a.Notify()
+
+	require.Equal(t, http.StatusOK, do(t, http.MethodGet, server.URL+"/pending", token, "", ""))
+	approve := server.URL + "/approve/" + r.ID
+	// no or wrong token
+	require.Equal(t, http.StatusUnauthorized, do(t, http.MethodGet, server.URL+"/pending", "", "", ""))
+	require.Equal(t, http.StatusUnauthorized, do(t, http.MethodPost, approve, "", "", ""))
+	require.Equal(t, http.StatusUnauthorized, do(t, http.MethodPost, approve, token[1:], "", ""))
+	// a page from another origin, or a domain rebound to the local address
+	require.Equal(t, http.StatusForbidden, do(t, http.MethodPost, approve, token, "", "http://evil.com"))
+	require.Equal(t, http.StatusForbidden, do(t, http.MethodPost, approve, token, "evil.com", ""))
+	require.Equal(t, http.StatusForbidden, do(t, http.MethodPost, approve, token, "evil.com", "http://evil.com"))
+	require.Len(t, a.Pending(), 2)
+
+	require.Equal(t, http.StatusNoContent, do(t, http.MethodPost, approve, token, "", server.URL))
+	require.Equal(t, http.StatusNoContent, do(t, http.MethodPost, server.URL+"/deny/"+r2.ID+"?reason=nope", token, "", ""))
+	require.Equal(t, http.StatusNotFound, do(t, http.MethodPost, approve, token, "", ""))
+
+	require.True(t, (<-approved).ok)
+	res := <-denied
+	require.False(t, res.ok)
+	require.True(t, strings.Contains(res.reason, "nope"))
+}
+
+func TestApprovalHTTPHost(t *testing.T) {
+	a := NewApproval(time.Second, nil)
+	server := httptest.NewServer(a)
+	defer server.Close()
+	pending := server.URL + "/pending"
+
+	require.Equal(t, http.StatusOK, do(t, http.MethodGet, pending, a.Token(), "localhost:1234", ""))
+	a.SetHost("dsign.local:1234")
+	require.Equal(t, http.StatusForbidden, do(t, http.MethodGet, pending, a.Token(), "", ""))
+	require.Equal(t, http.StatusForbidden, do(t, http.MethodGet, pending, a.Token(), "dsign.local:1234", "http://localhost:1234"))
+	require.Equal(t, http.StatusOK, do(t, http.MethodGet, pending, a.Token(), "dsign.local:1234", "http://dsign.local:1234"))
+}
@@ -0,0 +1,315 @@
+// Package validator provides implementations of the core.Validator interface.
+package validator
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/nikkolasg/dsign/core"
+)
+
+// Policy is a core.Validator accepting or rejecting requests according to a
+// set of rules read from a TOML file such as:
+//
+//	[Signature]
+//	# allowed values of SignatureInfo.Type
+//	Types = [0]
+//	# the message must match at least one of these regular expressions
+//	Messages = ["^release v[0-9.]+$"]
+//
+//	[Longterm]
+//	# allowed domains of the email of a new longterm key
+//	EmailDomains = ["dsign.io"]
+//
+//	# at most Max signatures per Period with the given key, or with each key
+//	# if KeyID is empty
+//	[[RateLimit]]
+//	KeyID = ""
+//	Max = 10
+//	Period = "1h"
+//
+//	# requests are only accepted inside one of the time windows
+//	[[TimeWindow]]
+//	Days = ["Mon", "Tue", "Wed", "Thu", "Fri"]
+//	Start = "09:00"
+//	End = "18:00"
+//	Location = "Europe/Zurich"
+//
+// Every section is optional: an empty policy accepts everything. Each
+// rejection returns the rule that failed as the reason.
+type Policy struct {
+	types        map[uint32]bool
+	messages     []*regexp.Regexp
+	emailDomains []string
+	limits       []*rateLimit
+	windows      []*timeWindow
+	now          func() time.Time
+
+	sync.Mutex
+}
+
+var _ core.Validator = (*Policy)(nil)
+
+type policyToml struct {
+	Signature  signatureToml
+	Longterm   longtermToml
+	RateLimit  []rateLimitToml
+	TimeWindow []timeWindowToml
+}
+
+type signatureToml struct {
+	Types    []uint32
+	Messages []string
+}
+
+type longtermToml struct {
+	EmailDomains []string
+}
+
+type rateLimitToml struct {
+	KeyID  string
+	Max    int
+	Period string
+}
+
+type timeWindowToml struct {
+	Days     []string
+	Start    string
+	End      string
+	Location string
+}
+
+// rateLimit keeps the time of the accepted signatures for each key.
+type rateLimit struct {
+	keyID  string
+	max    int
+	period time.Duration
+	seen   map[string][]time.Time
+}
+
+type timeWindow struct {
+	days     map[time.Weekday]bool
+	start    time.Duration // since midnight
+	end      time.Duration // since midnight
+	location *time.Location
+}
+
+// LoadPolicy reads the policy from the given TOML file.
+func LoadPolicy(path string) (*Policy, error) {
+	buff, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return PolicyFromToml(string(buff))
+}
+
+// PolicyFromToml parses the policy from the given TOML content.
+func PolicyFromToml(f string) (*Policy, error) {
+	pt := &policyToml{}
+	if _, err := toml.Decode(f, pt); err != nil {
+		return nil, err
+	}
+	p := &Policy{now: time.Now}
+	if len(pt.Signature.Types) > 0 {
+		p.types = make(map[uint32]bool)
+		for _, t := range pt.Signature.Types {
+			p.types[t] = true
+		}
+	}
+	for _, m := range pt.Signature.Messages {
+		r, err := regexp.Compile(m)
+		if err != nil {
+			return nil, fmt.Errorf("validator: invalid message rule %q: %s", m, err)
+		}
+		p.messages = append(p.messages, r)
+	}
+	for _, d := range pt.Longterm.EmailDomains {
+		p.emailDomains = append(p.emailDomains, strings.ToLower(d))
+	}
+	for i, rt := range pt.RateLimit {
+		period, err := time.ParseDuration(rt.Period)
+		if err != nil {
+			return nil, fmt.Errorf("validator: invalid period of rate limit %d: %s", i, err)
+		}
+		if rt.Max <= 0 || period <= 0 {
+			return nil, fmt.Errorf("validator: rate limit %d must have a positive max and period", i)
+		}
+		p.limits = append(p.limits, &rateLimit{
+			keyID:  rt.KeyID,
+			max:    rt.Max,
+			period: period,
+			seen:   make(map[string][]time.Time),
+		})
+	}
+	for i, wt := range pt.TimeWindow {
+		w, err := newTimeWindow(&wt)
+		if err != nil {
+			return nil, fmt.Errorf("validator: invalid time window %d: %s", i, err)
+		}
+		p.windows = append(p.windows, w)
+	}
+	return p, nil
+}
+
+// ValidateLongtermInfo implements the core.Validator interface.
+func (p *Policy) ValidateLongtermInfo(lp *core.LongtermProposal) (bool, string) {
+	p.Lock()
+	defer p.Unlock()
+	if ok, reason := p.checkWindows(); !ok {
+		return false, reason
+	}
+	if len(p.emailDomains) == 0 {
+		return true, ""
+	}
+	var domain string
+	if i := strings.LastIndex(lp.Email, "@"); i >= 0 {
+		domain = strings.ToLower(lp.Email[i+1:])
+	}
+	for _, d := range p.emailDomains {
+		if d == domain {
+			return true, ""
+		}
+	}
+	return false, fmt.Sprintf("Longterm.EmailDomains: domain of %q not allowed", lp.Email)
+}
+
+// ValidateSignatureInfo implements the core.Validator interface. An accepted
+// signature info counts for the rate limits.
+func (p *Policy) ValidateSignatureInfo(si *core.SignatureInfo) (bool, string) {
+	p.Lock()
+	defer p.Unlock()
+	if ok, reason := p.checkWindows(); !ok {
+		return false, reason
+	}
+	if p.types != nil && !p.types[si.Type] {
+		return false, fmt.Sprintf("Signature.Types: type %d not allowed", si.Type)
+	}
+	if len(p.messages) > 0 {
+		var matched bool
+		for _, r := range p.messages {
+			if r.MatchString(si.Message) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false, "Signature.Messages: message does not match any rule"
+		}
+	}
+	now := p.now()
+	for i, l := range p.limits {
+		if !l.allow(si.KeyID, now) {
+			return false, fmt.Sprintf("RateLimit[%d]: more than %d signatures with key %s in %s", i, l.max, si.KeyID, l.period)
+		}
+	}
+	for _, l := range p.limits {
+		l.add(si.KeyID, now)
+	}
+	return true, ""
+}
+
+func (p *Policy) checkWindows() (bool, string) {
+	if len(p.windows) == 0 {
+		return true, ""
+	}
+	now := p.now()
+	for _, w := range p.windows {
+		if w.contains(now) {
+			return true, ""
+		}
+	}
+	return false, "TimeWindow: outside of the allowed time windows"
+}
+
+// allow returns true if one more signature with the given key is within the
+// limit. It also forgets about the signatures older than the period.
+func (r *rateLimit) allow(keyID string, now time.Time) bool {
+	if r.keyID != "" && r.keyID != keyID {
+		return true
+	}
+	var recent []time.Time
+	for _, t := range r.seen[keyID] {
+		if now.Sub(t) < r.period {
+			recent = append(recent, t)
+		}
+	}
+	r.seen[keyID] = recent
+	return len(recent) < r.max
+}
+
+func (r *rateLimit) add(keyID string, now time.Time) {
+	if r.keyID != "" && r.keyID != keyID {
+		return
+	}
+	r.seen[keyID] = append(r.seen[keyID], now)
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+func newTimeWindow(wt *timeWindowToml) (*timeWindow, error) {
+	w := &timeWindow{location: time.UTC}
+	if wt.Location != "" {
+		loc, err := time.LoadLocation(wt.Location)
+		if err != nil {
+			return nil, err
+		}
+		w.location = loc
+	}
+	if len(wt.Days) > 0 {
+		w.days = make(map[time.Weekday]bool)
+		for _, d := range wt.Days {
+			day, ok := weekdays[strings.ToLower(d)]
+			if !ok {
+				return nil, errors.New("unknown day " + d)
+			}
+			w.days[day] = true
+		}
+	}
+	var err error
+	if w.start, err = parseClock(wt.Start, 0); err != nil {
+		return nil, err
+	}
+	if w.end, err = parseClock(wt.End, 24*time.Hour); err != nil {
+		return nil, err
+	}
+	if w.end <= w.start {
+		return nil, errors.New("end must be after start")
+	}
+	return w, nil
+}
+
+// parseClock parses a "15:04" time of the day into a duration since midnight.
+func parseClock(s string, def time.Duration) (time.Duration, error) {
+	if s == "" {
+		return def, nil
+	}
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+func (w *timeWindow) contains(t time.Time) bool {
+	t = t.In(w.location)
+	if w.days != nil && !w.days[t.Weekday()] {
+		return false
+	}
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, w.location)
+	since := t.Sub(midnight)
+	return since >= w.start && since < w.end
+}
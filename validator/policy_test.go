@@ -0,0 +1,139 @@
+package validator
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nikkolasg/dsign/core"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPolicyEmpty(t *testing.T) {
+	p, err := PolicyFromToml("")
+	require.Nil(t, err)
+	ok, _ := p.ValidateLongtermInfo(&core.LongtermProposal{Email: "anyone@anywhere"})
+	require.True(t, ok)
+	ok, _ = p.ValidateSignatureInfo(&core.SignatureInfo{Type: 42, Message: "anything"})
+	require.True(t, ok)
+}
+
+func TestPolicySignature(t *testing.T) {
+	p, err := PolicyFromToml(`
+[Signature]
+Types = [0, 2]
+Messages = ["^release v[0-9.]+$", "^hotfix"]
+`)
+	require.Nil(t, err)
+
+	ok, reason := p.ValidateSignatureInfo(&core.SignatureInfo{Type: 1, Message: "release v1.0"})
+	require.False(t, ok)
+	require.True(t, strings.HasPrefix(reason, "Signature.Types"))
+
+	ok, reason = p.ValidateSignatureInfo(&core.SignatureInfo{Type: 2, Message: "something else"})
+	require.False(t, ok)
+	require.True(t, strings.HasPrefix(reason, "Signature.Messages"))
+
+	ok, _ = p.ValidateSignatureInfo(&core.SignatureInfo{Type: 0, Message: "release v1.0.2"})
+	require.True(t, ok)
+	ok, _ = p.ValidateSignatureInfo(&core.SignatureInfo{Type: 2, Message: "hotfix 42"})
+	require.True(t, ok)
+
+	_, err = PolicyFromToml(`
+[Signature]
+Messages = ["("]
+`)
+	require.NotNil(t, err)
+}
+
+func TestPolicyLongterm(t *testing.T) {
+	p, err := PolicyFromToml(`
+[Longterm]
+EmailDomains = ["dsign.io"]
+`)
+	require.Nil(t, err)
+	ok, _ := p.ValidateLongtermInfo(&core.LongtermProposal{Email: "release@DSIGN.io"})
+	require.True(t, ok)
+	ok, reason := p.ValidateLongtermInfo(&core.LongtermProposal{Email: "release@dsign.io.evil.com"})
+	require.False(t, ok)
+	require.True(t, strings.HasPrefix(reason, "Longterm.EmailDomains"))
+	ok, _ = p.ValidateLongtermInfo(&core.LongtermProposal{Email: "release"})
+	require.False(t, ok)
+}
+
+func TestPolicyRateLimit(t *testing.T) {
+	p, err := PolicyFromToml(`
+[[RateLimit]]
+Max = 2
+Period = "1h"
+
+[[RateLimit]]
+KeyID = "release"
+Max = 1
+Period = "24h"
+`)
+	require.Nil(t, err)
+	now := time.Now()
+	p.now = func() time.Time { return now }
+
+	info := &core.SignatureInfo{KeyID: "infra"}
+	for i := 0; i < 2; i++ {
+		ok, _ := p.ValidateSignatureInfo(info)
+		require.True(t, ok)
+	}
+	ok, reason := p.ValidateSignatureInfo(info)
+	require.False(t, ok)
+	require.True(t, strings.HasPrefix(reason, "RateLimit[0]"))
+
+	// each key is counted separately
+	release := &core.SignatureInfo{KeyID: "release"}
+	ok, _ = p.ValidateSignatureInfo(release)
+	require.True(t, ok)
+	ok, reason = p.ValidateSignatureInfo(release)
+	require.False(t, ok)
+	require.True(t, strings.HasPrefix(reason, "RateLimit[1]"))
+
+	now = now.Add(time.Hour)
+	ok, _ = p.ValidateSignatureInfo(info)
+	require.True(t, ok)
+	ok, _ = p.ValidateSignatureInfo(release)
+	require.False(t, ok)
+
+	_, err = PolicyFromToml(`
+[[RateLimit]]
+Max = 1
+Period = "forever"
+`)
+	require.NotNil(t, err)
+}
+
+func TestPolicyTimeWindow(t *testing.T) {
+	p, err := PolicyFromToml(`
+[[TimeWindow]]
+Days = ["Mon", "Tue", "Wed", "Thu", "Fri"]
+Start = "09:00"
+End = "18:00"
+`)
+	require.Nil(t, err)
+	// a monday
+	now := time.Date(2018, time.January, 1, 10, 0, 0, 0, time.UTC)
+	p.now = func() time.Time { return now }
+	ok, _ := p.ValidateSignatureInfo(&core.SignatureInfo{})
+	require.True(t, ok)
+
+	now = now.Add(9 * time.Hour)
+	ok, reason := p.ValidateSignatureInfo(&core.SignatureInfo{})
+	require.False(t, ok)
+	require.True(t, strings.HasPrefix(reason, "TimeWindow"))
+
+	// a saturday
+	now = time.Date(2018, time.January, 6, 10, 0, 0, 0, time.UTC)
+	ok, _ = p.ValidateLongtermInfo(&core.LongtermProposal{})
+	require.False(t, ok)
+
+	_, err = PolicyFromToml(`
+[[TimeWindow]]
+Days = ["Someday"]
+`)
+	require.NotNil(t, err)
+}